@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"cursor-deepseek/usage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminHandler serves the /admin API. It is authenticated with the ADMIN_TOKEN rather
+// than client keys, and doesn't exist when no token is configured.
+//
+//	GET    /admin/config          active routes, keys and masking, without secrets
+//	POST   /admin/config/reload   reload CONFIG_FILE now
+//	GET    /admin/keys            client keys with their budget and spend
+//	POST   /admin/keys            create a client key: {"name", "upstream_key", "budget"}
+//	PATCH  /admin/keys/{name}     change a client key's "upstream_key" or "budget"
+//	DELETE /admin/keys/{name}     revoke a client key
+//	GET    /admin/usage           usage per key, from ?since=YYYY-MM-DD or the budget period
+//	POST   /admin/cache/flush     empty the response and summary caches
+//	GET    /admin/stats           traffic, errors, usage and cache hit rates for the dashboard
+//	GET    /admin/debug           keys whose requests are logged at debug level
+//	PUT    /admin/debug/{key}     log a key's requests at debug level
+//	DELETE /admin/debug/{key}     stop doing so
+//
+// The proxy has no circuit breakers, so there are no endpoints to inspect or reset them.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if cfg.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	rl := requestLogFrom(r.Context())
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		rl.errorf("Admin authentication failed")
+		writeOpenAIError(w, http.StatusUnauthorized, "authentication_error", "invalid_admin_token", "Invalid admin token")
+		return
+	}
+	rl.key = "admin"
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	resource, id, _ := strings.Cut(path, "/")
+	switch {
+	case path == "config" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, adminConfigView(cfg))
+	case path == "config/reload" && r.Method == http.MethodPost:
+		adminReload(w)
+	case path == "keys" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, adminKeys(cfg))
+	case path == "keys" && r.Method == http.MethodPost:
+		adminCreateKey(w, r)
+	case resource == "keys" && id != "" && r.Method == http.MethodPatch:
+		adminUpdateKey(w, r, id)
+	case resource == "keys" && id != "" && r.Method == http.MethodDelete:
+		adminRevokeKey(w, id)
+	case path == "usage" && r.Method == http.MethodGet:
+		adminUsage(w, r)
+	case path == "cache/flush" && r.Method == http.MethodPost:
+		adminFlushCaches(w)
+	case path == "stats" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, traffic.snapshot())
+	case path == "debug" && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"keys": debugKeys.list()})
+	case resource == "debug" && id != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		on := r.Method == http.MethodPut
+		debugKeys.set(id, on)
+		infoLog("Debug logging for key %s turned on: %v", id, on)
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"keys": debugKeys.list()})
+	default:
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "not_found", fmt.Sprintf("No admin endpoint %s /admin/%s", r.Method, path))
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminConfigView is the configuration as the admin API shows it, secrets left out
+func adminConfigView(cfg *Config) map[string]interface{} {
+	routes := make([]Route, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		routes[i] = route
+		routes[i].Endpoint = cfg.endpoint(&cfg.Routes[i])
+		if route.Upstream != nil {
+			upstream := route.Upstream.redacted()
+			routes[i].Upstream = &upstream
+		}
+	}
+	keys := make([]string, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		keys[i] = keyLabel(k)
+	}
+	return map[string]interface{}{
+		"config_file": configPath,
+		"upstream":    cfg.Upstream.redacted(),
+		"routes":      routes,
+		"keys":        keys,
+		"secret_keys": cfg.Secret != "", // Whether SECRET@<deepseek-api-key> is accepted
+		"mask":        cfg.Mask,
+		"cors":        cfg.CORS,
+	}
+}
+
+func adminReload(w http.ResponseWriter) {
+	if configPath == "" {
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "no_config_file", "The proxy is configured through the environment, there is no CONFIG_FILE to reload")
+		return
+	}
+	infoLog("Reloading %s through the admin API", configPath)
+	cfg, err := reloadConfig(configPath)
+	if err != nil {
+		writeOpenAIError(w, http.StatusUnprocessableEntity, "invalid_request_error", "invalid_config", err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, adminConfigView(cfg))
+}
+
+type adminKey struct {
+	Name      string  `json:"name"`
+	KeyPrefix string  `json:"key_prefix"`
+	Budget    float64 `json:"budget,omitempty"`
+	Spent     float64 `json:"spent"`
+}
+
+func adminKeys(cfg *Config) map[string]interface{} {
+	since := budgetStart(time.Now())
+	keys := make([]adminKey, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		prefix := k.Key
+		if len(prefix) > 12 {
+			prefix = prefix[:12]
+		}
+		keys[i] = adminKey{
+			Name:      keyLabel(k),
+			KeyPrefix: prefix,
+			Budget:    k.Budget,
+			Spent:     usageLedger.Total(keyLabel(k), since).Cost,
+		}
+	}
+	return map[string]interface{}{"budget_period": budgetPeriod, "keys": keys}
+}
+
+func adminCreateKey(w http.ResponseWriter, r *http.Request) {
+	if configPath == "" {
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "no_config_file", "Client keys are kept in the CONFIG_FILE, and the proxy runs without one")
+		return
+	}
+	var req struct {
+		Name        string  `json:"name"`
+		UpstreamKey string  `json:"upstream_key"`
+		Budget      float64 `json:"budget"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Name == "" || req.Budget < 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_key", `Send {"name": ..., "upstream_key": ..., "budget": ...} with a name and a budget that isn't negative`)
+		return
+	}
+	if req.UpstreamKey == "" {
+		req.UpstreamKey = "${DEEPSEEK_API_KEY}"
+	}
+	key, err := addClientKey(configPath, req.Name, req.UpstreamKey, req.Budget)
+	if err != nil {
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "invalid_key", err.Error())
+		return
+	}
+	infoLog("Created client key %s through the admin API", key.Name)
+	reloadConfig(configPath)
+	writeAdminJSON(w, http.StatusCreated, map[string]interface{}{"name": key.Name, "key": key.Key, "budget": key.Budget})
+}
+
+func adminUpdateKey(w http.ResponseWriter, r *http.Request, id string) {
+	if configPath == "" {
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "no_config_file", "Client keys are kept in the CONFIG_FILE, and the proxy runs without one")
+		return
+	}
+	var req struct {
+		UpstreamKey *string  `json:"upstream_key"`
+		Budget      *float64 `json:"budget"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil ||
+		(req.UpstreamKey != nil && *req.UpstreamKey == "") || (req.Budget != nil && *req.Budget < 0) {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_key", `Send {"upstream_key": ..., "budget": ...} with the settings to change, a budget that isn't negative`)
+		return
+	}
+	key, err := updateClientKey(configPath, id, func(k *ClientKey) {
+		if req.UpstreamKey != nil {
+			k.UpstreamKey = *req.UpstreamKey
+		}
+		if req.Budget != nil {
+			k.Budget = *req.Budget
+		}
+	})
+	if err != nil {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "not_found", err.Error())
+		return
+	}
+	infoLog("Updated client key %s through the admin API", keyLabel(key))
+	reloadConfig(configPath)
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"name": keyLabel(key), "budget": key.Budget})
+}
+
+func adminRevokeKey(w http.ResponseWriter, id string) {
+	if configPath == "" {
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "no_config_file", "Client keys are kept in the CONFIG_FILE, and the proxy runs without one")
+		return
+	}
+	key, err := removeClientKey(configPath, id)
+	if err != nil {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "not_found", err.Error())
+		return
+	}
+	infoLog("Revoked client key %s through the admin API", keyLabel(key))
+	reloadConfig(configPath)
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"revoked": keyLabel(key)})
+}
+
+func adminUsage(w http.ResponseWriter, r *http.Request) {
+	since := budgetStart(time.Now())
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_since", "since must be a date, YYYY-MM-DD")
+			return
+		}
+		since = t
+	}
+	totals := make(map[string]usage.Total)
+	for _, key := range usageLedger.Keys() {
+		totals[key] = usageLedger.Total(key, since)
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"since": since.Format("2006-01-02"), "keys": totals})
+}
+
+func adminFlushCaches(w http.ResponseWriter) {
+	flushed := []string{"summaries"}
+	summaryCache.Flush()
+	if responseCache != nil {
+		responseCache.Flush()
+		flushed = append(flushed, "responses")
+	}
+	infoLog("Flushed caches through the admin API: %s", strings.Join(flushed, ", "))
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"flushed": flushed})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/mockupstream"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	const token = "admin-token-0123456789"
+	savedPath := configPath
+	t.Cleanup(func() { configPath = savedPath })
+	configPath = filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(configPath, []byte(fmt.Sprintf("admin_token: %s\nsecret: %s\nendpoint: %s\nroutes:\n  - {model: gpt-4o, upstream_model: deepseek-chat}\n", token, testSecret, upstream.URL)), 0o600)
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConfig.Store(cfg)
+
+	admin := func(method, path, body, auth string) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&v)
+		return resp.StatusCode, v
+	}
+
+	if status, _ := admin(http.MethodGet, "/admin/config", "", testSecret+"@"+testAPIKey); status != http.StatusUnauthorized {
+		t.Errorf("client key accepted by the admin API: %d", status)
+	}
+	status, view := admin(http.MethodGet, "/admin/config", "", token)
+	if status != http.StatusOK || strings.Contains(fmt.Sprint(view), testSecret) || strings.Contains(fmt.Sprint(view), token) {
+		t.Errorf("got %d %v", status, view)
+	}
+
+	// A key created through the API can be used right away, and revoked again
+	status, created := admin(http.MethodPost, "/admin/keys", `{"name":"carol","upstream_key":"sk-carol","budget":2}`, token)
+	if status != http.StatusCreated {
+		t.Fatalf("got %d %v", status, created)
+	}
+	chat := func(key string) int {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(chatBody))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := chat(created["key"].(string)); status != http.StatusOK {
+		t.Errorf("new key got status %d", status)
+	}
+	if auth := upstream.Requests()[0].Header.Get("Authorization"); auth != "Bearer sk-carol" {
+		t.Errorf("upstream got %q", auth)
+	}
+	if _, keys := admin(http.MethodGet, "/admin/keys", "", token); !strings.Contains(fmt.Sprint(keys["keys"]), "carol") {
+		t.Errorf("got keys %v", keys)
+	}
+	// Its budget can be changed, and keys that don't exist are reported
+	if status, updated := admin(http.MethodPatch, "/admin/keys/carol", `{"budget":5}`, token); status != http.StatusOK || updated["budget"] != 5.0 {
+		t.Errorf("update got %d %v", status, updated)
+	}
+	if key := currentConfig().keys[created["key"].(string)]; key == nil || key.Budget != 5 || key.UpstreamKey != "sk-carol" {
+		t.Errorf("updated key is %+v", key)
+	}
+	if status, _ := admin(http.MethodPatch, "/admin/keys/carol", `{"budget":-1}`, token); status != http.StatusBadRequest {
+		t.Errorf("negative budget got %d", status)
+	}
+	if status, _ := admin(http.MethodPatch, "/admin/keys/dave", `{"budget":1}`, token); status != http.StatusNotFound {
+		t.Errorf("unknown key got %d", status)
+	}
+	if status, _ := admin(http.MethodDelete, "/admin/keys/carol", "", token); status != http.StatusOK {
+		t.Errorf("revoke got %d", status)
+	}
+	if status := chat(created["key"].(string)); status != http.StatusUnauthorized {
+		t.Errorf("revoked key got status %d", status)
+	}
+
+	// Debug logging for one key
+	var logs bytes.Buffer
+	savedFormat, savedOutput := logFormat, logOutput
+	logFormat, logOutput = "json", &logs
+	t.Cleanup(func() { logFormat, logOutput = savedFormat, savedOutput })
+	t.Cleanup(func() { debugKeys.set(keyFingerprint(testAPIKey), false) })
+	admin(http.MethodPut, "/admin/debug/"+keyFingerprint(testAPIKey), "", token)
+	decodeResponse(t, post(t, proxy, chatBody))
+	if !strings.Contains(logs.String(), `"level":"debug"`) {
+		t.Errorf("no debug lines logged for the key:\n%s", logs.String())
+	}
+
+	if status, flushed := admin(http.MethodPost, "/admin/cache/flush", "", token); status != http.StatusOK || flushed["flushed"] == nil {
+		t.Errorf("flush got %d %v", status, flushed)
+	}
+	if status, _ := admin(http.MethodGet, "/admin/nothing", "", token); status != http.StatusNotFound {
+		t.Errorf("unknown endpoint got %d", status)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.AdminToken = "admin-token-0123456789"
+	cfg.Mask.Patterns = []string{`account-(\d+)`}
+	useConfig(t, &cfg)
+	traffic = newTrafficStats()
+
+	resp, err := http.Get(proxy.URL + "/dashboard/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "dashboard.js") {
+		t.Fatalf("got %d %s", resp.StatusCode, page)
+	}
+
+	upstream.Enqueue(mockupstream.Reply{Content: "Hi"}, mockupstream.Reply{Status: http.StatusPaymentRequired, Error: "Insufficient Balance on account-4242"})
+	decodeResponse(t, post(t, proxy, chatBody))
+	post(t, proxy, chatBody).Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Requests int              `json:"requests"`
+		Errors   int              `json:"errors"`
+		Recent   []trafficRequest `json:"recent"`
+		Failures []trafficRequest `json:"failures"`
+		Keys     map[string]trafficTotal
+		Models   map[string]trafficTotal
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Requests != 2 || stats.Errors != 1 || len(stats.Recent) != 2 {
+		t.Errorf("got %d requests, %d errors, %d recent", stats.Requests, stats.Errors, len(stats.Recent))
+	}
+	if len(stats.Failures) != 1 || stats.Failures[0].UpstreamStatus != http.StatusPaymentRequired || !strings.Contains(stats.Failures[0].UpstreamBody, "Insufficient Balance") {
+		t.Errorf("got failures %+v", stats.Failures)
+	} else if strings.Contains(stats.Failures[0].UpstreamBody, "4242") {
+		t.Errorf("configured mask pattern not applied: %s", stats.Failures[0].UpstreamBody)
+	}
+	if stats.Keys[keyFingerprint(testAPIKey)].Requests != 2 || stats.Models["deepseek-chat"].Requests != 2 {
+		t.Errorf("got keys %+v, models %+v", stats.Keys, stats.Models)
+	}
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Cache stores values by key until they expire or are evicted
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	// Flush removes every entry
+	Flush()
+}
+
+// Key returns a content address for the given parts
+func Key(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Memory is an in-memory LRU cache with a TTL and limits on entry count and total size
+type Memory struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	order      *list.List // Most recently used first
+	items      map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewMemory creates a Memory cache. Zero ttl, maxEntries or maxBytes means no limit.
+func NewMemory(ttl time.Duration, maxEntries int, maxBytes int64) *Memory {
+	return &Memory{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (m *Memory) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxBytes > 0 && int64(len(value)) > m.maxBytes {
+		return
+	}
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+
+	entry := &memoryEntry{key: key, value: value}
+	if m.ttl > 0 {
+		entry.expires = time.Now().Add(m.ttl)
+	}
+	m.items[key] = m.order.PushFront(entry)
+	m.size += int64(len(value))
+
+	// Evict least recently used entries until within limits
+	for (m.maxEntries > 0 && m.order.Len() > m.maxEntries) || (m.maxBytes > 0 && m.size > m.maxBytes) {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *Memory) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order.Init()
+	m.items = make(map[string]*list.Element)
+	m.size = 0
+}
+
+// Len returns the number of entries, including expired ones not yet evicted
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+func (m *Memory) remove(el *list.Element) {
+	entry := m.order.Remove(el).(*memoryEntry)
+	delete(m.items, entry.key)
+	m.size -= int64(len(entry.value))
+}
+
+// Tiered checks a fast cache before a slow one and copies slow hits into the fast cache
+type Tiered struct {
+	Fast Cache
+	Slow Cache
+}
+
+func (t *Tiered) Get(key string) ([]byte, bool) {
+	if value, ok := t.Fast.Get(key); ok {
+		return value, true
+	}
+	value, ok := t.Slow.Get(key)
+	if ok {
+		t.Fast.Set(key, value)
+	}
+	return value, ok
+}
+
+func (t *Tiered) Set(key string, value []byte) {
+	t.Fast.Set(key, value)
+	t.Slow.Set(key, value)
+}
+
+func (t *Tiered) Flush() {
+	t.Fast.Flush()
+	t.Slow.Flush()
+}
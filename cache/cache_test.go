@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLRU(t *testing.T) {
+	m := NewMemory(0, 2, 0)
+	m.Set("a", []byte("1"))
+	m.Set("b", []byte("2"))
+	// Reading a makes b the least recently used
+	if value, ok := m.Get("a"); !ok || string(value) != "1" {
+		t.Fatalf("got %q, %v", value, ok)
+	}
+	m.Set("c", []byte("3"))
+	if _, ok := m.Get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := m.Get(key); !ok {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	m.Flush()
+	if m.Len() != 0 {
+		t.Errorf("got %d entries after a flush", m.Len())
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	m := NewMemory(0, 0, 8)
+	m.Set("a", []byte("aaaa"))
+	m.Set("b", []byte("bbbb"))
+	// Replacing an entry doesn't count its old value
+	m.Set("a", []byte("AAAA"))
+	if m.Len() != 2 {
+		t.Fatalf("got %d entries", m.Len())
+	}
+	m.Set("c", []byte("cc"))
+	if _, ok := m.Get("b"); ok {
+		t.Error("entry kept over the size limit")
+	}
+	m.Set("d", []byte("ddddddddd"))
+	if _, ok := m.Get("d"); ok {
+		t.Error("stored an entry larger than the limit")
+	}
+	if value, ok := m.Get("a"); !ok || string(value) != "AAAA" {
+		t.Errorf("got %q, %v", value, ok)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	m := NewMemory(20*time.Millisecond, 0, 0)
+	m.Set("a", []byte("1"))
+	if _, ok := m.Get("a"); !ok {
+		t.Fatal("entry expired early")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := m.Get("a"); ok {
+		t.Error("expired entry returned")
+	}
+	if m.Len() != 0 {
+		t.Errorf("expired entry kept, %d entries", m.Len())
+	}
+}
+
+func TestTiered(t *testing.T) {
+	fast, slow := NewMemory(0, 0, 0), NewMemory(0, 0, 0)
+	tiered := &Tiered{Fast: fast, Slow: slow}
+	slow.Set("a", []byte("1"))
+	if value, ok := tiered.Get("a"); !ok || string(value) != "1" {
+		t.Fatalf("got %q, %v", value, ok)
+	}
+	if _, ok := fast.Get("a"); !ok {
+		t.Error("slow hit not copied into the fast cache")
+	}
+	tiered.Set("b", []byte("2"))
+	if _, ok := slow.Get("b"); !ok {
+		t.Error("entry not written to the slow cache")
+	}
+	tiered.Flush()
+	if fast.Len() != 0 || slow.Len() != 0 {
+		t.Error("flush left entries")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if Key([]byte("ab"), []byte("c")) == Key([]byte("a"), []byte("bc")) {
+		t.Error("keys of different parts collide")
+	}
+	if Key([]byte("a")) != Key([]byte("a")) {
+		t.Error("key isn't stable")
+	}
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskSuffix = ".cache"
+
+// Disk stores entries as files in a directory, using the modification time for expiry
+// so entries survive restarts. The files are listed once, when the cache is created,
+// and tracked in memory from then on.
+type Disk struct {
+	mu       sync.Mutex
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	size     int64
+	order    *list.List // Most recently written first
+	files    map[string]*list.Element
+}
+
+// NewDisk creates a Disk cache in dir, creating the directory if needed.
+// Zero ttl or maxBytes means no limit.
+func NewDisk(dir string, ttl time.Duration, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &Disk{dir: dir, ttl: ttl, maxBytes: maxBytes, order: list.New(), files: make(map[string]*list.Element)}
+	entries := d.entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, entry := range entries {
+		d.add(entry)
+	}
+	d.evict()
+	return d, nil
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.dir, key+diskSuffix)
+}
+
+func (d *Disk) Get(key string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		d.forget(path)
+		return nil, false
+	}
+	if d.ttl > 0 && time.Since(info.ModTime()) > d.ttl {
+		d.remove(path)
+		return nil, false
+	}
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (d *Disk) Set(key string, value []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.maxBytes > 0 && int64(len(value)) > d.maxBytes {
+		return
+	}
+	// Write to a temporary file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(d.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	path := d.path(key)
+	if err != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	d.forget(path)
+	d.add(diskEntry{path: path, size: int64(len(value)), modTime: time.Now()})
+	d.evict()
+}
+
+func (d *Disk) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, entry := range d.entries() {
+		os.Remove(entry.path)
+	}
+	d.order.Init()
+	d.files = make(map[string]*list.Element)
+	d.size = 0
+}
+
+// Len returns the number of entries, including expired ones not yet evicted
+func (d *Disk) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+type diskEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (d *Disk) entries() []diskEntry {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil
+	}
+	var entries []diskEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), diskSuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, diskEntry{path: filepath.Join(d.dir, f.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	return entries
+}
+
+// add tracks an entry newer than every tracked one
+func (d *Disk) add(entry diskEntry) {
+	d.files[entry.path] = d.order.PushFront(entry)
+	d.size += entry.size
+}
+
+// forget stops tracking the entry at path
+func (d *Disk) forget(path string) {
+	el, ok := d.files[path]
+	if !ok {
+		return
+	}
+	entry := d.order.Remove(el).(diskEntry)
+	delete(d.files, path)
+	d.size -= entry.size
+}
+
+func (d *Disk) remove(path string) {
+	d.forget(path)
+	os.Remove(path)
+}
+
+// evict removes expired entries, then the oldest ones until the total size fits
+func (d *Disk) evict() {
+	for el := d.order.Back(); el != nil; el = d.order.Back() {
+		entry := el.Value.(diskEntry)
+		expired := d.ttl > 0 && time.Since(entry.modTime) > d.ttl
+		if !expired && (d.maxBytes <= 0 || d.size <= d.maxBytes) {
+			break
+		}
+		d.remove(entry.path)
+	}
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskEviction(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("a", []byte("aaaa"))
+	d.Set("b", []byte("bbbb"))
+	// Rewriting an entry replaces its size rather than adding to it
+	d.Set("b", []byte("BBBB"))
+	if _, ok := d.Get("a"); !ok {
+		t.Fatal("entry evicted while within the limit")
+	}
+	d.Set("c", []byte("cccc"))
+	if _, ok := d.Get("a"); ok {
+		t.Error("oldest entry kept over the size limit")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a"+diskSuffix)); !os.IsNotExist(err) {
+		t.Errorf("evicted entry's file still exists: %v", err)
+	}
+	if value, ok := d.Get("b"); !ok || string(value) != "BBBB" {
+		t.Errorf("got %q, %v for b", value, ok)
+	}
+	if d.Len() != 2 {
+		t.Errorf("got %d entries", d.Len())
+	}
+	// Larger than the whole cache
+	d.Set("d", []byte("ddddddddddd"))
+	if _, ok := d.Get("d"); ok {
+		t.Error("stored an entry larger than the limit")
+	}
+
+	d.Flush()
+	if d.Len() != 0 {
+		t.Errorf("got %d entries after a flush", d.Len())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files after a flush", len(files))
+	}
+}
+
+func TestDiskReopen(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("old", []byte("old"))
+	d.Set("new", []byte("new"))
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "old"+diskSuffix), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries survive a restart and expired ones are removed
+	d, err = NewDisk(dir, time.Hour, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 1 {
+		t.Errorf("got %d entries after reopening", d.Len())
+	}
+	if value, ok := d.Get("new"); !ok || string(value) != "new" {
+		t.Errorf("got %q, %v after reopening", value, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old"+diskSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expired entry's file still exists: %v", err)
+	}
+	// Existing entries count towards the limit
+	d.Set("next", []byte("next"))
+	if _, ok := d.Get("new"); ok {
+		t.Error("entry from before the restart wasn't evicted")
+	}
+}
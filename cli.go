@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/recorder"
+	"cursor-deepseek/usage"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand of the proxy binary
+type command struct {
+	name    string
+	summary string
+	run     func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"serve", "Run the proxy (the default)", serve},
+	{"check-config", "Validate the configuration and exit", checkConfigCommand},
+	{"keys", "Create, revoke and list client keys in CONFIG_FILE", keysCommand},
+	{"mask", "Mask credentials in stdin and report how many were found", maskCommand},
+	{"replay", "Send recorded requests to a running proxy and compare the results", replayCommand},
+	{"usage", "Report token usage and cost from the usage ledger", usageCommand},
+}
+
+// errUsage means the arguments were wrong, the usage has been printed
+var errUsage = errors.New("invalid arguments")
+
+// runCommand runs the subcommand named by the first argument and returns the exit
+// status. Without arguments, or with flags only, the proxy is served.
+func runCommand(args []string, stdin io.Reader, stdout io.Writer) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args, stdin, stdout)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\nCommands:\n", name)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	return 2
+}
+
+// newFlagSet returns a flag set for a command that reports errors instead of exiting
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cursor-deepseek %s\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func checkConfigCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if err := newFlagSet("check-config", "check-config").Parse(args); err != nil {
+		return err
+	}
+	cfg, err := startupConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Configuration OK: %d routes (%s), %d keys, masking %v\n",
+		len(cfg.Routes), strings.Join(cfg.clientModels(), ", "), len(cfg.Keys), cfg.Mask.Enabled)
+	return nil
+}
+
+func keysCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cursor-deepseek keys create|revoke|list")
+		return errUsage
+	}
+	if configPath == "" {
+		return errors.New("client keys are kept in the configuration file, set CONFIG_FILE")
+	}
+	switch args[0] {
+	case "create":
+		return createKey(args[1:], stdout)
+	case "revoke":
+		return revokeKey(args[1:], stdout)
+	case "list":
+		return listKeys(args[1:], stdout)
+	}
+	fmt.Fprintln(os.Stderr, "Usage: cursor-deepseek keys create|revoke|list")
+	return errUsage
+}
+
+func createKey(args []string, stdout io.Writer) error {
+	fs := newFlagSet("keys create", "keys create -name NAME [flags]")
+	name := fs.String("name", "", "name of the key in logs and the usage ledger")
+	upstreamKey := fs.String("upstream-key", "${DEEPSEEK_API_KEY}", "DeepSeek API key requests are made with, may reference an environment variable")
+	budget := fs.Float64("budget", 0, "spend limit in USD per BUDGET_PERIOD, 0 for the default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *budget < 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	key, err := addClientKey(configPath, *name, *upstreamKey, *budget)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Created key %s: %s\n", key.Name, key.Key)
+	return nil
+}
+
+func revokeKey(args []string, stdout io.Writer) error {
+	fs := newFlagSet("keys revoke", "keys revoke NAME|KEY")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	key, err := removeClientKey(configPath, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Revoked key %s\n", keyLabel(key))
+	return nil
+}
+
+func listKeys(args []string, stdout io.Writer) error {
+	if err := newFlagSet("keys list", "keys list").Parse(args); err != nil {
+		return err
+	}
+	cfg, _, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	since := budgetStart(time.Now())
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tKEY\tBUDGET\tSPENT THIS %s\n", strings.ToUpper(budgetPeriod))
+	for _, k := range cfg.Keys {
+		budget := "-"
+		if k.Budget > 0 {
+			budget = fmt.Sprintf("$%.2f", k.Budget)
+		}
+		// Keys referencing the environment are shown as they are written
+		shown := k.Key
+		if !strings.Contains(k.Key, "${") && len(k.Key) > 12 {
+			shown = k.Key[:12] + "..."
+		}
+		spent := usageLedger.Total(keyLabel(k), since).Cost
+		fmt.Fprintf(tw, "%s\t%s\t%s\t$%.2f\n", keyLabel(k), shown, budget, spent)
+	}
+	return tw.Flush()
+}
+
+func maskCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("mask", "mask < FILE")
+	check := fs.Bool("check", false, "exit with status 1 when credentials are found")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	// The configured masking rules apply even when masking is off for requests
+	masked, count := currentConfig().masker.MaskCount(string(data))
+	io.WriteString(stdout, masked)
+	fmt.Fprintf(os.Stderr, "%d credentials masked\n", count)
+	if *check && count > 0 {
+		return fmt.Errorf("found %d credentials", count)
+	}
+	return nil
+}
+
+func replayCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("replay", "replay -key KEY [flags] RECORDING")
+	proxyURL := fs.String("url", "http://localhost:"+port, "base URL of the proxy")
+	key := fs.String("key", os.Getenv("PROXY_API_KEY"), "API key for the proxy, SECRET@<deepseek-api-key> or a client key")
+	model := fs.String("model", "", "model to request, the first route's when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *key == "" {
+		fs.Usage()
+		return errUsage
+	}
+	if *model == "" {
+		if routes := currentConfig().Routes; len(routes) > 0 {
+			*model = routes[0].Model
+		}
+	}
+	entries, err := recorder.Load(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Recordings hold the upstream requests, which are sent to the proxy with a
+	// model it routes
+	client := &http.Client{Timeout: upstreamClient.Timeout}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tPATH\tRECORDED\tSTATUS\tLATENCY\tBYTES")
+	sent, differ := 0, 0
+	for i, entry := range entries {
+		u, err := url.Parse(entry.URL)
+		if err != nil || entry.Method != http.MethodPost || !strings.HasSuffix(u.Path, "/chat/completions") {
+			continue
+		}
+		sent++
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(entry.RequestBody), &body); err != nil {
+			fmt.Fprintf(tw, "%d\t%s\t%d\tinvalid recorded body: %v\t\t\n", i+1, u.Path, entry.Status, err)
+			differ++
+			continue
+		}
+		body["model"] = *model
+		data, _ := json.Marshal(body)
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*proxyURL, "/")+u.Path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+*key)
+		req.Header.Set("Content-Type", "application/json")
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%v\t\t\n", i+1, u.Path, entry.Status, err)
+			differ++
+			continue
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mark := ""
+		if resp.StatusCode != entry.Status {
+			mark = " (differs)"
+			differ++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d%s\t%dms\t%d\n", i+1, u.Path, entry.Status, resp.StatusCode, mark, time.Since(start).Milliseconds(), n)
+	}
+	tw.Flush()
+	fmt.Fprintf(stdout, "%d requests replayed, %d with a different status\n", sent, differ)
+	if differ > 0 {
+		return fmt.Errorf("%d of %d requests differ from the recording", differ, sent)
+	}
+	return nil
+}
+
+func usageCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "report" {
+		fmt.Fprintln(os.Stderr, "Usage: cursor-deepseek usage report [flags]")
+		return errUsage
+	}
+	fs := newFlagSet("usage report", "usage report [flags]")
+	ledger := fs.String("ledger", os.Getenv("USAGE_LEDGER"), "usage ledger file")
+	since := fs.String("since", budgetStart(time.Now()).Format("2006-01-02"), "first day to report, YYYY-MM-DD")
+	by := fs.String("by", "key", "group by key, model or day")
+	key := fs.String("key", "", "only report this key")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *ledger == "" {
+		fs.Usage()
+		return errUsage
+	}
+	first, err := time.Parse("2006-01-02", *since)
+	if err != nil {
+		return fmt.Errorf("invalid -since %q, use YYYY-MM-DD", *since)
+	}
+	group := map[string]func(usage.Record) string{
+		"key":   func(r usage.Record) string { return r.Key },
+		"model": func(r usage.Record) string { return r.Model },
+		"day":   func(r usage.Record) string { return r.Time.UTC().Format("2006-01-02") },
+	}[*by]
+	if group == nil {
+		return fmt.Errorf("invalid -by %q, use key, model or day", *by)
+	}
+
+	records, err := usage.Load(*ledger)
+	var malformed *usage.MalformedError
+	if errors.As(err, &malformed) {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", *ledger, err)
+	} else if err != nil {
+		return err
+	}
+	totals := make(map[string]*usage.Total)
+	var all usage.Total
+	for _, rec := range records {
+		if rec.Time.Before(first) || (*key != "" && rec.Key != *key) {
+			continue
+		}
+		g := group(rec)
+		if totals[g] == nil {
+			totals[g] = &usage.Total{}
+		}
+		totals[g].Add(rec)
+		all.Add(rec)
+	}
+	groups := make([]string, 0, len(totals))
+	for g := range totals {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tREQUESTS\tPROMPT\tCACHED\tCOMPLETION\tCOST\t\n", strings.ToUpper(*by))
+	row := func(name string, t *usage.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t$%.4f\t\n", name, t.Requests, t.PromptTokens, t.CachedTokens, t.CompletionTokens, t.Cost)
+	}
+	for _, g := range groups {
+		row(g, totals[g])
+	}
+	row("TOTAL", &all)
+	return tw.Flush()
+}
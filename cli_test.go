@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/recorder"
+	"cursor-deepseek/usage"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommands(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	dir := t.TempDir()
+	run := func(stdin string, args ...string) (string, int) {
+		t.Helper()
+		var out bytes.Buffer
+		status := runCommand(args, strings.NewReader(stdin), &out)
+		return out.String(), status
+	}
+
+	t.Run("keys", func(t *testing.T) {
+		savedPath := configPath
+		t.Cleanup(func() { configPath = savedPath })
+		configPath = filepath.Join(dir, "config.yaml")
+		os.WriteFile(configPath, []byte("# Proxy settings\nendpoint: "+upstream.URL+"\nroutes:\n  - {model: gpt-4o, upstream_model: deepseek-chat}\n"), 0o600)
+
+		out, status := run("", "keys", "create", "-name", "alice", "-upstream-key", "sk-alice", "-budget", "5")
+		if status != 0 || !strings.Contains(out, "sk-proxy-") {
+			t.Fatalf("create exited with %d: %s", status, out)
+		}
+		key := strings.TrimSpace(out[strings.Index(out, "sk-proxy-"):])
+		run("", "keys", "create", "-name", "bob", "-upstream-key", "sk-bob")
+		if _, status := run("", "keys", "create", "-name", "bob"); status != 1 {
+			t.Errorf("duplicate name accepted")
+		}
+
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Keys) != 2 || cfg.keys[key] == nil || cfg.keys[key].Budget != 5 {
+			t.Errorf("unexpected keys %+v", cfg.Keys)
+		}
+		if data, _ := os.ReadFile(configPath); !strings.Contains(string(data), "# Proxy settings") {
+			t.Errorf("comments lost:\n%s", data)
+		}
+		if out, _ := run("", "keys", "list"); !strings.Contains(out, "alice") || !strings.Contains(out, "$5.00") || strings.Contains(out, key) {
+			t.Errorf("unexpected list:\n%s", out)
+		}
+
+		run("", "keys", "revoke", "alice")
+		cfg, _ = loadConfig(configPath)
+		if len(cfg.Keys) != 1 || cfg.Keys[0].Name != "bob" {
+			t.Errorf("alice not revoked: %+v", cfg.Keys)
+		}
+	})
+
+	t.Run("mask", func(t *testing.T) {
+		out, status := run("api_key: 1234567890abcdef1234567890abcdef\nhello\n", "mask", "-check")
+		if status != 1 || strings.Contains(out, "1234567890abcdef") || !strings.Contains(out, "hello") {
+			t.Errorf("mask exited with %d: %q", status, out)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		recording := filepath.Join(dir, "traffic.jsonl")
+		entry, _ := json.Marshal(recorder.Entry{
+			Method:      http.MethodPost,
+			URL:         "https://api.deepseek.com/v1/chat/completions",
+			RequestBody: `{"model":"deepseek-chat","messages":[{"role":"user","content":"Hi"}]}`,
+			Status:      http.StatusOK,
+		})
+		os.WriteFile(recording, append(entry, '\n'), 0o600)
+
+		out, status := run("", "replay", "-url", proxy.URL, "-key", testSecret+"@"+testAPIKey, recording)
+		if status != 0 || !strings.Contains(out, "1 requests replayed, 0 with a different status") {
+			t.Errorf("replay exited with %d:\n%s", status, out)
+		}
+		if sent := upstream.Requests(); len(sent) != 1 || !strings.Contains(string(sent[0].Body), `"content":"Hi"`) {
+			t.Errorf("recorded request not sent")
+		}
+	})
+
+	t.Run("usage report", func(t *testing.T) {
+		ledger := filepath.Join(dir, "usage.jsonl")
+		l, _ := usage.Open(ledger)
+		now := time.Now()
+		l.Add(usage.Record{Time: now, Key: "alice", Model: "deepseek-chat", PromptTokens: 100, CompletionTokens: 10, Cost: 0.5})
+		l.Add(usage.Record{Time: now, Key: "bob", Model: "deepseek-chat", PromptTokens: 50, CompletionTokens: 5, Cost: 0.25})
+		l.Add(usage.Record{Time: now.AddDate(-1, 0, 0), Key: "alice", Model: "deepseek-chat", PromptTokens: 1, Cost: 9})
+		l.Close()
+
+		out, status := run("", "usage", "report", "-ledger", ledger, "-since", now.Format("2006-01-02"))
+		if status != 0 || !strings.Contains(out, "$0.5000") || !strings.Contains(out, "$0.7500") || strings.Contains(out, "$9") {
+			t.Errorf("report exited with %d:\n%s", status, out)
+		}
+		if out, _ := run("", "usage", "report", "-ledger", ledger, "-by", "model", "-since", "2000-01-01"); !strings.Contains(out, "deepseek-chat") || !strings.Contains(out, "$9.7500") {
+			t.Errorf("unexpected report by model:\n%s", out)
+		}
+	})
+
+	if _, status := run("", "frobnicate"); status != 2 {
+		t.Errorf("unknown command exited with %d", status)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings the proxy's responses may be compressed with, in order of preference
+// when the client accepts several equally. Empty turns compression off.
+var compressionEncodings = []string{"zstd", "br", "gzip"}
+
+// Whether SSE streams are compressed too, each event is flushed through the encoder
+var compressStreams bool
+
+// Responses smaller than this are sent uncompressed, compressing them saves nothing
+var compressionMinBytes = 1024
+
+// What upstream responses may be encoded with, see decodeBody
+const upstreamAcceptEncoding = "gzip, deflate, br, zstd"
+
+func initCompression() {
+	if v, ok := os.LookupEnv("COMPRESSION"); ok {
+		compressionEncodings = nil
+		if v != "off" {
+			for _, name := range splitList(v) {
+				if encoders[name] == nil {
+					log.Fatalf("Invalid COMPRESSION %q, use a list of zstd, br and gzip, or off", v)
+				}
+				compressionEncodings = append(compressionEncodings, name)
+			}
+		}
+	}
+	compressStreams = os.Getenv("COMPRESS_STREAMS") == "true"
+	if v := os.Getenv("COMPRESSION_MIN_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid COMPRESSION_MIN_BYTES %q", v)
+		}
+		compressionMinBytes = n
+	}
+}
+
+// encoder is a compressor that can be flushed and reused for another response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Encoders are pooled, zstd's in particular are expensive to create. Levels favor
+// speed, responses are compressed while the client waits.
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return gz
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"zstd": {New: func() interface{} {
+		zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		return zw
+	}},
+}
+
+// negotiateEncoding picks the encoding for a request's Accept-Encoding: the
+// acceptable one with the highest q-value, ties broken by our preference.
+// It returns an empty string for an uncompressed response.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, name := range compressionEncodings {
+		if q := acceptQuality(acceptEncoding, name); q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value an Accept-Encoding header gives an encoding,
+// 0 when it isn't acceptable
+func acceptQuality(acceptEncoding, name string) float64 {
+	q := 0.0
+	for _, item := range splitList(acceptEncoding) {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != name && coding != "*" {
+			continue
+		}
+		itemQ := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					itemQ = f
+				}
+			}
+		}
+		// The encoding named outright counts over a wildcard
+		if coding == name {
+			return itemQ
+		}
+		q = itemQ
+	}
+	return q
+}
+
+// compressible reports whether responses of a content type are worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case mediaType == "text/event-stream":
+		return compressStreams
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json",
+		mediaType == "application/javascript", mediaType == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// withCompression compresses responses with the encoding the client accepts best.
+// Regular responses are buffered up to COMPRESSION_MIN_BYTES to decide whether they
+// are worth it, streams are compressed from the start and flushed event by event.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(compressionEncodings) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Uncompressed responses still vary by Accept-Encoding
+		encoding := ""
+		if r.Method != http.MethodHead {
+			encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the status and the start of the body until it knows
+// whether to compress the response, it never does without an encoding
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	decided bool
+	buf     bytes.Buffer
+	enc     encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	// Streams have no end to wait for, and bodiless responses nothing to compress
+	if w.encoding == "" || strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") || !hasBody(status) {
+		w.decide(true)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf.Write(data)
+		if w.buf.Len() >= compressionMinBytes {
+			w.decide(true)
+		}
+		return len(data), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// decide sends the headers, compressing when the response is large enough and of a
+// type worth it, and writes out what was held back
+func (w *compressWriter) decide(large bool) {
+	w.decided = true
+	h := w.Header()
+	// Already encoded responses, partial content and bodiless ones are left alone
+	if hasBody(w.status) && w.status != http.StatusPartialContent && h.Get("Content-Encoding") == "" &&
+		compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+	} else {
+		large = false
+	}
+	if large && w.encoding != "" {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		w.enc = encoders[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		if w.enc != nil {
+			w.enc.Write(w.buf.Bytes())
+		} else {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+		w.buf = bytes.Buffer{}
+	}
+}
+
+func hasBody(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Flush pushes what was compressed so far to the client, SSE events go out one by one
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(w.buf.Len() >= compressionMinBytes)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close writes out a response smaller than COMPRESSION_MIN_BYTES and ends the
+// compressed stream, returning the encoder to its pool
+func (w *compressWriter) close() {
+	if w.status == 0 {
+		// The handler wrote nothing, the server sends its own 200
+		return
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"cursor-deepseek/masker"
+	"cursor-deepseek/tokenizer"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings that can change while the proxy runs: where requests go,
+// who may send them and what is masked. It is read from CONFIG_FILE, or built from
+// the environment without one.
+type Config struct {
+	Port       string         `yaml:"port"`      // Read at startup only
+	Listeners  []Listener     `yaml:"listeners"` // Read at startup only, PORT's listener when empty
+	Secret     string         `yaml:"secret"`
+	AdminToken string         `yaml:"admin_token"` // The /admin API is off without one
+	Endpoint   string         `yaml:"endpoint"`
+	Upstream   UpstreamConfig `yaml:"upstream"` // How upstreams are reached, unless a route says otherwise
+	Routes     []Route        `yaml:"routes"`
+	Keys       []ClientKey    `yaml:"keys"`
+	Mask       MaskConfig     `yaml:"mask"`
+	CORS       CORSConfig     `yaml:"cors"`
+
+	// Any other setting by its environment variable name. They are applied once at
+	// startup and variables set in the environment take precedence.
+	Env map[string]string `yaml:"env"`
+
+	masker      *masker.Masker
+	cors        *corsPolicy
+	keys        map[string]*ClientKey
+	clientCerts map[string]*ClientKey
+}
+
+// Route sends requests for a model name clients use to an upstream model
+type Route struct {
+	Model         string          `yaml:"model" json:"model"`
+	UpstreamModel string          `yaml:"upstream_model" json:"upstream_model"`
+	Endpoint      string          `yaml:"endpoint" json:"endpoint,omitempty"`           // The config's endpoint when empty
+	Upstream      *UpstreamConfig `yaml:"upstream,omitempty" json:"upstream,omitempty"` // The config's upstream settings when nil
+	// Sent upstream instead of the client key's upstream key, for routes to another
+	// provider or account
+	UpstreamKey string `yaml:"upstream_key,omitempty" json:"-"`
+
+	// Describe tools in the system prompt and parse calls from the reply text,
+	// for upstream models that reject the tools field
+	PromptedTools bool `yaml:"prompted_tools,omitempty" json:"prompted_tools,omitempty"`
+	// response_format types the upstream handles itself: json_schema, json_object or
+	// none. RESPONSE_FORMAT_SUPPORT when empty.
+	ResponseFormat string `yaml:"response_format,omitempty" json:"response_format,omitempty"`
+	// Limits and token estimator for the upstream model, the built-in model table's,
+	// CONTEXT_WINDOW, MAX_OUTPUT_TOKENS and TOKENIZER when unset
+	ContextWindow   int    `yaml:"context_window,omitempty" json:"context_window,omitempty"`
+	MaxOutputTokens int    `yaml:"max_output_tokens,omitempty" json:"max_output_tokens,omitempty"`
+	Tokenizer       string `yaml:"tokenizer,omitempty" json:"tokenizer,omitempty"`
+
+	transport http.RoundTripper
+	limits    modelLimits
+	estimator tokenizer.Estimator
+}
+
+// ClientKey is an API key handed out to clients in place of SECRET@<DeepSeek API key>,
+// or a client certificate when the proxy serves mutual TLS. Requests made with either
+// use UpstreamKey.
+type ClientKey struct {
+	Name        string  `yaml:"name,omitempty"` // Shown in logs and the usage ledger instead of a fingerprint
+	Key         string  `yaml:"key,omitempty"`
+	ClientCert  string  `yaml:"client_cert,omitempty"` // Common name, DNS name or email of the certificate
+	UpstreamKey string  `yaml:"upstream_key"`
+	Budget      float64 `yaml:"budget,omitempty"` // USD per BUDGET_PERIOD, BUDGET applies when zero
+}
+
+// MaskConfig turns masking on and adds masking rules to the built-in ones
+type MaskConfig struct {
+	Enabled  bool     `yaml:"enabled" json:"enabled"`
+	Patterns []string `yaml:"patterns" json:"patterns"`
+}
+
+// The configuration requests are served with, swapped whole on reload
+var activeConfig atomic.Pointer[Config]
+
+// Path of the configuration file, empty when configured through the environment
+var configPath string
+
+// Why the configuration file couldn't be loaded at startup
+var configErr error
+
+// How often the configuration file is checked for changes
+const configPollInterval = 2 * time.Second
+
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// startupConfig returns the configuration loaded at startup, or why it is unusable
+func startupConfig() (*Config, error) {
+	if configErr != nil {
+		return nil, fmt.Errorf("error loading CONFIG_FILE: %v", configErr)
+	}
+	cfg := currentConfig()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configFromEnv builds the configuration from the environment variables
+func configFromEnv() *Config {
+	cfg := &Config{
+		Port:       port,
+		Secret:     secret,
+		AdminToken: adminToken,
+		Endpoint:   deepseekEndpoint,
+		Upstream:   envUpstream,
+		Mask:       MaskConfig{Enabled: useMask},
+		CORS:       envCORS,
+	}
+	if model != "" || deepseekChatModel != "" {
+		cfg.Routes = []Route{{Model: model, UpstreamModel: deepseekChatModel, PromptedTools: promptedTools}}
+	}
+	return cfg
+}
+
+// loadConfig reads, expands and validates a configuration file. YAML and JSON are
+// both accepted, and unknown fields are errors so typos don't go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	cfg, err := parseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfig reads a configuration file and expands its variables without validating it
+func parseConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if err := cfg.expand(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+var configVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expand replaces ${VAR} and ${VAR:-default} in every setting with the environment
+// variable, so secrets can stay out of the file
+func (c *Config) expand() error {
+	var missing []string
+	expand := func(s *string) {
+		*s = configVarPattern.ReplaceAllStringFunc(*s, func(ref string) string {
+			m := configVarPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok && value != "" {
+				return value
+			}
+			if m[2] != "" {
+				return m[2][2:]
+			}
+			missing = append(missing, m[1])
+			return ""
+		})
+	}
+
+	expand(&c.Port)
+	expand(&c.Secret)
+	expand(&c.AdminToken)
+	expand(&c.Endpoint)
+	expandUpstream := func(u *UpstreamConfig) {
+		for _, s := range []*string{&u.Proxy, &u.CAFile, &u.CertFile, &u.KeyFile, &u.ServerName, &u.Host} {
+			expand(s)
+		}
+	}
+	expandUpstream(&c.Upstream)
+	for i := range c.Routes {
+		expand(&c.Routes[i].Model)
+		expand(&c.Routes[i].UpstreamModel)
+		expand(&c.Routes[i].Endpoint)
+		expand(&c.Routes[i].UpstreamKey)
+		if c.Routes[i].Upstream != nil {
+			expandUpstream(c.Routes[i].Upstream)
+		}
+	}
+	for i := range c.Keys {
+		expand(&c.Keys[i].Name)
+		expand(&c.Keys[i].Key)
+		expand(&c.Keys[i].ClientCert)
+		expand(&c.Keys[i].UpstreamKey)
+	}
+	for i := range c.CORS.AllowedOrigins {
+		expand(&c.CORS.AllowedOrigins[i])
+	}
+	for name, value := range c.Env {
+		expand(&value)
+		c.Env[name] = value
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables referenced in the configuration are not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validate checks the configuration and prepares it for use, reporting every problem at once
+func (c *Config) validate() error {
+	var problems []string
+	problemf := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if c.Secret == "" && len(c.Keys) == 0 {
+		problemf("secret (SECRET) or keys are required")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < 16 {
+		problemf("admin_token (ADMIN_TOKEN) must be at least 16 characters")
+	}
+	if c.Endpoint != "" {
+		if err := validateEndpoint(c.Endpoint); err != nil {
+			problemf("endpoint: %v", err)
+		}
+	}
+
+	if len(c.Routes) == 0 {
+		problemf("at least one route is required (MODEL and DEEPSEEK_CHAT_MODEL)")
+	}
+	// Connection settings are checked by building the transports requests will use
+	transport := defaultUpstreamTransport
+	if c.Upstream != (UpstreamConfig{}) {
+		rt, err := c.Upstream.newTransport()
+		if err != nil {
+			problemf("upstream: %v", err)
+		}
+		transport = rt
+	}
+
+	models := make(map[string]bool)
+	for i, route := range c.Routes {
+		c.Routes[i].transport = transport
+		if route.Upstream != nil {
+			rt, err := route.Upstream.newTransport()
+			if err != nil {
+				problemf("routes[%d]: upstream: %v", i, err)
+			}
+			c.Routes[i].transport = rt
+		}
+		switch {
+		case route.Model == "":
+			problemf("routes[%d]: model (MODEL) is required", i)
+		case models[route.Model]:
+			problemf("routes[%d]: model %s has more than one route", i, route.Model)
+		}
+		models[route.Model] = true
+		if route.UpstreamModel == "" {
+			problemf("routes[%d]: upstream_model (DEEPSEEK_CHAT_MODEL) is required", i)
+		}
+		c.Routes[i].limits = routeLimits(route)
+		if route.ContextWindow < 0 || (route.ContextWindow > 0 && route.ContextWindow <= minReplyTokens) {
+			problemf("routes[%d]: context_window must be more than %d tokens", i, minReplyTokens)
+		}
+		if route.MaxOutputTokens < 0 {
+			problemf("routes[%d]: max_output_tokens can't be negative", i)
+		}
+		c.Routes[i].estimator = defaultEstimator
+		if route.Tokenizer != "" {
+			est, err := tokenizer.New(route.Tokenizer)
+			if err != nil {
+				problemf("routes[%d]: tokenizer: %v", i, err)
+			}
+			c.Routes[i].estimator = est
+		}
+		switch route.ResponseFormat {
+		case "", "json_schema", "json_object", "none":
+		default:
+			problemf("routes[%d]: unknown response_format %q, use json_schema, json_object or none", i, route.ResponseFormat)
+		}
+		switch {
+		case route.Endpoint != "":
+			if err := validateEndpoint(route.Endpoint); err != nil {
+				problemf("routes[%d]: endpoint: %v", i, err)
+			}
+		case c.Endpoint == "":
+			problemf("routes[%d]: endpoint (DEEPSEEK_ENDPOINT) is required", i)
+		}
+	}
+	if trimSummaryRoute != "" && len(c.Routes) > 0 && c.route(trimSummaryRoute) == nil {
+		problemf("TRIM_SUMMARY_ROUTE %s is not the model of a route", trimSummaryRoute)
+	}
+
+	c.keys = make(map[string]*ClientKey)
+	c.clientCerts = make(map[string]*ClientKey)
+	names := make(map[string]bool)
+	for i := range c.Keys {
+		key := &c.Keys[i]
+		switch {
+		case key.Key == "" && key.ClientCert == "":
+			problemf("keys[%d]: key or client_cert is required", i)
+		case key.Key == "":
+		case c.keys[key.Key] != nil:
+			problemf("keys[%d]: key is used more than once", i)
+		case strings.Contains(key.Key, "@"):
+			problemf("keys[%d]: key can't contain @", i)
+		}
+		if key.Key != "" {
+			c.keys[key.Key] = key
+		}
+		if key.ClientCert != "" {
+			if c.clientCerts[key.ClientCert] != nil {
+				problemf("keys[%d]: client_cert %s is used more than once", i, key.ClientCert)
+			}
+			c.clientCerts[key.ClientCert] = key
+		}
+		if key.UpstreamKey == "" {
+			problemf("keys[%d]: upstream_key is required", i)
+		}
+		if key.Name != "" && names[key.Name] {
+			problemf("keys[%d]: name %s is used more than once", i, key.Name)
+		}
+		names[key.Name] = true
+		if key.Budget < 0 {
+			problemf("keys[%d]: budget can't be negative", i)
+		}
+	}
+
+	m, err := masker.New(c.Mask.Patterns)
+	if err != nil {
+		problemf("mask.patterns: %v", err)
+	}
+	c.masker = m
+
+	cors, corsProblems := c.CORS.compile()
+	problems = append(problems, corsProblems...)
+	c.cors = cors
+	problems = append(problems, c.validateListeners()...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", endpoint)
+	}
+	return nil
+}
+
+// applyEnv sets the variables of the env section that aren't set already
+func (c *Config) applyEnv() {
+	for name, value := range c.Env {
+		if _, ok := os.LookupEnv(name); !ok {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// route returns the route for a model clients request, nil when there is none
+func (c *Config) route(model string) *Route {
+	for i := range c.Routes {
+		if c.Routes[i].Model == model {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// responseFormatSupport returns the response_format types the route's upstream handles itself
+func (r *Route) responseFormatSupport() string {
+	if r.ResponseFormat != "" {
+		return r.ResponseFormat
+	}
+	return responseFormatSupport
+}
+
+// endpoint returns the upstream base URL of a route
+func (c *Config) endpoint(route *Route) string {
+	if route.Endpoint != "" {
+		return route.Endpoint
+	}
+	return c.Endpoint
+}
+
+// clientModels lists the model names clients can request
+func (c *Config) clientModels() []string {
+	models := make([]string, len(c.Routes))
+	for i, route := range c.Routes {
+		models[i] = route.Model
+	}
+	return models
+}
+
+// watchConfig reloads the configuration file on SIGHUP and when it changes
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modified := configModTime(path)
+	for {
+		select {
+		case <-hup:
+			infoLog("Received SIGHUP, reloading %s", path)
+		case <-ticker.C:
+			t := configModTime(path)
+			if t.Equal(modified) {
+				continue
+			}
+			modified = t
+			infoLog("%s changed, reloading", path)
+		}
+		reloadConfig(path)
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig swaps in the configuration from path. Requests in flight finish with
+// the configuration they started with, and an invalid file leaves the current one.
+func reloadConfig(path string) (*Config, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		errorLog("Keeping the current configuration: %v", err)
+		return nil, err
+	}
+	old := currentConfig()
+	if changed := restartSettings(old, cfg); len(changed) > 0 {
+		errorLog("Changes to %s in %s take effect after a restart", strings.Join(changed, ", "), path)
+	}
+	activeConfig.Store(cfg)
+	closeReplacedTransports(old, cfg)
+	infoLog("Reloaded configuration from %s: %d routes, %d keys", path, len(cfg.Routes), len(cfg.Keys))
+	return cfg, nil
+}
+
+// closeReplacedTransports closes the idle upstream connections of the old
+// configuration's transports. Requests still using them keep their connections.
+func closeReplacedTransports(old, cfg *Config) {
+	if old == nil {
+		return
+	}
+	kept := map[http.RoundTripper]bool{defaultUpstreamTransport: true}
+	for _, route := range cfg.Routes {
+		kept[route.transport] = true
+	}
+	for _, route := range old.Routes {
+		if route.transport != nil && !kept[route.transport] {
+			kept[route.transport] = true
+			closeIdleConnections(route.transport)
+		}
+	}
+}
+
+// restartSettings names the settings that differ between two configurations but
+// are only read at startup
+func restartSettings(old, cfg *Config) []string {
+	if old == nil {
+		return nil
+	}
+	var changed []string
+	if cfg.Port != old.Port {
+		changed = append(changed, "port")
+	}
+	if !reflect.DeepEqual(cfg.Listeners, old.Listeners) {
+		changed = append(changed, "listeners")
+	}
+	if !reflect.DeepEqual(cfg.Env, old.Env) {
+		changed = append(changed, "env")
+	}
+	return changed
+}
+
+// keyLabel is how a client key appears in logs, the usage ledger and budgets
+func keyLabel(k ClientKey) string {
+	switch {
+	case k.Name != "":
+		return k.Name
+	case k.Key == "":
+		return k.ClientCert
+	}
+	return keyFingerprint(k.Key)
+}
+
+// readConfigFile parses a configuration file without expanding or validating it,
+// returning the document as well so it can be edited with its comments intact
+func readConfigFile(path string) (*Config, *yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("%s doesn't hold a mapping", path)
+	}
+	var cfg Config
+	if err := doc.Decode(&cfg); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return &cfg, &doc, nil
+}
+
+// editConfigFile lets edit change the keys of the configuration file and writes it back.
+// The file is replaced in one step, so a running proxy never reloads half of it.
+func editConfigFile(path string, edit func(cfg *Config, keys *yaml.Node) error) error {
+	cfg, doc, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	root := doc.Content[0]
+	var keys *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "keys" {
+			keys = root.Content[i+1]
+		}
+	}
+	if keys == nil {
+		keys = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "keys"}, keys)
+	}
+	if keys.Kind != yaml.SequenceNode {
+		// An empty "keys:" is a null scalar
+		*keys = yaml.Node{Kind: yaml.SequenceNode}
+	}
+	if err := edit(cfg, keys); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// addClientKey generates a client key and adds it to the configuration file
+func addClientKey(path, name, upstreamKey string, budget float64) (ClientKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return ClientKey{}, err
+	}
+	key := ClientKey{Name: name, Key: "sk-proxy-" + hex.EncodeToString(secret), UpstreamKey: upstreamKey, Budget: budget}
+	err := editConfigFile(path, func(cfg *Config, keys *yaml.Node) error {
+		for _, k := range cfg.Keys {
+			if k.Name == key.Name {
+				return fmt.Errorf("there already is a key named %s", key.Name)
+			}
+		}
+		var node yaml.Node
+		if err := node.Encode(key); err != nil {
+			return err
+		}
+		keys.Content = append(keys.Content, &node)
+		return nil
+	})
+	return key, err
+}
+
+// updateClientKey changes the key with the given name, or the key itself, in the
+// configuration file and returns it as changed
+func updateClientKey(path, id string, update func(k *ClientKey)) (ClientKey, error) {
+	var updated ClientKey
+	err := editConfigFile(path, func(cfg *Config, keys *yaml.Node) error {
+		for i, k := range cfg.Keys {
+			if keyLabel(k) == id || k.Key == id {
+				update(&k)
+				var node yaml.Node
+				if err := node.Encode(k); err != nil {
+					return err
+				}
+				keys.Content[i] = &node
+				updated = k
+				return nil
+			}
+		}
+		return fmt.Errorf("no key named %s", id)
+	})
+	return updated, err
+}
+
+// removeClientKey removes the key with the given name, or the key itself, from the
+// configuration file and returns it
+func removeClientKey(path, id string) (ClientKey, error) {
+	var removed ClientKey
+	err := editConfigFile(path, func(cfg *Config, keys *yaml.Node) error {
+		for i, k := range cfg.Keys {
+			if keyLabel(k) == id || k.Key == id {
+				keys.Content = append(keys.Content[:i], keys.Content[i+1:]...)
+				removed = k
+				return nil
+			}
+		}
+		return fmt.Errorf("no key named %s", id)
+	})
+	return removed, err
+}
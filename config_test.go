@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigFile(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	t.Setenv("TEAM_KEY", "team-key-1")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`
+endpoint: ` + upstream.URL + `
+routes:
+  - model: gpt-4o
+    upstream_model: deepseek-chat
+  - model: o1
+    upstream_model: deepseek-reasoner
+  - model: internal
+    upstream_model: deepseek-chat
+    upstream_key: ${INTERNAL_KEY:-sk-internal}
+keys:
+  - name: team
+    key: ${TEAM_KEY}
+    upstream_key: ${TEAM_UPSTREAM_KEY:-sk-team}
+mask:
+  enabled: true
+  patterns: ['ticket-(\d+)']
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := cfg.route("internal").UpstreamKey; key != "sk-internal" {
+		t.Errorf("route upstream_key expanded to %q", key)
+	}
+	activeConfig.Store(cfg)
+
+	send := func(key, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := decodeResponse(t, send("team-key-1", `{"model":"o1","messages":[{"role":"user","content":"Look at ticket-4711"}]}`))
+	if resp.Model != "o1" {
+		t.Errorf("got model %q", resp.Model)
+	}
+	sent := upstream.Requests()[0]
+	if auth := sent.Header.Get("Authorization"); auth != "Bearer sk-team" {
+		t.Errorf("upstream got %q", auth)
+	}
+	if body := string(sent.Body); !strings.Contains(body, `"model":"deepseek-reasoner"`) || !strings.Contains(body, "ticket-*********") {
+		t.Errorf("unexpected upstream request %s", body)
+	}
+	// Without a secret, SECRET@<key> isn't accepted
+	if resp := post(t, proxy, chatBody); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a secret key", resp.StatusCode)
+	}
+
+	// An invalid file keeps the current configuration
+	writeConfig("routes:\n  - model: gpt-4o\n")
+	if _, err := reloadConfig(path); err == nil {
+		t.Error("expected the invalid configuration to be reported")
+	}
+	if currentConfig() != cfg {
+		t.Fatal("invalid configuration was loaded")
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "upstream_model") || !strings.Contains(err.Error(), "endpoint") {
+		t.Errorf("expected every problem to be reported, got %v", err)
+	}
+
+	// A valid one replaces it, revoking the team key
+	writeConfig(fmt.Sprintf("secret: %s\nendpoint: %s\nroutes:\n  - {model: gpt-4o, upstream_model: deepseek-chat}\n", testSecret, upstream.URL))
+	reloadConfig(path)
+	if resp := send("team-key-1", chatBody); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got status %d for a revoked key", resp.StatusCode)
+	}
+	decodeResponse(t, post(t, proxy, chatBody))
+}
+
+func TestRestartSettings(t *testing.T) {
+	old := &Config{Port: "9000", Listeners: []Listener{{Address: ":9000"}}, Env: map[string]string{"LOG_LEVEL": "info"}}
+	cfg := *old
+	if changed := restartSettings(old, &cfg); len(changed) != 0 {
+		t.Errorf("got changes %v to an unchanged configuration", changed)
+	}
+	cfg.Listeners = []Listener{{Address: ":9000"}, {Address: ":9443", Auth: "client_cert"}}
+	cfg.Env = map[string]string{"LOG_LEVEL": "debug"}
+	if changed := strings.Join(restartSettings(old, &cfg), ","); changed != "listeners,env" {
+		t.Errorf("got changes %q", changed)
+	}
+}
+
+func TestCloseReplacedTransports(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	old := &Config{Secret: testSecret, Endpoint: upstream.URL, Routes: []Route{
+		{Model: "gpt-4o", UpstreamModel: "deepseek-chat", Upstream: &UpstreamConfig{Host: "api.deepseek.internal"}},
+		{Model: "o1", UpstreamModel: "deepseek-reasoner"},
+	}}
+	if err := old.validate(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: old.Routes[0].transport}).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The route that keeps its transport keeps its connections
+	cfg := &Config{Endpoint: upstream.URL, Routes: []Route{old.Routes[0]}}
+	closeReplacedTransports(old, cfg)
+	select {
+	case <-closed:
+		t.Fatal("a connection of a kept transport was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cfg.Routes[0].transport = defaultUpstreamTransport
+	closeReplacedTransports(old, cfg)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection of a replaced transport wasn't closed")
+	}
+}
+
+// The configuration file is validated at startup against settings read from the
+// environment, so this runs check-config in a fresh process, as the subcommand
+// and as the --check-config flag
+func TestStartupConfigFile(t *testing.T) {
+	if args := os.Getenv("TEST_STARTUP_CONFIG"); args != "" {
+		os.Exit(runCommand(strings.Fields(args), strings.NewReader(""), os.Stdout))
+	}
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCertificate(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	path := filepath.Join(dir, "config.yaml")
+	os.WriteFile(path, []byte(`
+endpoint: https://api.deepseek.com
+routes:
+  - model: gpt-4o
+    upstream_model: deepseek-chat
+keys:
+  - name: alice
+    client_cert: alice-laptop
+    upstream_key: sk-alice
+listeners:
+  - address: 127.0.0.1:0
+    auth: client_cert
+`), 0o600)
+
+	for _, args := range []string{"check-config", "--check-config", "-port 9000 -check-config"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStartupConfigFile$")
+		cmd.Env = append(os.Environ(), "TEST_STARTUP_CONFIG="+args, "CONFIG_FILE="+path,
+			"TLS_CERT_FILE="+filepath.Join(dir, "server.crt"), "TLS_KEY_FILE="+filepath.Join(dir, "server.key"),
+			"TLS_CLIENT_CA_FILE="+filepath.Join(dir, "ca.crt"))
+		out, err := cmd.CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "Configuration OK") {
+			t.Errorf("%s failed: %v\n%s", args, err, out)
+		}
+	}
+}
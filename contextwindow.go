@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cursor-deepseek/tokenizer"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// modelLimits is the size of an upstream model's context window and longest reply
+type modelLimits struct {
+	ContextWindow int
+	MaxOutput     int
+}
+
+// Known upstream models, the defaults of routes to them
+var modelLimitTable = map[string]modelLimits{
+	"deepseek-chat":          {ContextWindow: 128000, MaxOutput: 8192},
+	"deepseek-reasoner":      {ContextWindow: 128000, MaxOutput: 65536},
+	"deepseek/deepseek-chat": {ContextWindow: 128000, MaxOutput: 8192},
+}
+
+// Limits from CONTEXT_WINDOW and MAX_OUTPUT_TOKENS for routes without their own, zero when unset
+var envContextWindow, envMaxOutput int
+
+// Estimates prompt tokens for routes without a tokenizer, TOKENIZER picks it
+var defaultEstimator tokenizer.Estimator = tokenizer.Pieces{}
+
+// What to do with requests that don't fit the context window: "reject" or "trim"
+var contextOverflow = "reject"
+
+// Requests need at least this much room for the reply
+const minReplyTokens = 256
+
+func initContextWindow() {
+	if window := os.Getenv("CONTEXT_WINDOW"); window != "" {
+		n, err := strconv.Atoi(window)
+		if err != nil || n <= minReplyTokens {
+			log.Fatalf("Invalid CONTEXT_WINDOW %q", window)
+		}
+		envContextWindow = n
+	}
+	if maxOutput := os.Getenv("MAX_OUTPUT_TOKENS"); maxOutput != "" {
+		n, err := strconv.Atoi(maxOutput)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid MAX_OUTPUT_TOKENS %q", maxOutput)
+		}
+		envMaxOutput = n
+	}
+
+	var err error
+	if defaultEstimator, err = tokenizer.New(os.Getenv("TOKENIZER")); err != nil {
+		log.Fatalf("Invalid TOKENIZER: %v", err)
+	}
+	switch overflow := os.Getenv("CONTEXT_OVERFLOW"); overflow {
+	case "reject", "trim":
+		contextOverflow = overflow
+	case "":
+	default:
+		log.Fatalf("Invalid CONTEXT_OVERFLOW %q, use reject or trim", overflow)
+	}
+}
+
+// contextLengthError is returned for requests that don't fit the model's context window
+type contextLengthError struct {
+	Limit  int
+	Tokens int
+}
+
+func (e *contextLengthError) Error() string {
+	return fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in about %d tokens, "+
+		"leaving less than %d tokens for the reply. Please reduce the length of the messages.", e.Limit, e.Tokens, minReplyTokens)
+}
+
+// routeLimits returns the limits of a route: its own, CONTEXT_WINDOW and
+// MAX_OUTPUT_TOKENS, and those of its upstream model, in that order
+func routeLimits(route Route) modelLimits {
+	limits := modelLimitTable[route.UpstreamModel]
+	if envContextWindow > 0 {
+		limits.ContextWindow = envContextWindow
+	}
+	if envMaxOutput > 0 {
+		limits.MaxOutput = envMaxOutput
+	}
+	if route.ContextWindow > 0 {
+		limits.ContextWindow = route.ContextWindow
+	}
+	if route.MaxOutputTokens > 0 {
+		limits.MaxOutput = route.MaxOutputTokens
+	}
+	return limits
+}
+
+// estimator returns the token estimator of the request's route
+func (p *proxyRequest) estimator() tokenizer.Estimator {
+	if p != nil && p.route != nil && p.route.estimator != nil {
+		return p.route.estimator
+	}
+	return defaultEstimator
+}
+
+// limits returns the limits of the request's route, zero when they aren't known
+func (p *proxyRequest) limits() modelLimits {
+	if p == nil || p.route == nil {
+		return modelLimits{}
+	}
+	return p.route.limits
+}
+
+// messageTokens estimates the tokens of a message, including the role and separators around it
+func messageTokens(est tokenizer.Estimator, msg Message) int {
+	n := 4 + est.Count(msg.Content)
+	for _, tc := range msg.ToolCalls {
+		n += 3 + est.Count(tc.Function.Name) + est.Count(tc.Function.Arguments)
+	}
+	return n
+}
+
+// estimatePromptTokens estimates the prompt size of req: its messages and tool definitions
+func estimatePromptTokens(est tokenizer.Estimator, req DeepSeekRequest) int {
+	n := 3 // The reply is primed with the assistant role
+	for _, msg := range req.Messages {
+		n += messageTokens(est, msg)
+	}
+	if len(req.Tools) > 0 {
+		data, _ := json.Marshal(req.Tools)
+		n += est.Count(string(data))
+	}
+	return n
+}
+
+// messageBudget returns how many tokens the messages of req may take in "trim" mode,
+// what's left of the context window after the tool definitions and room for the
+// reply. It is 0 when trimming is off or the model's window isn't known.
+func messageBudget(px *proxyRequest, req DeepSeekRequest) int {
+	limits := px.limits()
+	if contextOverflow != "trim" || limits.ContextWindow == 0 {
+		return 0
+	}
+	req.Messages = nil
+	return limits.ContextWindow - minReplyTokens - estimatePromptTokens(px.estimator(), req)
+}
+
+// fitContextWindow checks req against its model's context window before it is sent.
+// Oversized requests are trimmed in "trim" mode and rejected otherwise, and max_tokens
+// is clamped to the room that is left. It returns the estimated prompt tokens.
+func fitContextWindow(px *proxyRequest, req *DeepSeekRequest) (int, error) {
+	est := px.estimator()
+	prompt := estimatePromptTokens(est, *req)
+	limits := px.limits()
+	if limits.ContextWindow == 0 {
+		return prompt, nil
+	}
+
+	// Messages are trimmed while they are converted, instructions added since
+	// can still push the request over
+	budget := limits.ContextWindow - minReplyTokens
+	if prompt > budget && contextOverflow == "trim" {
+		req.Messages = trimToBudget(px, req.Messages, budget-(prompt-messagesTokens(est, req.Messages)))
+		trimmed := estimatePromptTokens(est, *req)
+		px.log().debugf("Trimmed request from about %d to %d tokens", prompt, trimmed)
+		prompt = trimmed
+	}
+	if prompt > budget {
+		return prompt, &contextLengthError{Limit: limits.ContextWindow, Tokens: prompt}
+	}
+
+	remaining := limits.ContextWindow - prompt
+	maxOutput := remaining
+	if limits.MaxOutput > 0 && maxOutput > limits.MaxOutput {
+		maxOutput = limits.MaxOutput
+	}
+	// Explicit limits that don't fit are lowered, and without one the reply is
+	// capped once the room left is less than the model's longest reply
+	if req.MaxTokens > maxOutput || (req.MaxTokens == 0 && remaining < limits.MaxOutput) {
+		px.log().debugf("Clamping max_tokens from %d to %d", req.MaxTokens, maxOutput)
+		req.MaxTokens = maxOutput
+	}
+	return prompt, nil
+}
+
+func messagesTokens(est tokenizer.Estimator, messages []Message) int {
+	n := 0
+	for _, msg := range messages {
+		n += messageTokens(est, msg)
+	}
+	return n
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cursor-deepseek/cache"
+	"cursor-deepseek/mockupstream"
+	"cursor-deepseek/tokenizer"
+	"cursor-deepseek/usage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useRouteLimits gives the test proxy's route a smaller context window and longest reply
+func useRouteLimits(t *testing.T, contextWindow, maxOutput int) {
+	cfg := *currentConfig()
+	cfg.Routes = append([]Route(nil), cfg.Routes...)
+	cfg.Routes[0].ContextWindow, cfg.Routes[0].MaxOutputTokens = contextWindow, maxOutput
+	useConfig(t, &cfg)
+}
+
+func TestRouteLimits(t *testing.T) {
+	savedWindow := envContextWindow
+	t.Cleanup(func() { envContextWindow = savedWindow })
+	envContextWindow = 0
+
+	cfg := &Config{Secret: testSecret, Endpoint: "https://api.deepseek.com", Routes: []Route{
+		{Model: "chat", UpstreamModel: "deepseek-chat"},
+		{Model: "reasoner", UpstreamModel: "deepseek-reasoner"},
+		{Model: "local", UpstreamModel: "llama", ContextWindow: 32000, MaxOutputTokens: 4000, Tokenizer: "chars"},
+		{Model: "unknown", UpstreamModel: "llama"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []modelLimits{{128000, 8192}, {128000, 65536}, {32000, 4000}, {}}
+	for i, route := range cfg.Routes {
+		if route.limits != want[i] {
+			t.Errorf("%s got limits %+v", route.Model, route.limits)
+		}
+	}
+	if cfg.Routes[2].estimator != tokenizer.DeepSeekChars || cfg.Routes[0].estimator != defaultEstimator {
+		t.Errorf("got estimators %v and %v", cfg.Routes[2].estimator, cfg.Routes[0].estimator)
+	}
+
+	// CONTEXT_WINDOW applies to routes without their own
+	envContextWindow = 64000
+	cfg.validate()
+	if cfg.Routes[1].limits.ContextWindow != 64000 || cfg.Routes[2].limits.ContextWindow != 32000 {
+		t.Errorf("got limits %+v and %+v", cfg.Routes[1].limits, cfg.Routes[2].limits)
+	}
+
+	cfg.Routes[2].Tokenizer = "words"
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "tokenizer") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedOverflow := contextOverflow
+	t.Cleanup(func() { contextOverflow = savedOverflow })
+	useRouteLimits(t, 1000, 500)
+
+	long := strings.Repeat("word ", 400)
+	body := `{"model":"gpt-4o","max_tokens":2000,"messages":[{"role":"system","content":"Be brief"},` +
+		`{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"Hi"}]}`
+
+	resp := post(t, proxy, body)
+	var errResp struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	if resp.StatusCode != http.StatusBadRequest || errResp.Error.Code != "context_length_exceeded" {
+		t.Fatalf("got status %d, error %+v", resp.StatusCode, errResp)
+	}
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests", n)
+	}
+
+	// Trimming drops the old turn, and max_tokens is clamped to the model's longest reply
+	contextOverflow = "trim"
+	decodeResponse(t, post(t, proxy, body))
+	var sent DeepSeekRequest
+	json.Unmarshal(upstream.Requests()[0].Body, &sent)
+	if len(sent.Messages) != 2 || sent.Messages[0].Content != "Be brief" || sent.Messages[1].Content != "Hi" {
+		t.Errorf("got messages %+v", sent.Messages)
+	}
+	if sent.MaxTokens != 500 {
+		t.Errorf("got max_tokens %d", sent.MaxTokens)
+	}
+}
+
+// agentSession is a long agent turn: one user message followed by rounds of tool calls with large results
+func agentSession(rounds int) []Message {
+	messages := []Message{{Role: "system", Content: "You are a coding agent"}, {Role: "user", Content: "Fix the bug"}}
+	for i := 0; i < rounds; i++ {
+		id := fmt.Sprintf("call_%d", i)
+		messages = append(messages,
+			Message{Role: "assistant", ToolCalls: []ToolCall{{ID: id, Type: "function", Function: struct {
+				Name      string `json:"name"`
+				Arguments string `json:"arguments"`
+			}{Name: "read_file", Arguments: fmt.Sprintf(`{"path":"file%d.go"}`, i)}}}},
+			Message{Role: "tool", ToolCallID: id, Content: strings.Repeat(fmt.Sprintf("line of file %d\n", i), 200)})
+	}
+	return messages
+}
+
+func TestTrimmingStrategies(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedOverflow, savedToolTokens := contextOverflow, trimToolOutputTokens
+	t.Cleanup(func() { contextOverflow, trimToolOutputTokens = savedOverflow, savedToolTokens })
+	useRouteLimits(t, 1000, 500)
+	contextOverflow = "trim"
+	trimToolOutputTokens = 100
+
+	messages := agentSession(6)
+	body, _ := json.Marshal(map[string]interface{}{"model": "gpt-4o", "messages": messages, "tools": json.RawMessage(toolsJSON)})
+	decodeResponse(t, post(t, proxy, string(body)))
+
+	var sent DeepSeekRequest
+	json.Unmarshal(upstream.Requests()[0].Body, &sent)
+	if sent.Messages[0].Role != "system" || sent.Messages[1].Content != "Fix the bug" {
+		t.Errorf("system prompt or user message dropped: %+v", sent.Messages[:2])
+	}
+	last := sent.Messages[len(sent.Messages)-1]
+	if last.ToolCallID != "call_5" || !strings.Contains(last.Content, "removed by the proxy") {
+		t.Errorf("latest tool result is %q: %.80q", last.ToolCallID, last.Content)
+	}
+	if len(sent.Messages) >= len(messages) {
+		t.Errorf("no rounds dropped, %d messages sent", len(sent.Messages))
+	}
+	// Every remaining result follows its call
+	for i, msg := range sent.Messages {
+		if msg.Role == "tool" && (sent.Messages[i-1].Role != "assistant" || sent.Messages[i-1].ToolCalls[0].ID != msg.ToolCallID) {
+			t.Errorf("tool result %s doesn't follow its call", msg.ToolCallID)
+		}
+	}
+	if tokens := estimatePromptTokens(defaultEstimator, sent); tokens > 1000-minReplyTokens {
+		t.Errorf("trimmed request still has about %d tokens", tokens)
+	}
+}
+
+func TestSummarizeStrategy(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedOverflow, savedStrategies, savedCache := contextOverflow, trimStrategies, summaryCache
+	t.Cleanup(func() { contextOverflow, trimStrategies, summaryCache = savedOverflow, savedStrategies, savedCache })
+	useRouteLimits(t, 5000, 500)
+	contextOverflow = "trim"
+	trimStrategies = []string{"summarize", "oldest_turns"}
+	summaryCache = cache.NewMemory(0, 10, 0)
+
+	body, _ := json.Marshal(map[string]interface{}{"model": "gpt-4o", "messages": agentSession(6), "tools": json.RawMessage(toolsJSON)})
+	upstream.Enqueue(mockupstream.Reply{Content: "You read file0.go and file1.go looking for the bug."})
+	decodeResponse(t, post(t, proxy, string(body)))
+
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected a summary request and the completion, got %d requests", len(requests))
+	}
+	var summaryReq DeepSeekRequest
+	json.Unmarshal(requests[0].Body, &summaryReq)
+	if summaryReq.MaxTokens != trimSummaryTokens || !strings.Contains(summaryReq.Messages[1].Content, "line of file 0") {
+		t.Errorf("unexpected summary request: %.200s", requests[0].Body)
+	}
+	var sent DeepSeekRequest
+	json.Unmarshal(requests[1].Body, &sent)
+	note := sent.Messages[1]
+	if note.Role != "system" || !strings.HasSuffix(note.Content, "You read file0.go and file1.go looking for the bug.") {
+		t.Errorf("summary not spliced in after the system prompt: %+v", note)
+	}
+	if sent.Messages[2].Content != "Fix the bug" || sent.Messages[len(sent.Messages)-1].ToolCallID != "call_5" {
+		t.Errorf("user message or latest round not kept")
+	}
+	if strings.Contains(string(requests[1].Body), "call_0") {
+		t.Errorf("summarized round still sent")
+	}
+
+	// The same conversation reuses the summary
+	decodeResponse(t, post(t, proxy, string(body)))
+	if n := len(upstream.Requests()); n != 3 {
+		t.Errorf("summary not cached, %d upstream requests", n)
+	}
+}
+
+func TestSummaryRoute(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedOverflow, savedStrategies, savedCache, savedRoute, savedLedger := contextOverflow, trimStrategies, summaryCache, trimSummaryRoute, usageLedger
+	t.Cleanup(func() {
+		contextOverflow, trimStrategies, summaryCache, trimSummaryRoute, usageLedger = savedOverflow, savedStrategies, savedCache, savedRoute, savedLedger
+		delete(priceTable, "cheap-model")
+	})
+	contextOverflow = "trim"
+	trimStrategies = []string{"summarize", "oldest_turns"}
+	summaryCache = cache.NewMemory(0, 10, 0)
+	trimSummaryRoute = "cheap"
+	priceTable["cheap-model"] = ModelPrice{Input: 0.01, Output: 0.02}
+	ledgerPath := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := usage.Open(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageLedger = ledger
+	t.Cleanup(func() { ledger.Close() })
+
+	cfg := &Config{Secret: testSecret, Endpoint: upstream.URL, Routes: []Route{
+		{Model: "gpt-4o", UpstreamModel: "deepseek-chat", ContextWindow: 5000, MaxOutputTokens: 500},
+		{Model: "cheap", UpstreamModel: "cheap-model", Endpoint: upstream.URL + "/cheap", UpstreamKey: "sk-cheap"},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+
+	body, _ := json.Marshal(map[string]interface{}{"model": "gpt-4o", "messages": agentSession(6), "tools": json.RawMessage(toolsJSON)})
+	usageReply := &mockupstream.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}
+	upstream.Enqueue(mockupstream.Reply{Content: "You read file0.go.", Usage: usageReply}, mockupstream.Reply{Content: "Done", Usage: usageReply})
+	decodeResponse(t, post(t, proxy, string(body)))
+
+	// The summary is written on the cheap route, with its endpoint, key and model
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected a summary request and the completion, got %d requests", len(requests))
+	}
+	summary, completion := requests[0], requests[1]
+	if summary.Path != "/cheap/v1/chat/completions" || summary.Header.Get("Authorization") != "Bearer sk-cheap" || summary.JSON()["model"] != "cheap-model" {
+		t.Errorf("summary sent to %s with %q: %.100s", summary.Path, summary.Header.Get("Authorization"), summary.Body)
+	}
+	if completion.Header.Get("Authorization") != "Bearer "+testAPIKey || completion.JSON()["model"] != "deepseek-chat" {
+		t.Errorf("completion sent with %q: %.100s", completion.Header.Get("Authorization"), completion.Body)
+	}
+
+	// Its usage is recorded, and priced, under the summary model
+	proxy.Close()
+	records, err := usage.Load(ledgerPath)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("got records %+v, %v", records, err)
+	}
+	if records[0].Model != "deepseek-chat" || records[1].Model != "cheap-model" || records[1].Cost != (100*0.01+10*0.02)/1e6 {
+		t.Errorf("got records %+v", records)
+	}
+
+	// A summary route must exist
+	cfg.Routes = cfg.Routes[:1]
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "TRIM_SUMMARY_ROUTE") {
+		t.Errorf("got %v", err)
+	}
+}
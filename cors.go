@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig is the cross-origin policy for browser clients. Without allowed origins
+// browsers can't call the proxy from other origins.
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" json:"allowed_origins"` // Exact, "*" or with wildcards like https://*.example.com
+	AllowedMethods   []string `yaml:"allowed_methods" json:"allowed_methods"`
+	AllowedHeaders   []string `yaml:"allowed_headers" json:"allowed_headers"` // "*" allows whatever the browser asks for
+	MaxAge           int      `yaml:"max_age" json:"max_age"`                 // Seconds browsers may cache preflight responses
+	AllowCredentials bool     `yaml:"allow_credentials" json:"allow_credentials"`
+}
+
+// CORS policy from the CORS_* variables, used without a configuration file
+var envCORS CORSConfig
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "OPTIONS"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Accept", "X-Request-ID"}
+)
+
+// Headers of proxy responses browser clients may read
+const corsExposedHeaders = "Content-Length, X-Request-ID, X-Cache, X-Request-Cost"
+
+func initCORS() {
+	envCORS.AllowedOrigins = splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	envCORS.AllowedMethods = splitList(os.Getenv("CORS_ALLOWED_METHODS"))
+	envCORS.AllowedHeaders = splitList(os.Getenv("CORS_ALLOWED_HEADERS"))
+	if maxAge := os.Getenv("CORS_MAX_AGE"); maxAge != "" {
+		n, err := strconv.Atoi(maxAge)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid CORS_MAX_AGE %q, use seconds", maxAge)
+		}
+		envCORS.MaxAge = n
+	}
+	envCORS.AllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+}
+
+// splitList splits a comma-separated setting, leaving out empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// corsPolicy is a CORSConfig prepared for matching requests
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	patterns    []*regexp.Regexp
+	methods     map[string]bool
+	headers     map[string]bool // Lower case
+	anyHeader   bool
+	credentials bool
+	maxAge      int
+
+	allowMethods string
+	allowHeaders string
+}
+
+// compile prepares the policy, it returns the problems found for validate
+func (c CORSConfig) compile() (*corsPolicy, []string) {
+	var problems []string
+	p := &corsPolicy{
+		origins:     make(map[string]bool),
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: c.AllowCredentials,
+		maxAge:      c.MaxAge,
+	}
+	for _, origin := range c.AllowedOrigins {
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "*"):
+			// Wildcards stand for host name labels or a port, never for a scheme or path
+			quoted := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9-]+(?:\.[a-z0-9-]+)*`)
+			p.patterns = append(p.patterns, regexp.MustCompile("^"+quoted+"$"))
+		default:
+			p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") && origin != "*" {
+			problems = append(problems, fmt.Sprintf("cors.allowed_origins: %q isn't an http or https origin", origin))
+		}
+	}
+	if p.anyOrigin && c.AllowCredentials {
+		problems = append(problems, `cors.allow_credentials can't be used with "*" in allowed_origins, browsers reject it`)
+	}
+	if c.MaxAge < 0 {
+		problems = append(problems, "cors.max_age can't be negative")
+	}
+
+	methods := append([]string(nil), c.AllowedMethods...)
+	if len(methods) == 0 {
+		methods = append(methods, defaultCORSMethods...)
+	}
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+		p.methods[methods[i]] = true
+	}
+	p.allowMethods = strings.Join(methods, ", ")
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	for _, header := range headers {
+		if header == "*" {
+			p.anyHeader = true
+		}
+		p.headers[strings.ToLower(header)] = true
+	}
+	p.allowHeaders = strings.Join(headers, ", ")
+	return p, problems
+}
+
+func (p *corsPolicy) allowOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeadersFor returns the Access-Control-Allow-Headers value for a preflight's
+// requested headers, and false when one of them isn't allowed
+func (p *corsPolicy) allowHeadersFor(requested string) (string, bool) {
+	if p.anyHeader {
+		return requested, true
+	}
+	for _, header := range splitList(requested) {
+		if !p.headers[strings.ToLower(header)] {
+			return "", false
+		}
+	}
+	return p.allowHeaders, true
+}
+
+// withCORS applies the configuration's CORS policy. Preflight requests are answered
+// here, before authentication, since browsers send them without credentials.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := currentConfig().cors
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions
+
+		// Responses differ by origin unless every origin gets the same one
+		if policy != nil && !policy.anyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowed := origin != "" && policy != nil && policy.allowOrigin(origin)
+		if allowed {
+			if policy.anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if policy.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !preflight {
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflights that ask for more than the policy allows get no CORS headers,
+		// and the browser doesn't send the request
+		method := r.Header.Get("Access-Control-Request-Method")
+		headers, headersOK := "", false
+		if allowed {
+			headers, headersOK = policy.allowHeadersFor(r.Header.Get("Access-Control-Request-Headers"))
+		}
+		if !allowed || !policy.methods[method] || !headersOK {
+			w.Header().Del("Access-Control-Allow-Origin")
+			w.Header().Del("Access-Control-Allow-Credentials")
+			if origin != "" {
+				requestLogFrom(r.Context()).debugf("CORS preflight from %s for %s rejected", origin, method)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", policy.allowMethods)
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		if policy.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.CORS = CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.dev.example.com"}, MaxAge: 600}
+	useConfig(t, &cfg)
+
+	preflight := func(origin, method string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodOptions, proxy.URL+"/v1/chat/completions", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Preflights are answered without an Authorization header
+	resp := preflight("https://app.example.com", "POST")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" || !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "POST") {
+		t.Errorf("got %d %v", resp.StatusCode, resp.Header)
+	}
+	if vary := resp.Header.Values("Vary"); len(vary) != 3 || vary[0] != "Origin" {
+		t.Errorf("got Vary %v", vary)
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials allowed without allow_credentials")
+	}
+	for origin, allowed := range map[string]bool{
+		"https://a.dev.example.com":              true,
+		"https://a.b.dev.example.com":            true,
+		"https://dev.example.com":                false,
+		"https://evil.dev.example.com.attack.io": false,
+		"http://app.example.com":                 false,
+		"https://app.example.com.attack.io":      false,
+		"https://a.dev.example.com/.example.com": false,
+	} {
+		if got := preflight(origin, "POST").Header.Get("Access-Control-Allow-Origin") != ""; got != allowed {
+			t.Errorf("origin %s allowed: %v", origin, got)
+		}
+	}
+	if got := preflight("https://app.example.com", "DELETE").Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("DELETE preflight allowed for %s", got)
+	}
+
+	resp = post(t, proxy, chatBody, "Origin", "https://app.example.com")
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || resp.Header.Get("Vary") != "Origin" {
+		t.Errorf("got %v", resp.Header)
+	}
+
+	bad := CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	if _, problems := bad.compile(); len(problems) != 1 {
+		t.Errorf("got problems %v", problems)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cursor-deepseek/usage"
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dashboard's page and scripts, served under /dashboard/ when an ADMIN_TOKEN is set
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// How many completed requests and errors the dashboard keeps
+const (
+	dashboardRecent = 100
+	dashboardErrors = 50
+)
+
+// Requests per minute are kept for the last hour
+const trafficMinutes = 60
+
+// traffic collects what the dashboard shows about requests since the proxy started
+var traffic = newTrafficStats()
+
+// trafficRequest is a completed request as the dashboard shows it
+type trafficRequest struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"`
+	Route     string    `json:"route"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	Key       string    `json:"key,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Stream    bool      `json:"stream,omitempty"`
+	Tokens    int       `json:"tokens,omitempty"`
+	Cost      float64   `json:"cost,omitempty"`
+	Cache     string    `json:"cache,omitempty"`
+	Masked    int       `json:"masked,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+	UpstreamBody   string `json:"upstream_body,omitempty"` // Run through the masker
+}
+
+type trafficMinute struct {
+	Time     time.Time `json:"time"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+}
+
+// trafficTotal is the usage of a key or model, and the credentials masked in its requests
+type trafficTotal struct {
+	usage.Total
+	Masked int `json:"masked"`
+}
+
+type trafficStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	requests int
+	failed   int
+	minutes  []trafficMinute
+	recent   []trafficRequest // Oldest first
+	errors   []trafficRequest
+	keys     map[string]*trafficTotal
+	models   map[string]*trafficTotal
+
+	cacheHits   int
+	cacheMisses int
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		started: time.Now(),
+		keys:    make(map[string]*trafficTotal),
+		models:  make(map[string]*trafficTotal),
+	}
+}
+
+// record adds a completed request. Requests to the admin API and the dashboard itself
+// are left out so watching the dashboard doesn't show up on it.
+func (s *trafficStats) record(rl *requestLog, sw *statusWriter) {
+	if strings.HasPrefix(rl.route, "/admin/") || strings.HasPrefix(rl.route, "/dashboard/") {
+		return
+	}
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	req := trafficRequest{
+		Time:      rl.start,
+		ID:        rl.id,
+		Route:     rl.route,
+		Status:    status,
+		LatencyMS: float64(time.Since(rl.start).Microseconds()) / 1000,
+		Key:       rl.key,
+		Model:     rl.model,
+		Stream:    rl.stream,
+		Cache:     sw.Header().Get("X-Cache"),
+		Masked:    rl.masked,
+		Error:     rl.err,
+	}
+	if rl.usage != nil {
+		req.Tokens = rl.usage.TotalTokens
+	}
+	if rl.cost != nil {
+		req.Cost = *rl.cost
+	}
+	if rl.upstreamErr != nil {
+		req.UpstreamStatus = rl.upstreamErr.StatusCode
+		req.UpstreamBody = currentConfig().masker.Mask(truncateString(string(rl.upstreamErr.Body), 4096))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	minute := s.minute(rl.start)
+	minute.Requests++
+	if status >= 400 {
+		s.failed++
+		minute.Errors++
+		s.errors = appendRing(s.errors, req, dashboardErrors)
+	}
+	s.recent = appendRing(s.recent, req, dashboardRecent)
+	switch req.Cache {
+	case "HIT":
+		s.cacheHits++
+	case "MISS":
+		s.cacheMisses++
+	}
+
+	if rl.key == "" || rl.model == "" {
+		return
+	}
+	model := rl.upstreamModel
+	if model == "" {
+		model = rl.model
+	}
+	rec := usage.Record{Cost: req.Cost}
+	if rl.usage != nil {
+		rec.PromptTokens = rl.usage.PromptTokens
+		rec.CachedTokens = rl.usage.cachedTokens()
+		rec.CompletionTokens = rl.usage.CompletionTokens
+	}
+	for _, t := range []*trafficTotal{totalFor(s.keys, rl.key), totalFor(s.models, model)} {
+		t.Add(rec)
+		t.Masked += rl.masked
+	}
+}
+
+// minute returns the bucket for t, adding buckets up to it and dropping those older
+// than an hour. Must be called with s.mu held.
+func (s *trafficStats) minute(t time.Time) *trafficMinute {
+	t = t.Truncate(time.Minute)
+	if n := len(s.minutes); n == 0 || s.minutes[n-1].Time.Before(t) {
+		s.minutes = append(s.minutes, trafficMinute{Time: t})
+	}
+	if len(s.minutes) > trafficMinutes {
+		s.minutes = append(s.minutes[:0], s.minutes[len(s.minutes)-trafficMinutes:]...)
+	}
+	return &s.minutes[len(s.minutes)-1]
+}
+
+func appendRing(reqs []trafficRequest, req trafficRequest, size int) []trafficRequest {
+	if len(reqs) >= size {
+		reqs = append(reqs[:0], reqs[len(reqs)-size+1:]...)
+	}
+	return append(reqs, req)
+}
+
+func totalFor(totals map[string]*trafficTotal, name string) *trafficTotal {
+	t, ok := totals[name]
+	if !ok {
+		t = &trafficTotal{}
+		totals[name] = t
+	}
+	return t
+}
+
+// snapshot returns the stats as the dashboard's page reads them, newest requests first
+func (s *trafficStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Minutes without requests are filled in so the chart has a point for each
+	now := time.Now().Truncate(time.Minute)
+	minutes := make([]trafficMinute, 0, trafficMinutes)
+	next := 0
+	for t := now.Add(-(trafficMinutes - 1) * time.Minute); !t.After(now); t = t.Add(time.Minute) {
+		for next < len(s.minutes) && s.minutes[next].Time.Before(t) {
+			next++
+		}
+		if next < len(s.minutes) && s.minutes[next].Time.Equal(t) {
+			minutes = append(minutes, s.minutes[next])
+		} else {
+			minutes = append(minutes, trafficMinute{Time: t})
+		}
+	}
+
+	var prompt, cached int
+	keys := make(map[string]trafficTotal, len(s.keys))
+	for name, t := range s.keys {
+		keys[name] = *t
+		prompt += t.PromptTokens
+		cached += t.CachedTokens
+	}
+	models := make(map[string]trafficTotal, len(s.models))
+	for name, t := range s.models {
+		models[name] = *t
+	}
+	return map[string]interface{}{
+		"started":  s.started,
+		"requests": s.requests,
+		"errors":   s.failed,
+		"minutes":  minutes,
+		"recent":   newestFirst(s.recent),
+		"failures": newestFirst(s.errors),
+		"keys":     keys,
+		"models":   models,
+		"cache": map[string]interface{}{
+			"response_hits":        s.cacheHits,
+			"response_misses":      s.cacheMisses,
+			"response_hit_rate":    rate(s.cacheHits, s.cacheHits+s.cacheMisses),
+			"prompt_tokens":        prompt,
+			"prompt_cached_tokens": cached,
+			"prompt_hit_rate":      rate(cached, prompt),
+		},
+	}
+}
+
+func newestFirst(reqs []trafficRequest) []trafficRequest {
+	result := make([]trafficRequest, len(reqs))
+	for i, req := range reqs {
+		result[len(reqs)-1-i] = req
+	}
+	return result
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// dashboardHandler serves the dashboard's static files. They hold no data, the page
+// asks for the admin token and reads GET /admin/stats with it.
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	fileServer := http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,182 @@
+// Dashboard for a running proxy. Everything shown comes from GET /admin/stats,
+// read with the admin token kept in the tab's session storage.
+"use strict";
+
+const refreshInterval = 2000;
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    node.setAttribute(name, value);
+  }
+  node.append(...children.map((c) => (c instanceof Node ? c : String(c))));
+  return node;
+}
+
+function svg(tag, attrs) {
+  const node = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [name, value] of Object.entries(attrs)) {
+    node.setAttribute(name, value);
+  }
+  return node;
+}
+
+const number = (n) => n.toLocaleString();
+const percent = (r) => (r * 100).toFixed(1) + "%";
+const dollars = (n) => "$" + n.toFixed(4);
+const time = (t) => new Date(t).toLocaleTimeString();
+
+function setStatus(text, error) {
+  $("status").textContent = text;
+  $("status").className = error ? "error" : "";
+}
+
+async function refresh() {
+  const token = sessionStorage.getItem("adminToken");
+  if (!token) {
+    showLogin();
+    return;
+  }
+  let resp;
+  try {
+    resp = await fetch("/admin/stats", { headers: { Authorization: "Bearer " + token } });
+  } catch (err) {
+    setStatus("Proxy unreachable", true);
+    return;
+  }
+  if (resp.status === 401) {
+    sessionStorage.removeItem("adminToken");
+    showLogin();
+    setStatus("Invalid admin token", true);
+    return;
+  }
+  if (!resp.ok) {
+    setStatus("Error " + resp.status, true);
+    return;
+  }
+  render(await resp.json());
+  setStatus("Updated " + new Date().toLocaleTimeString());
+}
+
+function showLogin() {
+  $("dashboard").hidden = true;
+  $("login").hidden = false;
+  $("token").focus();
+}
+
+function render(stats) {
+  $("login").hidden = true;
+  $("dashboard").hidden = false;
+
+  $("requests").textContent = number(stats.requests);
+  $("errors").textContent = number(stats.errors);
+  const cache = stats.cache;
+  $("response-hit-rate").textContent =
+    cache.response_hits + cache.response_misses > 0 ? percent(cache.response_hit_rate) : "-";
+  $("prompt-hit-rate").textContent = cache.prompt_tokens > 0 ? percent(cache.prompt_hit_rate) : "-";
+  $("masked").textContent = number(Object.values(stats.keys).reduce((n, k) => n + k.masked, 0));
+
+  renderTraffic(stats.minutes);
+  renderUsage($("keys"), "Key", stats.keys);
+  renderUsage($("models"), "Model", stats.models);
+  renderRecent(stats.recent);
+  renderFailures(stats.failures);
+}
+
+// renderTraffic draws a bar per minute, the errors over the requests
+function renderTraffic(minutes) {
+  const chart = $("traffic");
+  const width = 600 / minutes.length;
+  const max = Math.max(1, ...minutes.map((m) => m.requests));
+  chart.replaceChildren();
+  minutes.forEach((m, i) => {
+    for (const [count, cls] of [[m.requests, "requests"], [m.errors, "errors"]]) {
+      const height = (count / max) * 110;
+      const bar = svg("rect", { class: cls, x: i * width + 1, y: 120 - height, width: width - 2, height });
+      bar.append(svg("title", {}));
+      bar.firstChild.textContent = `${time(m.time)}: ${m.requests} requests, ${m.errors} errors`;
+      chart.append(bar);
+    }
+  });
+}
+
+// renderUsage lists usage totals by cost, with a bar for each one's share of tokens
+function renderUsage(table, label, totals) {
+  const rows = Object.entries(totals).sort((a, b) => b[1].cost - a[1].cost);
+  const maxTokens = Math.max(1, ...rows.map(([, t]) => t.prompt_tokens + t.completion_tokens));
+  table.replaceChildren(
+    el("tr", {}, el("th", {}, label), el("th", {}, "Requests"), el("th", {}, "Prompt"),
+      el("th", {}, "Cached"), el("th", {}, "Completion"), el("th", {}, "Cost"), el("th", {}, "Masked"), el("th", {})),
+  );
+  for (const [name, t] of rows) {
+    const bar = el("span", { class: "bar" });
+    bar.style.width = Math.round(((t.prompt_tokens + t.completion_tokens) / maxTokens) * 120) + "px";
+    table.append(el("tr", {},
+      el("td", {}, name),
+      el("td", { class: "number" }, number(t.requests)),
+      el("td", { class: "number" }, number(t.prompt_tokens)),
+      el("td", { class: "number" }, number(t.cached_tokens)),
+      el("td", { class: "number" }, number(t.completion_tokens)),
+      el("td", { class: "number" }, dollars(t.cost)),
+      el("td", { class: "number" }, number(t.masked)),
+      el("td", {}, bar),
+    ));
+  }
+}
+
+function renderRecent(requests) {
+  const table = $("recent");
+  table.replaceChildren(
+    el("tr", {}, el("th", {}, "Time"), el("th", {}, "Route"), el("th", {}, "Status"), el("th", {}, "Latency"),
+      el("th", {}, "Key"), el("th", {}, "Model"), el("th", {}, "Tokens"), el("th", {}, "Cost"),
+      el("th", {}, "Cache"), el("th", {}, "Masked")),
+  );
+  for (const r of requests) {
+    table.append(el("tr", r.status >= 400 ? { class: "failed", title: r.error || "" } : {},
+      el("td", {}, time(r.time)),
+      el("td", {}, r.route),
+      el("td", {}, r.status),
+      el("td", { class: "number" }, r.latency_ms.toFixed(0) + " ms"),
+      el("td", {}, r.key || ""),
+      el("td", {}, r.model ? r.model + (r.stream ? " (stream)" : "") : ""),
+      el("td", { class: "number" }, r.tokens ? number(r.tokens) : ""),
+      el("td", { class: "number" }, r.cost ? dollars(r.cost) : ""),
+      el("td", {}, r.cache || ""),
+      el("td", { class: "number" }, r.masked || ""),
+    ));
+  }
+}
+
+// renderFailures shows failed requests, with the upstream's response when it sent one.
+// Open entries stay open across refreshes.
+function renderFailures(failures) {
+  const list = $("failures");
+  const open = new Set([...list.querySelectorAll("details[open]")].map((d) => d.dataset.id));
+  list.replaceChildren();
+  if (failures.length === 0) {
+    list.append("No errors since the proxy started.");
+  }
+  for (const f of failures) {
+    const details = el("details", { "data-id": f.id },
+      el("summary", {}, `${time(f.time)} ${f.status} ${f.route} ${f.key || ""} ${f.error || ""}`),
+      el("div", {}, `Request ${f.id}${f.model ? ", model " + f.model : ""}`),
+    );
+    if (f.upstream_status) {
+      details.append(el("div", {}, `Upstream returned ${f.upstream_status}:`), el("pre", {}, f.upstream_body));
+    }
+    details.open = open.has(f.id);
+    list.append(details);
+  }
+}
+
+$("login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  sessionStorage.setItem("adminToken", $("token").value);
+  $("token").value = "";
+  refresh();
+});
+
+refresh();
+setInterval(refresh, refreshInterval);
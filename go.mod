@@ -4,8 +4,9 @@ go 1.19
 
 require (
 	github.com/andybalholm/brotli v1.1.1
-	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.16.7
 	golang.org/x/net v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/text v0.21.0 // indirect
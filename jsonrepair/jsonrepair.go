@@ -0,0 +1,203 @@
+package jsonrepair
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrUnrepairable is returned when the input is still invalid JSON after repair
+var ErrUnrepairable = errors.New("jsonrepair: could not repair JSON")
+
+/*
+Repair fixes the common ways language models break JSON and returns valid JSON.
+
+It handles:
+  - Markdown code fences around the JSON
+  - Trailing commas before } and ]
+  - Unquoted and single-quoted keys and strings
+  - Raw newlines and tabs inside strings
+  - Python style True, False and None
+  - Backslash-escaped single quotes, which JSON doesn't allow
+  - Truncated output: unterminated strings and missing closing braces. A key
+    left without a value, complete or cut off, is dropped.
+
+An empty input repairs to an empty object. Valid input is returned unchanged.
+*/
+func Repair(s string) (string, error) {
+	s = strings.TrimSpace(stripFences(s))
+	if s == "" {
+		return "{}", nil
+	}
+	if json.Valid([]byte(s)) {
+		return s, nil
+	}
+
+	repaired := repair(s)
+	if !json.Valid(repaired) {
+		return "", ErrUnrepairable
+	}
+	return string(repaired), nil
+}
+
+func stripFences(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "```")
+	// Drop the language tag on the opening fence
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.LastIndex(s, "```"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+func repair(s string) []byte {
+	var out bytes.Buffer
+	var closers []byte // Closing brackets still expected, innermost last
+	inString := false
+	escaped := false
+	var quote byte
+	pendingKey := -1 // Where the last key without its colon yet starts in out
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+				if c == '\'' {
+					out.Truncate(out.Len() - 1)
+				}
+				out.WriteByte(c)
+			case c == '\\':
+				escaped = true
+				out.WriteByte(c)
+			case c == quote:
+				inString = false
+				out.WriteByte('"')
+			case c == '"':
+				out.WriteString(`\"`) // Inside a single-quoted string
+			case c == '\n':
+				out.WriteString(`\n`)
+			case c == '\r':
+				out.WriteString(`\r`)
+			case c == '\t':
+				out.WriteString(`\t`)
+			default:
+				out.WriteByte(c)
+			}
+			continue
+		}
+
+		switch {
+		case c == '"' || c == '\'':
+			if expectsKey(out.Bytes(), closers) {
+				pendingKey = out.Len()
+			}
+			inString = true
+			quote = c
+			out.WriteByte('"')
+		case c == '{':
+			closers = append(closers, '}')
+			out.WriteByte(c)
+		case c == '[':
+			closers = append(closers, ']')
+			out.WriteByte(c)
+		case c == ':':
+			pendingKey = -1
+			out.WriteByte(c)
+		case c == '}' || c == ']':
+			if pendingKey >= 0 {
+				out.Truncate(pendingKey)
+				pendingKey = -1
+			}
+			trimTrailingComma(&out)
+			if n := len(closers); n > 0 && closers[n-1] == c {
+				closers = closers[:n-1]
+			}
+			out.WriteByte(c)
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(s) && isIdentPart(s[j]) {
+				j++
+			}
+			word := s[i:j]
+			i = j - 1
+			if expectsKey(out.Bytes(), closers) {
+				pendingKey = out.Len()
+				out.WriteString(`"` + word + `"`)
+				continue
+			}
+			switch word {
+			case "True":
+				word = "true"
+			case "False":
+				word = "false"
+			case "None":
+				word = "null"
+			}
+			out.WriteString(word)
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	// Close whatever the truncated input left open
+	if inString {
+		if escaped {
+			out.Truncate(out.Len() - 1)
+		}
+		out.WriteByte('"')
+	}
+	if pendingKey >= 0 {
+		out.Truncate(pendingKey)
+	}
+	trimTrailingComma(&out)
+	if last := lastNonSpace(out.Bytes()); last == ':' {
+		out.WriteString("null")
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		trimTrailingComma(&out)
+		out.WriteByte(closers[i])
+	}
+	return out.Bytes()
+}
+
+// expectsKey reports whether the next token is an object key
+func expectsKey(out []byte, closers []byte) bool {
+	if len(closers) == 0 || closers[len(closers)-1] != '}' {
+		return false
+	}
+	last := lastNonSpace(out)
+	return last == '{' || last == ','
+}
+
+func trimTrailingComma(out *bytes.Buffer) {
+	b := bytes.TrimRight(out.Bytes(), " \t\r\n")
+	if len(b) > 0 && b[len(b)-1] == ',' {
+		out.Truncate(len(b) - 1)
+	}
+}
+
+func lastNonSpace(b []byte) byte {
+	b = bytes.TrimRight(b, " \t\r\n")
+	if len(b) == 0 {
+		return 0
+	}
+	return b[len(b)-1]
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c == '-' || (c >= '0' && c <= '9')
+}
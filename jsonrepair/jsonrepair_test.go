@@ -0,0 +1,45 @@
+package jsonrepair
+
+import "testing"
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"valid", `{"a": 1}`, `{"a": 1}`},
+		{"empty", ``, `{}`},
+		{"fences", "```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"trailing comma", `{"a": [1, 2,],}`, `{"a": [1, 2]}`},
+		{"unquoted key", `{a: 1}`, `{"a": 1}`},
+		{"single quotes", `{'a': 'b "c"'}`, `{"a": "b \"c\""}`},
+		{"escaped single quote", `{'a': 'it\'s'}`, `{"a": "it's"}`},
+		{"escaped single quote in double quotes", `{"a": "it\'s"}`, `{"a": "it's"}`},
+		{"raw newline", "{\"a\": \"b\nc\"}", `{"a": "b\nc"}`},
+		{"python constants", `{"a": True, "b": None}`, `{"a": true, "b": null}`},
+		{"unterminated string", `{"a": "b`, `{"a": "b"}`},
+		{"missing value", `{"a":`, `{"a":null}`},
+		{"dangling key", `{"a"`, `{}`},
+		{"dangling key after a pair", `{"a": "b", "c"`, `{"a": "b"}`},
+		{"truncated key", `{"a": "b", "c`, `{"a": "b"}`},
+		{"dangling unquoted key", `{"a": 1, b`, `{"a": 1}`},
+		{"dangling key before brace", `{"a": {"b"}}`, `{"a": {}}`},
+		{"nested truncation", `{"a": [{"b": 1`, `{"a": [{"b": 1}]}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Repair(tc.in)
+			if err != nil {
+				t.Fatalf("Repair(%q): %v", tc.in, err)
+			}
+			if got != tc.want {
+				t.Errorf("Repair(%q) = %s, want %s", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnrepairable(t *testing.T) {
+	if _, err := Repair(`{"a": 1}}`); err != ErrUnrepairable {
+		t.Errorf("got %v, want ErrUnrepairable", err)
+	}
+}
@@ -0,0 +1,357 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every place where a value doesn't match its schema
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// SchemaError reports a schema that can't be used to validate anything, such as
+// one whose $ref points back to itself without descending into the value
+type SchemaError struct {
+	Problem string
+}
+
+func (e *SchemaError) Error() string {
+	return "invalid schema: " + e.Problem
+}
+
+/*
+Validate checks value, as decoded by encoding/json, against a JSON schema.
+
+It supports the subset of JSON Schema used by tool definitions: type, enum,
+const, properties, required, additionalProperties, items, minItems, maxItems,
+minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+exclusiveMaximum, anyOf, oneOf, allOf and local $ref. Unknown keywords are
+ignored. A nil schema accepts anything. A *SchemaError is returned for a schema
+with a $ref cycle.
+*/
+func Validate(schema interface{}, value interface{}) error {
+	v := &validator{root: normalize(schema), resolving: make(map[string]bool)}
+	v.validate(v.root, value, "$")
+	if v.schemaErr != nil {
+		return v.schemaErr
+	}
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	root     interface{}
+	problems []string
+
+	// References being followed for a value, by ref and path. Meeting one again
+	// before descending into the value would recurse forever.
+	resolving map[string]bool
+	schemaErr *SchemaError
+}
+
+// normalize turns schemas built from Go types into the map form json.Unmarshal produces
+func normalize(schema interface{}) interface{} {
+	switch schema.(type) {
+	case nil, map[string]interface{}, bool:
+		return schema
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+func (v *validator) addf(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) validate(schema interface{}, value interface{}, path string) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if b, isBool := schema.(bool); isBool && !b {
+			v.addf(path, "no value is allowed here")
+		}
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		key := ref + " " + path
+		if v.resolving[key] {
+			if v.schemaErr == nil {
+				v.schemaErr = &SchemaError{Problem: fmt.Sprintf("$ref %q refers to itself", ref)}
+			}
+			return
+		}
+		if target := v.resolve(ref); target != nil {
+			v.resolving[key] = true
+			v.validate(target, value, path)
+			delete(v.resolving, key)
+		}
+		return
+	}
+	if v.schemaErr != nil {
+		return
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		v.addf(path, "expected %s, got %s", describeType(t), typeName(value))
+		return
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.addf(path, "must be one of %s", compact(enum))
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		v.addf(path, "must be %s", compact(c))
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(s, val, path)
+	case []interface{}:
+		v.validateArray(s, val, path)
+	case string:
+		v.validateString(s, val, path)
+	case float64:
+		v.validateNumber(s, val, path)
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok && v.countMatches(anyOf, value, path) == 0 {
+		v.addf(path, "does not match any of the allowed schemas")
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		if n := v.countMatches(oneOf, value, path); n != 1 {
+			v.addf(path, "must match exactly one schema, matched %d", n)
+		}
+	}
+}
+
+func (v *validator) countMatches(schemas []interface{}, value interface{}, path string) int {
+	n := 0
+	for _, sub := range schemas {
+		nested := &validator{root: v.root, resolving: v.resolving}
+		nested.validate(sub, value, path)
+		if nested.schemaErr != nil {
+			v.schemaErr = nested.schemaErr
+			return 0
+		}
+		if len(nested.problems) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *validator) validateObject(s map[string]interface{}, obj map[string]interface{}, path string) {
+	props, _ := s["properties"].(map[string]interface{})
+
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; name != "" && !present {
+				v.addf(path, "missing required property %q", name)
+			}
+		}
+	}
+
+	// Sort keys so problems are reported in a stable order
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := path + "." + k
+		if propSchema, ok := props[k]; ok {
+			v.validate(propSchema, obj[k], childPath)
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.addf(path, "unexpected property %q", k)
+			}
+		case map[string]interface{}:
+			v.validate(additional, obj[k], childPath)
+		}
+	}
+}
+
+func (v *validator) validateArray(s map[string]interface{}, arr []interface{}, path string) {
+	if min, ok := number(s["minItems"]); ok && float64(len(arr)) < min {
+		v.addf(path, "must have at least %v items", min)
+	}
+	if max, ok := number(s["maxItems"]); ok && float64(len(arr)) > max {
+		v.addf(path, "must have at most %v items", max)
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range arr {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+func (v *validator) validateString(s map[string]interface{}, str string, path string) {
+	length := float64(len([]rune(str)))
+	if min, ok := number(s["minLength"]); ok && length < min {
+		v.addf(path, "must be at least %v characters", min)
+	}
+	if max, ok := number(s["maxLength"]); ok && length > max {
+		v.addf(path, "must be at most %v characters", max)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(str) {
+			v.addf(path, "must match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(s map[string]interface{}, n float64, path string) {
+	if min, ok := number(s["minimum"]); ok && n < min {
+		v.addf(path, "must be >= %v", min)
+	}
+	if max, ok := number(s["maximum"]); ok && n > max {
+		v.addf(path, "must be <= %v", max)
+	}
+	if min, ok := number(s["exclusiveMinimum"]); ok && n <= min {
+		v.addf(path, "must be > %v", min)
+	}
+	if max, ok := number(s["exclusiveMaximum"]); ok && n >= max {
+		v.addf(path, "must be < %v", max)
+	}
+}
+
+// resolve looks up a local reference such as #/$defs/item or #/definitions/item
+func (v *validator) resolve(ref string) interface{} {
+	if !strings.HasPrefix(ref, "#") {
+		return nil
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[part]
+	}
+	return node
+}
+
+func matchesType(t interface{}, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func describeType(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, 0, len(list))
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func typeName(value interface{}) string {
+	switch n := value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(float64)
+	return n, ok
+}
+
+func compact(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,62 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name, schema, value string
+		problem             string // Empty when the value is valid
+	}{
+		{"type", `{"type":"string"}`, `1`, "expected string, got integer"},
+		{"type list", `{"type":["string","null"]}`, `null`, ""},
+		{"integer", `{"type":"integer"}`, `1.5`, "expected integer, got number"},
+		{"required", `{"type":"object","required":["path"]}`, `{}`, `missing required property "path"`},
+		{"additional properties", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, `unexpected property "b"`},
+		{"nested", `{"properties":{"a":{"items":{"type":"number"}}}}`, `{"a":[1,"x"]}`, "$.a[1]: expected number"},
+		{"enum", `{"enum":["a","b"]}`, `"c"`, `must be one of ["a","b"]`},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, `"A"`, "must match pattern"},
+		{"minimum", `{"minimum":1}`, `0`, "must be >= 1"},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"number"}]}`, `true`, "does not match any"},
+		{"oneOf", `{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, "matched 2"},
+		{"false schema", `{"properties":{"a":false}}`, `{"a":1}`, "no value is allowed"},
+		{"ref", `{"$defs":{"s":{"type":"string"}},"properties":{"a":{"$ref":"#/$defs/s"}}}`, `{"a":1}`, "$.a: expected string"},
+		{"recursive ref", `{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`,
+			`{"children":[{"children":[{"children":"x"}]}]}`, "$.children[0].children[0].children: expected array"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var schema, value interface{}
+			json.Unmarshal([]byte(tc.schema), &schema)
+			json.Unmarshal([]byte(tc.value), &value)
+			err := Validate(schema, value)
+			switch {
+			case tc.problem == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)):
+				t.Errorf("got %v, want %q", err, tc.problem)
+			}
+		})
+	}
+}
+
+func TestCyclicRef(t *testing.T) {
+	for _, schema := range []string{
+		`{"$defs":{"a":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`,
+		`{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`,
+		`{"$defs":{"a":{"allOf":[{"$ref":"#/$defs/a"}]}},"$ref":"#/$defs/a"}`,
+		`{"anyOf":[{"$ref":"#"}]}`,
+		`{"properties":{"x":{"oneOf":[{"$ref":"#/properties/x"}]}}}`,
+	} {
+		var s interface{}
+		json.Unmarshal([]byte(schema), &s)
+		var schemaErr *SchemaError
+		if err := Validate(s, map[string]interface{}{"x": 1.0}); !errors.As(err, &schemaErr) {
+			t.Errorf("%s: got %v", schema, err)
+		}
+	}
+}
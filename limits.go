@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Request bodies larger than this are rejected with 413. Cursor sends whole files,
+// so the default leaves plenty of room for them.
+var maxRequestBytes int64 = 32 << 20
+
+// Upstream responses larger than this, once decompressed, are cut off
+var maxResponseBytes int64 = 64 << 20
+
+var errResponseTooLarge = errors.New("upstream response is too large")
+
+func initLimits() {
+	for name, limit := range map[string]*int64{
+		"MAX_REQUEST_BYTES":  &maxRequestBytes,
+		"MAX_RESPONSE_BYTES": &maxResponseBytes,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				log.Fatalf("Invalid %s %q", name, v)
+			}
+			*limit = n
+		}
+	}
+}
+
+// readRequestBody reads the client's request body in one allocation when it
+// announces its length, failing with *http.MaxBytesError past MAX_REQUEST_BYTES
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if r.ContentLength > maxRequestBytes {
+		return nil, &http.MaxBytesError{Limit: maxRequestBytes}
+	}
+	var buf bytes.Buffer
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	return buf.Bytes(), err
+}
+
+// requestTooLarge reports an error of readRequestBody as a 413, it returns false for other errors
+func requestTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large",
+		fmt.Sprintf("Request bodies are limited to %d bytes", tooLarge.Limit))
+	return true
+}
+
+// limitedReader fails with errResponseTooLarge once more than max bytes were read
+type limitedReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, errResponseTooLarge
+	}
+	return n, err
+}
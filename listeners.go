@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Listener is an address the proxy serves on, what it serves there and how clients
+// of its proxy endpoints authenticate. The admin API always wants the admin token.
+type Listener struct {
+	Address string   `yaml:"address" json:"address"`                 // host:port, :port or unix:/path/to/socket
+	Serve   []string `yaml:"serve,omitempty" json:"serve,omitempty"` // proxy, admin and dashboard, all of them when empty
+	Auth    string   `yaml:"auth,omitempty" json:"auth,omitempty"`   // keys (the default), client_cert or none
+	Key     string   `yaml:"key,omitempty" json:"key,omitempty"`     // Name of the client key requests use with auth: none
+}
+
+// Addresses from LISTEN, ":" + PORT when empty
+var listenAddrs []string
+
+// Address from ADMIN_LISTEN, where the admin API and dashboard are served instead
+// of on the LISTEN addresses
+var adminListen string
+
+func initListeners() {
+	listenAddrs = splitList(os.Getenv("LISTEN"))
+	adminListen = os.Getenv("ADMIN_LISTEN")
+}
+
+// listeners returns the listeners to serve on, from the configuration file or LISTEN,
+// ADMIN_LISTEN and PORT
+func (c *Config) listeners() []Listener {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	addrs := listenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{":" + port}
+	}
+	var serve []string
+	if adminListen != "" {
+		serve = []string{"proxy"}
+	}
+	var listeners []Listener
+	for _, addr := range addrs {
+		listeners = append(listeners, Listener{Address: addr, Serve: serve})
+	}
+	if adminListen != "" {
+		listeners = append(listeners, Listener{Address: adminListen, Serve: []string{"admin", "dashboard"}})
+	}
+	return listeners
+}
+
+// validateListeners checks the listeners of the configuration file
+func (c *Config) validateListeners() []string {
+	var problems []string
+	problemf := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	addrs := make(map[string]bool)
+	for i, l := range c.Listeners {
+		switch {
+		case l.Address == "":
+			problemf("listeners[%d]: address is required", i)
+		case addrs[l.Address]:
+			problemf("listeners[%d]: address %s is used more than once", i, l.Address)
+		}
+		addrs[l.Address] = true
+		for _, name := range l.Serve {
+			if name != "proxy" && name != "admin" && name != "dashboard" {
+				problemf("listeners[%d]: serve: unknown endpoints %q, use proxy, admin or dashboard", i, name)
+			}
+		}
+		switch l.Auth {
+		case "", "keys":
+		case "client_cert":
+			if tlsClientCAFile == "" || l.unixSocket() != "" {
+				problemf("listeners[%d]: auth client_cert needs TLS with TLS_CLIENT_CA_FILE", i)
+			}
+		case "none":
+			// Anyone who can connect spends the key's budget, so only local clients may
+			if !l.local() {
+				problemf("listeners[%d]: auth none is only allowed on unix sockets and loopback addresses", i)
+			}
+			if c.namedKey(l.Key) == nil {
+				problemf("listeners[%d]: auth none needs the name of a client key in key", i)
+			}
+		default:
+			problemf("listeners[%d]: unknown auth %q, use keys, client_cert or none", i, l.Auth)
+		}
+		if l.Key != "" && l.Auth != "none" {
+			problemf("listeners[%d]: key is only used with auth none", i)
+		}
+	}
+	return problems
+}
+
+// namedKey returns the client key with a name as shown in logs, nil when there is none
+func (c *Config) namedKey(name string) *ClientKey {
+	for i := range c.Keys {
+		if name != "" && keyLabel(c.Keys[i]) == name {
+			return &c.Keys[i]
+		}
+	}
+	return nil
+}
+
+func (l *Listener) serves(name string) bool {
+	if len(l.Serve) == 0 {
+		return true
+	}
+	for _, s := range l.Serve {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) served() []string {
+	if len(l.Serve) == 0 {
+		return []string{"proxy", "admin", "dashboard"}
+	}
+	return l.Serve
+}
+
+// unixSocket returns the path of a unix socket address, empty for TCP addresses
+func (l *Listener) unixSocket() string {
+	if !strings.HasPrefix(l.Address, "unix:") {
+		return ""
+	}
+	return strings.TrimPrefix(l.Address, "unix:")
+}
+
+// local reports whether only clients on this machine can connect
+func (l *Listener) local() bool {
+	if l.unixSocket() != "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listen opens the listener's socket. Unix sockets left behind by an earlier run
+// are replaced, and the new one can be used by the owner and group.
+func (l *Listener) listen() (net.Listener, error) {
+	path := l.unixSocket()
+	if path == "" {
+		return net.Listen("tcp", l.Address)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// server returns the server for the listener's endpoints, with TLS on TCP sockets
+// when certs are set
+func (l *Listener) server(certs *certificates) (*http.Server, error) {
+	if l.unixSocket() != "" {
+		certs = nil
+	}
+	return newServer(l.handler(), certs)
+}
+
+// serveListener serves ln until the server is shut down
+func serveListener(server *http.Server, ln net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+type listenerKey struct{}
+
+// listenerFrom returns the listener a request came in on, one that serves
+// everything with the usual authentication outside of a listener's handler
+func listenerFrom(ctx context.Context) *Listener {
+	if l, ok := ctx.Value(listenerKey{}).(*Listener); ok {
+		return l
+	}
+	return &Listener{}
+}
+
+// handler returns the endpoints the listener serves wrapped in their middleware.
+// Admin and dashboard paths are not found rather than passed to the proxy when
+// they are served elsewhere.
+func (l *Listener) handler() http.Handler {
+	mux := http.NewServeMux()
+	admin, dashboard := http.NotFoundHandler(), http.NotFoundHandler()
+	if l.serves("admin") {
+		admin = http.HandlerFunc(adminHandler)
+	}
+	if l.serves("dashboard") {
+		dashboard = dashboardHandler()
+	}
+	mux.Handle("/admin/", admin)
+	mux.Handle("/dashboard/", dashboard)
+	if l.serves("proxy") {
+		mux.Handle("/", withCORS(withTracing(http.HandlerFunc(proxyHandler))))
+	}
+	next := withRequestLog(withCompression(mux))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, l)))
+	})
+}
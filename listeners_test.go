@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// writeCertificate creates a certificate signed by parent, self-signed when parent is
+// nil, and writes it and its key as PEM files to dir
+func writeCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	_, upstream := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.Keys = []ClientKey{{Name: "alice", ClientCert: "alice-laptop", UpstreamKey: "sk-alice"}}
+	useConfig(t, &cfg)
+
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert := func(name string) {
+		writeCertificate(t, dir, "server", &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca, caKey)
+	}
+	serverCert("proxy")
+	writeCertificate(t, dir, "alice", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice-laptop"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	saved := []string{tlsCertFile, tlsKeyFile, tlsClientCAFile}
+	t.Cleanup(func() { tlsCertFile, tlsKeyFile, tlsClientCAFile = saved[0], saved[1], saved[2] })
+	tlsCertFile, tlsKeyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	tlsClientCAFile = filepath.Join(dir, "ca.crt")
+	certs, err := serverCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newServer(newHandler(), certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	aliceCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice.crt"), filepath.Join(dir, "alice.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "https://" + ln.Addr().String() + "/v1/chat/completions"
+
+	// The client certificate stands for alice's key, no Authorization header needed
+	resp, err := client(aliceCert).Post(url, "application/json", strings.NewReader(chatBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Proto != "HTTP/2.0" {
+		t.Errorf("got %d over %s", resp.StatusCode, resp.Proto)
+	}
+	if auth := upstream.Requests()[0].Header.Get("Authorization"); auth != "Bearer sk-alice" {
+		t.Errorf("upstream got %q", auth)
+	}
+	if _, err := client().Post(url, "application/json", strings.NewReader(chatBody)); err == nil {
+		t.Error("connection without a client certificate was accepted")
+	}
+
+	// Rotated certificates are served after SIGHUP
+	serverCert("rotated")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{aliceCert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if name == "rotated" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving the %s certificate", name)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	newTestProxy(t)
+	server, err := newServer(newHandler(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(server.Handler)
+	t.Cleanup(proxy.Close)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(chatBody))
+	req.Header.Set("Authorization", "Bearer "+testSecret+"@"+testAPIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Proto != "HTTP/2.0" {
+		t.Errorf("got %d over %s", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	_, upstream := newTestProxy(t)
+	dir, err := os.MkdirTemp("", "proxy") // Unix socket paths are short
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "proxy.sock")
+
+	cfg := *currentConfig()
+	cfg.AdminToken = "admin-token-0123456789"
+	cfg.Keys = []ClientKey{{Name: "sidecar", Key: "sk-proxy-sidecar", UpstreamKey: "sk-sidecar"}}
+	cfg.Listeners = []Listener{
+		{Address: "unix:" + socket, Serve: []string{"proxy"}, Auth: "none", Key: "sidecar"},
+		{Address: "127.0.0.1:0", Serve: []string{"admin", "dashboard"}},
+	}
+	useConfig(t, &cfg)
+
+	var addrs []string
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		ln, err := l.listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		server, err := l.server(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveListener(server, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// The sidecar's socket needs no Authorization header and only serves the proxy
+	sidecar := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	resp, err := sidecar.Post("http://proxy/v1/chat/completions", "application/json", strings.NewReader(chatBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	if auth := upstream.Requests()[0].Header.Get("Authorization"); auth != "Bearer sk-sidecar" {
+		t.Errorf("upstream got %q", auth)
+	}
+	if resp, _ := sidecar.Get("http://proxy/admin/config"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("admin API on the proxy socket got %d", resp.StatusCode)
+	}
+
+	// The admin listener serves nothing else
+	resp, err = http.Post("http://"+addrs[1]+"/v1/chat/completions", "application/json", strings.NewReader(chatBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("proxy on the admin listener got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addrs[1]+"/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("admin API got %v %v", resp, err)
+	}
+
+	cfg.Listeners = []Listener{{Address: ":9000", Auth: "none", Key: "sidecar"}, {Address: ":9001", Serve: []string{"metrics"}}}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "auth none is only allowed") || !strings.Contains(err.Error(), `"metrics"`) {
+		t.Errorf("got %v", err)
+	}
+}
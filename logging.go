@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// Lowest level that is logged, DEBUG=true lowers it to debug
+var minLogLevel = levelInfo
+
+// Log line format: "text" (the standard log package), "json" or "logfmt"
+var logFormat = "text"
+
+// Request and response bodies are only logged at debug level, and only when
+// LOG_BODIES is "redacted" (run through the masker) or "full"
+var logBodies = "off"
+
+// Where json and logfmt lines are written
+var logOutput io.Writer = os.Stderr
+var logMu sync.Mutex
+
+// Keys whose requests are logged at debug level, toggled through the admin API
+var debugKeys = &keySet{keys: make(map[string]bool)}
+
+type keySet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (s *keySet) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[key]
+}
+
+func (s *keySet) set(key string, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if on {
+		s.keys[key] = true
+	} else {
+		delete(s.keys, key)
+	}
+}
+
+func (s *keySet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Header carrying the request ID to the upstream and back to the client
+const requestIDHeader = "X-Request-ID"
+
+func initLogging() {
+	if debug {
+		minLogLevel = levelDebug
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		l, ok := parseLogLevel(level)
+		if !ok {
+			log.Fatalf("Invalid LOG_LEVEL %q, use debug, info, warn or error", level)
+		}
+		minLogLevel = l
+	}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "text", "json", "logfmt":
+		logFormat = format
+	case "":
+	default:
+		log.Fatalf("Invalid LOG_FORMAT %q, use text, json or logfmt", format)
+	}
+	switch bodies := os.Getenv("LOG_BODIES"); bodies {
+	case "off", "redacted", "full":
+		logBodies = bodies
+	case "":
+	default:
+		log.Fatalf("Invalid LOG_BODIES %q, use off, redacted or full", bodies)
+	}
+}
+
+func parseLogLevel(name string) (logLevel, bool) {
+	for l, n := range levelNames {
+		if n == name {
+			return logLevel(l), true
+		}
+	}
+	return levelInfo, false
+}
+
+// Add a debug logging helper
+func debugLog(format string, v ...interface{}) {
+	if minLogLevel <= levelDebug {
+		output(3, levelDebug, fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func infoLog(format string, v ...interface{}) {
+	if minLogLevel <= levelInfo {
+		output(3, levelInfo, fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func errorLog(format string, v ...interface{}) {
+	output(3, levelError, fmt.Sprintf(format, v...), nil)
+}
+
+// output writes one log line, fields are alternating keys and values.
+// calldepth is passed on to log.Output so text lines point at the caller.
+func output(calldepth int, level logLevel, msg string, fields []interface{}) {
+	switch logFormat {
+	case "json":
+		var buf bytes.Buffer
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, fields[i+1])
+		}
+		buf.WriteString("}\n")
+		writeLogLine(buf.Bytes())
+	case "logfmt":
+		var buf bytes.Buffer
+		buf.WriteString("time=" + time.Now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(" level=" + level.String())
+		buf.WriteString(" msg=" + logfmtValue(msg))
+		writeLogfmtFields(&buf, fields)
+		buf.WriteByte('\n')
+		writeLogLine(buf.Bytes())
+	default:
+		var buf bytes.Buffer
+		if level != levelInfo {
+			buf.WriteString(strings.ToUpper(level.String()) + " ")
+		}
+		buf.WriteString(msg)
+		writeLogfmtFields(&buf, fields)
+		log.Output(calldepth, buf.String())
+	}
+}
+
+func writeLogLine(line []byte) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(line)
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+func writeLogfmtFields(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fields[i+1]))
+	}
+}
+
+// logfmtValue quotes values that contain spaces, quotes or equals signs
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// requestLog follows a request through the proxy and is logged once when it completes
+type requestLog struct {
+	id      string
+	traceID string
+	start   time.Time
+	method  string
+	route   string
+	key     string // Name of the client key or fingerprint of the API key, never the key itself
+	model   string
+	stream  bool
+	usage   *Usage // Summed over all upstream calls to the request's upstream model
+	masked  int
+	err     string
+	debug   bool // Logged at debug level whatever the LOG_LEVEL
+
+	upstreamModel  string
+	otherUsage     map[string]Usage // Usage of other models the proxy called on its own, like the summary model
+	upstreamErr    *upstreamError   // Error response from the upstream, kept for the dashboard
+	cost           *float64
+	promptEstimate int // Estimated prompt tokens before the request was sent
+}
+
+type requestLogKey struct{}
+
+// requestLogFrom returns the request's log, or an empty one outside of withRequestLog
+func requestLogFrom(ctx context.Context) *requestLog {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl
+	}
+	return &requestLog{}
+}
+
+// withRequestLog assigns every request an ID, returns it to the client and
+// logs the request with its outcome once the handler is done
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := &requestLog{
+			id:     requestID(r),
+			start:  time.Now(),
+			method: r.Method,
+			route:  r.URL.Path,
+		}
+		w.Header().Set(requestIDHeader, rl.id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+		recordUsage(rl)
+		rl.finish(sw)
+		traffic.record(rl, sw)
+	})
+}
+
+// requestID keeps a well-formed ID sent by the client and generates one otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 && strings.Trim(id, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.:") == "" {
+		return id
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "req_" + hex.EncodeToString(b)
+}
+
+// keyFingerprint identifies an API key in logs without revealing it
+func keyFingerprint(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+// addUsage adds the usage of an upstream call to model
+func (rl *requestLog) addUsage(model string, u Usage) {
+	if model != rl.upstreamModel && model != "" && rl.upstreamModel != "" {
+		if rl.otherUsage == nil {
+			rl.otherUsage = make(map[string]Usage)
+		}
+		total := rl.otherUsage[model]
+		total.add(u)
+		rl.otherUsage[model] = total
+		return
+	}
+	if rl.usage == nil {
+		rl.usage = &Usage{}
+	}
+	rl.usage.add(u)
+}
+
+func (rl *requestLog) fields(extra ...interface{}) []interface{} {
+	if rl.id == "" {
+		return extra
+	}
+	return append([]interface{}{"request_id", rl.id}, extra...)
+}
+
+func (rl *requestLog) debugf(format string, v ...interface{}) {
+	if minLogLevel <= levelDebug || rl.debug {
+		output(3, levelDebug, fmt.Sprintf(format, v...), rl.fields())
+	}
+}
+
+// logBody logs a request or response body at debug level when LOG_BODIES allows it,
+// masked with the configuration's patterns when redacted
+func (rl *requestLog) logBody(label string, body []byte) {
+	if (minLogLevel > levelDebug && !rl.debug) || logBodies == "off" {
+		return
+	}
+	text := string(body)
+	if logBodies == "redacted" {
+		text = currentConfig().masker.Mask(text)
+	}
+	output(3, levelDebug, label, rl.fields("body", text))
+}
+
+// errorf logs an error and keeps it for the request's completion line
+func (rl *requestLog) errorf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	rl.err = msg
+	output(3, levelError, msg, rl.fields())
+}
+
+func (rl *requestLog) finish(sw *statusWriter) {
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	level := levelInfo
+	switch {
+	case status >= 500:
+		level = levelError
+	case status >= 400:
+		level = levelWarn
+	}
+	if level < minLogLevel && !rl.debug {
+		return
+	}
+
+	fields := rl.fields(
+		"method", rl.method,
+		"route", rl.route,
+		"status", status,
+		"latency_ms", float64(time.Since(rl.start).Microseconds())/1000,
+		"bytes", sw.bytes,
+	)
+	if rl.traceID != "" {
+		fields = append(fields, "trace_id", rl.traceID)
+	}
+	if rl.key != "" {
+		fields = append(fields, "key", rl.key)
+	}
+	if rl.model != "" {
+		fields = append(fields, "model", rl.model, "stream", rl.stream)
+	}
+	if cache := sw.Header().Get("X-Cache"); cache != "" {
+		fields = append(fields, "cache", cache)
+	}
+	if rl.promptEstimate > 0 {
+		fields = append(fields, "estimated_prompt_tokens", rl.promptEstimate)
+	}
+	if rl.usage != nil {
+		fields = append(fields,
+			"prompt_tokens", rl.usage.PromptTokens,
+			"completion_tokens", rl.usage.CompletionTokens,
+			"total_tokens", rl.usage.TotalTokens)
+		if cached := rl.usage.cachedTokens(); cached > 0 {
+			fields = append(fields, "cached_tokens", cached)
+		}
+	}
+	if rl.cost != nil {
+		fields = append(fields, "cost_usd", strconv.FormatFloat(*rl.cost, 'f', 6, 64))
+	}
+	if rl.masked > 0 {
+		fields = append(fields, "masked", rl.masked)
+	}
+	if rl.err != "" {
+		fields = append(fields, "error", rl.err)
+	}
+	output(3, level, "Request completed", fields)
+}
+
+// statusWriter records the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
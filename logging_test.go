@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/mockupstream"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRequestLog(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	var logs bytes.Buffer
+	savedFormat, savedOutput := logFormat, logOutput
+	logFormat, logOutput = "json", &logs
+	t.Cleanup(func() { logFormat, logOutput = savedFormat, savedOutput })
+	upstream.Enqueue(mockupstream.Reply{Content: "Hello!", Usage: &mockupstream.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}})
+
+	resp := post(t, proxy, chatBody, "X-Request-ID", "cursor-123")
+	decodeResponse(t, resp)
+	if got := resp.Header.Get("X-Request-ID"); got != "cursor-123" {
+		t.Errorf("got response request ID %q", got)
+	}
+	if got := upstream.Requests()[0].Header.Get("X-Request-ID"); got != "cursor-123" {
+		t.Errorf("got upstream request ID %q", got)
+	}
+
+	// Closing the proxy waits for the handler, and with it the completion line
+	proxy.Close()
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+	}
+	if entry["msg"] != "Request completed" || entry["request_id"] != "cursor-123" || entry["status"] != float64(200) ||
+		entry["model"] != "gpt-4o" || entry["total_tokens"] != float64(5) || entry["key"] != keyFingerprint(testAPIKey) {
+		t.Errorf("got completion line %v", entry)
+	}
+
+	other, _ := newTestProxy(t)
+	generated := post(t, other, chatBody, "X-Request-ID", "not a valid id")
+	if got := generated.Header.Get("X-Request-ID"); !strings.HasPrefix(got, "req_") {
+		t.Errorf("got generated request ID %q", got)
+	}
+}
+
+func TestDebugKeyLogsBodies(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+	var logs bytes.Buffer
+	savedFormat, savedOutput, savedLevel, savedBodies := logFormat, logOutput, minLogLevel, logBodies
+	logFormat, logOutput, minLogLevel, logBodies = "json", &logs, levelInfo, "redacted"
+	t.Cleanup(func() {
+		logFormat, logOutput, minLogLevel, logBodies = savedFormat, savedOutput, savedLevel, savedBodies
+	})
+	debugKeys.set(keyFingerprint(testAPIKey), true)
+	t.Cleanup(func() { debugKeys.set(keyFingerprint(testAPIKey), false) })
+
+	decodeResponse(t, post(t, proxy, `{"model":"gpt-4o","messages":[{"role":"user","content":"plan alpha"}]}`))
+	decodeResponse(t, post(t, proxy, `{"model":"gpt-4o","messages":[{"role":"user","content":"plan beta"}]}`,
+		"Authorization", "Bearer "+testSecret+"@sk-other-key"))
+
+	// The toggled key's bodies and upstream calls are logged, the other key's aren't
+	for _, want := range []string{`"msg":"Modified request body"`, "plan alpha", `"msg":"Forwarding to: `, `"msg":"Original response body"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log is missing %s:\n%s", want, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "plan beta") {
+		t.Errorf("body of a key without debug logging was logged:\n%s", logs.String())
+	}
+}
@@ -7,17 +7,26 @@ import (
 	"compress/gzip"
 	"context"
 	"cursor-deepseek/masker"
+	"cursor-deepseek/recorder"
+	"cursor-deepseek/tracing"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/andybalholm/brotli"
-	"golang.org/x/net/http2"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
@@ -32,17 +41,45 @@ var (
 // Uses ad prefix to API key: secret@apikey
 var secret string
 
+// Bearer token for the /admin API
+var adminToken string
+
 // var port = "9000"
 var port = os.Getenv("PORT")
 var useMask = false
 var debug = false
 
+// How many times to re-ask the model when it ignores a forced tool_choice
+var toolChoiceRetries = 2
+
+// Tool call arguments handling: "repair" fixes malformed JSON, "reask" also
+// re-asks the model when arguments don't match the schema, "off" disables it
+var toolArgsMode = "repair"
+var toolArgsRetries = 1
+
+// Which response_format types upstreams handle themselves: "json_schema",
+// "json_object" or "none", for routes that don't say. Anything else is emulated by the proxy.
+var responseFormatSupport = "json_object"
+var structuredOutputRetries = 2
+
+// Prompted tools for the route built from the environment, see Route.PromptedTools
+var promptedTools = false
+
 func init() {
+	// The configuration file's env section goes first so the settings below see it
+	var fileConfig *Config
+	if configPath = os.Getenv("CONFIG_FILE"); configPath != "" {
+		// Errors are reported by the commands that need the configuration, so
+		// keys can still be managed in a file that doesn't validate here
+		fileConfig, configErr = parseConfig(configPath)
+		if configErr == nil {
+			fileConfig.applyEnv()
+		}
+	}
+
 	// Get DeepSeek API key
 	secret = os.Getenv("SECRET")
-	if secret == "" {
-		log.Fatal("SECRET environment variable is required")
-	}
+	adminToken = os.Getenv("ADMIN_TOKEN")
 	if newPort := os.Getenv("PORT"); newPort != "" {
 		port = newPort
 	}
@@ -52,22 +89,75 @@ func init() {
 	if os.Getenv("DEBUG") == "true" {
 		debug = true
 	}
+	if retries, err := strconv.Atoi(os.Getenv("TOOL_CHOICE_RETRIES")); err == nil && retries >= 0 {
+		toolChoiceRetries = retries
+	}
+	switch mode := os.Getenv("TOOL_ARGS_VALIDATION"); mode {
+	case "off", "repair", "reask":
+		toolArgsMode = mode
+	case "":
+	default:
+		log.Fatalf("Invalid TOOL_ARGS_VALIDATION %q, use off, repair or reask", mode)
+	}
+	if retries, err := strconv.Atoi(os.Getenv("TOOL_ARGS_RETRIES")); err == nil && retries >= 0 {
+		toolArgsRetries = retries
+	}
+	switch support := os.Getenv("RESPONSE_FORMAT_SUPPORT"); support {
+	case "json_schema", "json_object", "none":
+		responseFormatSupport = support
+	case "":
+	default:
+		log.Fatalf("Invalid RESPONSE_FORMAT_SUPPORT %q, use json_schema, json_object or none", support)
+	}
+	if retries, err := strconv.Atoi(os.Getenv("STRUCTURED_OUTPUT_RETRIES")); err == nil && retries >= 0 {
+		structuredOutputRetries = retries
+	}
+	if os.Getenv("PROMPTED_TOOLS") == "true" {
+		promptedTools = true
+	}
+	if os.Getenv("STREAM_USAGE") == "false" {
+		streamUsage = false
+	}
+	initLogging()
+	initTracing()
+	initPricing()
+	initContextWindow()
+	initTrimming()
+	initSummaries()
+	initResponseCache()
+	initRecording()
+	initTLS()
+	initCORS()
+	initOutbound()
+	initListeners()
+	initLimits()
+	initCompression()
+
+	// The file is validated once the settings it is checked against are read.
+	// Without one the environment is validated by startupConfig.
+	if fileConfig != nil {
+		if configErr = fileConfig.validate(); configErr != nil {
+			fileConfig = nil
+		}
+	}
+	if fileConfig != nil {
+		if fileConfig.Port != "" {
+			port = fileConfig.Port
+		}
+		activeConfig.Store(fileConfig)
+	} else {
+		cfg := configFromEnv()
+		cfg.validate()
+		activeConfig.Store(cfg)
+	}
 	// Default port
 	if port == "" {
 		port = "9000"
 	}
 }
 
-// Add a debug logging helper
-func debugLog(format string, v ...interface{}) {
-	if debug {
-		log.Printf(format, v...)
-	}
-}
-
-func errorLog(format string, v ...interface{}) {
-	log.Printf(format, v...)
-}
+// Ask the upstream to report usage at the end of streams, for accounting
+var streamUsage = true
 
 // Models response structure
 type ModelsResponse struct {
@@ -92,6 +182,14 @@ type ChatRequest struct {
 	ToolChoice  interface{} `json:"tool_choice,omitempty"`
 	Temperature *float64    `json:"temperature,omitempty"`
 	MaxTokens   *int        `json:"max_tokens,omitempty"`
+
+	ResponseFormat    *ResponseFormat `json:"response_format,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	StreamOptions     *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
@@ -122,8 +220,98 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
+// OpenAI compatible response structure
+type ChatResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []ChatChoice `json:"choices"`
+	Usage   Usage        `json:"usage"`
+}
+
+type ChatChoice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	// DeepSeek reports how much of the prompt hit its context cache
+	PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens,omitempty"`
+	PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
+}
+
+func (u *Usage) add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.PromptCacheHitTokens += other.PromptCacheHitTokens
+	u.PromptCacheMissTokens += other.PromptCacheMissTokens
+}
+
+func (u *Usage) sub(other Usage) {
+	u.PromptTokens -= other.PromptTokens
+	u.CompletionTokens -= other.CompletionTokens
+	u.TotalTokens -= other.TotalTokens
+	u.PromptCacheHitTokens -= other.PromptCacheHitTokens
+	u.PromptCacheMissTokens -= other.PromptCacheMissTokens
+}
+
+// cachedTokens returns how many prompt tokens were billed at the cached input price
+func (u Usage) cachedTokens() int {
+	return u.PromptCacheHitTokens
+}
+
+// authenticate returns the DeepSeek API key for the client's certificate or Authorization
+// header and the key's name in logs, the ledger and budgets. The error is the message
+// for the client.
+func authenticate(cfg *Config, r *http.Request) (apiKey, keyID string, err error) {
+	// A verified client certificate stands for the key it's mapped to
+	if key := cfg.clientCertKey(r.TLS); key != nil {
+		return key.UpstreamKey, keyLabel(*key), nil
+	}
+	switch l := listenerFrom(r.Context()); l.Auth {
+	case "client_cert":
+		return "", "", errors.New("A client certificate mapped to a key is required")
+	case "none":
+		// Local listeners can serve every request with one key
+		key := cfg.namedKey(l.Key)
+		if key == nil {
+			return "", "", fmt.Errorf("The listener's key %s doesn't exist", l.Key)
+		}
+		return key.UpstreamKey, keyLabel(*key), nil
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", "", errors.New("Authorization header is required")
+	}
+
+	// Expecting format: "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", "", errors.New("Invalid Authorization header format")
+	}
+
+	// Keys from the configuration file stand for an upstream key
+	if key, ok := cfg.keys[parts[1]]; ok {
+		return key.UpstreamKey, keyLabel(*key), nil
+	}
+
+	apiKey = getAPIKey(parts[1], cfg.Secret)
+	if apiKey == "" {
+		return "", "", errors.New("API key is required")
+	}
+	return apiKey, keyFingerprint(apiKey), nil
+}
+
 // getAPIKey parse api key and extract DeepSeek API key from it
-func getAPIKey(s string) string {
+func getAPIKey(s, secret string) string {
 	// if !strings.Contains(s, "@") {
 	// 	return s
 	// }
@@ -131,49 +319,40 @@ func getAPIKey(s string) string {
 	if len(parts) != 2 {
 		return ""
 	}
-	if parts[0] != secret {
+	if secret == "" || parts[0] != secret {
 		return ""
 	}
 	return parts[1]
 }
 
-func convertToolChoice(choice interface{}) string {
-	if choice == nil {
-		return ""
-	}
-
-	// If string "auto" or "none"
-	if str, ok := choice.(string); ok {
-		switch str {
-		case "auto", "none":
-			return str
-		}
-	}
-
-	// Try to parse as map for function call
-	if choiceMap, ok := choice.(map[string]interface{}); ok {
-		if choiceMap["type"] == "function" {
-			return "auto" // DeepSeek doesn't support specific function selection, default to auto
+// maskMessages returns a copy of messages with credentials in user messages masked,
+// and how many were masked
+func maskMessages(m *masker.Masker, messages []Message) ([]Message, int) {
+	masked := make([]Message, len(messages))
+	count := 0
+	for i, msg := range messages {
+		masked[i] = msg
+		if msg.Role == "user" {
+			var n int
+			masked[i].Content, n = m.MaskCount(msg.Content)
+			count += n
 		}
 	}
-
-	return ""
+	return masked, count
 }
 
-func convertMessages(messages []Message) []Message {
+// convertMessages converts messages to DeepSeek format. When budget is positive and the
+// conversation takes more tokens than that, it is trimmed with the TRIM_STRATEGIES.
+func convertMessages(px *proxyRequest, messages []Message, budget int) []Message {
+	rl := px.log()
 	converted := make([]Message, len(messages))
 	for i, msg := range messages {
-		debugLog("Converting message %d - Role: %s", i, msg.Role)
+		rl.debugf("Converting message %d - Role: %s", i, msg.Role)
 		converted[i] = msg
 
-		// Apply masking to user messages if enabled
-		if useMask && msg.Role == "user" {
-			converted[i].Content = masker.Mask(msg.Content)
-		}
-
 		// Handle assistant messages with tool calls
 		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-			debugLog("Processing assistant message with %d tool calls", len(msg.ToolCalls))
+			rl.debugf("Processing assistant message with %d tool calls", len(msg.ToolCalls))
 			// DeepSeek expects tool_calls in a specific format
 			toolCalls := make([]ToolCall, len(msg.ToolCalls))
 			for j, tc := range msg.ToolCalls {
@@ -182,24 +361,32 @@ func convertMessages(messages []Message) []Message {
 					Type:     "function",
 					Function: tc.Function,
 				}
-				debugLog("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
+				rl.debugf("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
 			}
 			converted[i].ToolCalls = toolCalls
 		}
 
 		// Handle function response messages
 		if msg.Role == "function" {
-			debugLog("Converting function response to tool response")
+			rl.debugf("Converting function response to tool response")
 			// Convert to tool response format
 			converted[i].Role = "tool"
 		}
 	}
 
+	// DeepSeek rejects dangling or reordered tool results
+	converted = repairToolPairing(rl, converted)
+
+	// Trim after the repair so tool calls and their results are dropped together
+	if budget > 0 && messagesTokens(px.estimator(), converted) > budget {
+		converted = trimToBudget(px, converted, budget)
+	}
+
 	// Log the final converted messages
 	for i, msg := range converted {
-		debugLog("Final message %d - Role: %s, Content: %s", i, msg.Role, truncateString(msg.Content, 50))
+		rl.debugf("Final message %d - Role: %s, Content: %d bytes", i, msg.Role, len(msg.Content))
 		if len(msg.ToolCalls) > 0 {
-			debugLog("Message %d has %d tool calls", i, len(msg.ToolCalls))
+			rl.debugf("Message %d has %d tool calls", i, len(msg.ToolCalls))
 		}
 	}
 
@@ -222,98 +409,157 @@ type DeepSeekRequest struct {
 	MaxTokens   int       `json:"max_tokens,omitempty"`
 	Tools       []Tool    `json:"tools,omitempty"`
 	ToolChoice  string    `json:"tool_choice,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
 }
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout))
+}
 
-	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: http.HandlerFunc(proxyHandler),
+// serve runs the proxy, the default command
+func serve(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.StringVar(&port, "port", port, "port to listen on when LISTEN and listeners aren't set")
+	checkOnly := fs.Bool("check-config", false, "validate the configuration and exit, like the check-config command")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *checkOnly {
+		return checkConfigCommand(fs.Args(), stdin, stdout)
 	}
 
-	// Enable HTTP/2 support
-	http2.ConfigureServer(server, &http2.Server{})
+	// Misconfiguration is reported now rather than when the first request comes in
+	cfg, err := startupConfig()
+	if err != nil {
+		return err
+	}
+	certs, err := serverCertificates()
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Starting proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	// Every listener is opened before serving starts, so a taken address is reported
+	// without the others serving in the meantime
+	listeners := cfg.listeners()
+	sockets := make([]net.Listener, len(listeners))
+	for i := range listeners {
+		if sockets[i], err = listeners[i].listen(); err != nil {
+			return fmt.Errorf("error listening on %s: %v", listeners[i].Address, err)
+		}
+	}
+	if configPath != "" {
+		go watchConfig(configPath)
 	}
-}
 
-func enableCors(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-}
+	errs := make(chan error, len(listeners))
+	servers := make([]*http.Server, len(listeners))
+	for i := range listeners {
+		l := &listeners[i]
+		if servers[i], err = l.server(certs); err != nil {
+			return err
+		}
+		tls := ""
+		if certs != nil && l.unixSocket() == "" {
+			tls = " with TLS"
+		}
+		infoLog("Serving %s on %s%s", strings.Join(l.served(), ", "), l.Address, tls)
+		go func(server *http.Server, ln net.Listener) { errs <- serveListener(server, ln) }(servers[i], sockets[i])
+	}
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	debugLog("Received request: %s %s", r.Method, r.URL.Path)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		err = fmt.Errorf("server failed: %v", err)
+	case sig := <-stop:
+		infoLog("Received %v, shutting down", sig)
+	}
 
-	if r.Method == "OPTIONS" {
-		enableCors(w, r)
-		return
+	// Requests in flight get to finish, then the spans they left are exported
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(ctx)
 	}
+	shutdownTracing(ctx)
+	return err
+}
 
-	enableCors(w, r)
+// How long requests in flight get to finish when the proxy is stopped
+const shutdownTimeout = 30 * time.Second
 
-	// Extract API key from Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		errorLog("No Authorization header found")
-		http.Error(w, "Authorization header is required", http.StatusUnauthorized)
-		return
-	}
+// newHandler returns the handler of a listener that serves every endpoint
+func newHandler() http.Handler {
+	return (&Listener{}).handler()
+}
 
-	// Expecting format: "Bearer <token>"
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		errorLog("Invalid Authorization header format")
-		http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	rl := requestLogFrom(r.Context())
+	rl.debugf("Received request: %s %s", r.Method, r.URL.Path)
+
+	// The whole request is served with the configuration it started with
+	cfg := currentConfig()
+
+	_, authSpan := startSpan(r.Context(), "authenticate")
+	deepseekAPIKey, keyID, err := authenticate(cfg, r)
+	authSpan.SetError(err)
+	authSpan.End()
+	if err != nil {
+		rl.errorf("Authentication failed: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	rl.key = keyID
+	rl.debug = debugKeys.has(keyID)
 
-	deepseekAPIKey := getAPIKey(parts[1])
-	if deepseekAPIKey == "" {
-		errorLog("Empty or wrong API key in Authorization header")
-		http.Error(w, "API key is required", http.StatusUnauthorized)
+	// Keys that spent their budget are turned away before anything is sent upstream
+	if err := checkBudget(cfg, rl.key); err != nil {
+		rl.errorf("Budget exceeded for key %s: %v", rl.key, err)
+		writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota", "budget_exceeded", err.Error())
 		return
 	}
 
 	// Handle /v1/models endpoint
 	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		debugLog("Handling /v1/models request")
-		handleModelsRequest(w)
+		rl.debugf("Handling /v1/models request")
+		handleModelsRequest(w, rl, cfg)
 		return
 	}
 
 	// Log headers for debugging
-	debugLog("Request headers: %+v", r.Header)
+	rl.debugf("Request headers: %+v", recorder.RedactHeaders(r.Header))
 
-	// Read and log request body for debugging
+	// The body is read and parsed once, everything after works on chatReq
+	_, parseSpan := startSpan(r.Context(), "parse_request")
 	var chatReq ChatRequest
-	body, err := io.ReadAll(r.Body)
+	body, err := readRequestBody(w, r)
 	if err != nil {
-		errorLog("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
+		parseSpan.SetError(err)
+		parseSpan.End()
+		rl.errorf("Error reading request body: %v", err)
+		if !requestTooLarge(w, err) {
+			http.Error(w, "Error reading request", http.StatusBadRequest)
+		}
 		return
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
 	if err := json.Unmarshal(body, &chatReq); err != nil {
-		errorLog("Error parsing request JSON: %v", err)
-		debugLog("Raw request body: %s", string(body))
+		parseSpan.SetError(err)
+		parseSpan.End()
+		rl.errorf("Error parsing request JSON: %v", err)
+		rl.logBody("Raw request body", body)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	debugLog("Parsed request: %+v", chatReq)
+	parseSpan.SetAttributes(tracing.Int("http.request.body.size", len(body)))
+	parseSpan.End()
 
 	// Handle models endpoint
 	if r.URL.Path == "/v1/models" {
-		handleModelsRequest(w)
+		handleModelsRequest(w, rl, cfg)
 		return
 	}
 
@@ -325,40 +571,48 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Only handle API requests with /v1/ prefix
 	if !strings.HasPrefix(r.URL.Path, "/v1/") {
-		errorLog("Invalid path: %s", r.URL.Path)
+		rl.errorf("Invalid path: %s", r.URL.Path)
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
-	// Restore the body for further reading
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	rl.logBody("Request body", body)
 
-	debugLog("Request body: %s", string(body))
+	rl.debugf("Requested model: %s", chatReq.Model)
+	rl.model = chatReq.Model
+	rl.stream = chatReq.Stream
 
-	// Parse the request to check for streaming - reuse existing chatReq
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		errorLog("Error parsing request JSON: %v", err)
-		http.Error(w, "Error parsing request", http.StatusBadRequest)
+	// Replace the requested model, e.g. gpt-4o, with its upstream model
+	route := cfg.route(chatReq.Model)
+	if route == nil {
+		rl.errorf("Unsupported model requested: %s", chatReq.Model)
+		http.Error(w, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, strings.Join(cfg.clientModels(), " or ")), http.StatusBadRequest)
 		return
 	}
-
-	debugLog("Requested model: %s", chatReq.Model)
-
-	// Replace gpt-4o model with deepseek-chat
-	if chatReq.Model == model {
-		chatReq.Model = deepseekChatModel
-		debugLog("Model converted to: %s", deepseekChatModel)
-	} else {
-		errorLog("Unsupported model requested: %s", chatReq.Model)
-		http.Error(w, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, model), http.StatusBadRequest)
-		return
+	chatReq.Model = route.UpstreamModel
+	rl.upstreamModel = route.UpstreamModel
+	rl.debugf("Model converted to: %s", route.UpstreamModel)
+
+	// Apply masking to user messages if enabled
+	messages := chatReq.Messages
+	if cfg.Mask.Enabled {
+		_, maskSpan := startSpan(r.Context(), "mask_messages")
+		messages, rl.masked = maskMessages(cfg.masker, messages)
+		maskSpan.SetAttributes(tracing.Int("masker.findings", rl.masked))
+		maskSpan.End()
 	}
 
 	// Convert to DeepSeek request format
 	deepseekReq := DeepSeekRequest{
-		Model:    deepseekChatModel,
-		Messages: convertMessages(chatReq.Messages),
-		Stream:   chatReq.Stream,
+		Model:  route.UpstreamModel,
+		Stream: chatReq.Stream,
+	}
+
+	// Streams end with a usage chunk so they can be accounted for, it only
+	// reaches the client when it asked for it as well
+	includeUsage := chatReq.Stream && chatReq.StreamOptions != nil && chatReq.StreamOptions.IncludeUsage
+	if chatReq.Stream && (streamUsage || includeUsage) {
+		deepseekReq.StreamOptions = &StreamOptions{IncludeUsage: true}
 	}
 
 	// Copy optional parameters if present
@@ -370,11 +624,10 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle tools/functions
+	choice := parseToolChoice(chatReq.ToolChoice)
 	if len(chatReq.Tools) > 0 {
 		deepseekReq.Tools = chatReq.Tools
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			deepseekReq.ToolChoice = tc
-		}
+		deepseekReq.ToolChoice = choice.upstream()
 	} else if len(chatReq.Functions) > 0 {
 		// Convert functions to tools format
 		tools := make([]Tool, len(chatReq.Functions))
@@ -387,124 +640,249 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		deepseekReq.Tools = tools
 
 		// Convert tool_choice if present
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			deepseekReq.ToolChoice = tc
-		}
-	}
-
-	// Create new request body
-	modifiedBody, err := json.Marshal(deepseekReq)
-	if err != nil {
-		errorLog("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
-		return
+		deepseekReq.ToolChoice = choice.upstream()
 	}
 
-	debugLog("Modified request body: %s", string(modifiedBody))
-
 	// Create the proxy request to DeepSeek
-	targetURL := deepseekEndpoint + targetPath
+	endpoint := cfg.endpoint(route)
+	targetURL := endpoint + targetPath
 	if r.URL.RawQuery != "" {
 		targetURL += "?" + r.URL.RawQuery
 	}
+	px := &proxyRequest{r: r, apiKey: deepseekAPIKey, targetURL: targetURL, route: route}
+
+	// Long conversations are trimmed to what's left of the context window after the tools
+	_, convertSpan := startSpan(r.Context(), "convert_messages", tracing.Int("messages", len(messages)))
+	deepseekReq.Messages = convertMessages(px, messages, messageBudget(px, deepseekReq))
+	convertSpan.SetAttributes(tracing.Int("messages.converted", len(deepseekReq.Messages)))
+	convertSpan.End()
+
+	// Replies that have to be validated are buffered, checked and re-requested until they pass
+	var checks []responseCheck
+	retries := 0
+
+	// DeepSeek can't be forced to call a tool, so validate the reply and retry instead
+	if choice.forced() && len(deepseekReq.Tools) > 0 {
+		rl.debugf("Emulating tool_choice %s %s", choice.Mode, choice.Function)
+		if err := applyToolChoice(&deepseekReq, choice); err != nil {
+			rl.errorf("Invalid tool_choice: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_tool_choice", err.Error())
+			return
+		}
+		checks = append(checks, enforceToolChoice(choice))
+		retries = toolChoiceRetries
+	}
 
-	debugLog("Forwarding to: %s", targetURL)
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		errorLog("Error creating proxy request: %v", err)
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
-		return
+	// Structured outputs the upstream doesn't support are emulated the same way
+	if chatReq.ResponseFormat != nil {
+		check, err := applyResponseFormat(&deepseekReq, chatReq.ResponseFormat, px.route.responseFormatSupport())
+		if err != nil {
+			rl.errorf("Invalid response_format: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_response_format", err.Error())
+			return
+		}
+		if check != nil {
+			rl.debugf("Emulating response_format %s", chatReq.ResponseFormat.Type)
+			checks = append(checks, check)
+			if structuredOutputRetries > retries {
+				retries = structuredOutputRetries
+			}
+		}
 	}
 
-	// Copy headers
-	copyHeaders(proxyReq.Header, r.Header)
+	// Tools the reply may call, kept aside because prompted tools mode removes them from the request
+	tools := deepseekReq.Tools
 
-	// Set DeepSeek API key and content type
-	proxyReq.Header.Set("Authorization", "Bearer "+deepseekAPIKey)
-	proxyReq.Header.Set("Content-Type", "application/json")
-	if chatReq.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
+	// DeepSeek has no parallel_tool_calls parameter, so ask for one call and drop any extra ones
+	parallel := chatReq.ParallelToolCalls == nil || *chatReq.ParallelToolCalls
+	if !parallel && len(tools) > 0 {
+		deepseekReq.Messages = addSystemInstruction(deepseekReq.Messages, "Call at most one tool per reply.")
 	}
 
-	// Add Accept-Language header from request
-	if acceptLanguage := r.Header.Get("Accept-Language"); acceptLanguage != "" {
-		proxyReq.Header.Set("Accept-Language", acceptLanguage)
+	// Upstreams without native tool support get the tools in the prompt and
+	// write calls as text, which are parsed back into tool_calls before any other check
+	var toolCallsCheck responseCheck
+	if px.route.PromptedTools && len(tools) > 0 {
+		rl.debugf("Using prompted tools for %d tools", len(tools))
+		applyPromptedTools(&deepseekReq)
+		toolCallsCheck = parsePromptedToolCalls(rl, tools)
+	}
+	toolCallsCheck = chainChecks(toolCallsCheck, normalizeToolCalls(rl, parallel))
+
+	// Requests that can't fit the context window fail here rather than after the upload
+	_, countSpan := startSpan(r.Context(), "count_tokens")
+	promptTokens, err := fitContextWindow(px, &deepseekReq)
+	countSpan.SetAttributes(tracing.Int("gen_ai.request.estimated_input_tokens", promptTokens))
+	countSpan.End()
+	rl.promptEstimate = promptTokens
+	if err != nil {
+		rl.errorf("Request doesn't fit the context window: %v", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", err.Error())
+		return
 	}
 
-	debugLog("Proxy request headers: %v", proxyReq.Header)
+	// Identical requests are answered from the cache when it's enabled
+	var cacheKey string
+	lookup, store := cacheControl(r)
+	if store {
+		cacheKey = responseCacheKey(endpoint, deepseekAPIKey, deepseekReq)
+	}
+	if lookup {
+		if cached, ok := loadCachedResponse(cacheKey); ok {
+			rl.debugf("Serving cached response %s", cached.ID)
+			w.Header().Set("X-Cache", "HIT")
+			replayCachedResponse(w, rl, cached, route.Model, chatReq.Stream, includeUsage)
+			return
+		}
+	}
+	if store {
+		w.Header().Set("X-Cache", "MISS")
+	}
 
-	// Create a custom client with keepalive
-	client := &http.Client{
-		Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLS:   nil,
-		},
-		Timeout: 5 * time.Minute,
+	reask := toolArgsMode == "reask" && len(tools) > 0
+	if reask && toolArgsRetries > retries {
+		retries = toolArgsRetries
+	}
+	if len(checks) > 0 || reask {
+		checks = append([]responseCheck{toolCallsCheck}, checks...)
+		checks = append(checks, toolArgumentsCheck(rl, tools))
+		sent := handleCheckedCompletion(w, px, deepseekReq, retries, chainChecks(checks...), chatReq.Stream, includeUsage)
+		if store {
+			storeCachedResponse(rl, cacheKey, sent)
+		}
+		return
 	}
 
 	// Send the request
-	resp, err := client.Do(proxyReq)
+	resp, err := px.send(deepseekReq)
 	if err != nil {
-		errorLog("Error forwarding request: %v", err)
+		rl.errorf("Error forwarding request: %v", err)
 		http.Error(w, "Error forwarding request", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
-	debugLog("DeepSeek response status: %d", resp.StatusCode)
-	debugLog("DeepSeek response headers: %v", resp.Header)
+	rl.debugf("DeepSeek response status: %d", resp.StatusCode)
+	rl.debugf("DeepSeek response headers: %v", resp.Header)
 
 	// Handle error responses
 	if resp.StatusCode >= 400 {
-		respBody, err := io.ReadAll(resp.Body)
+		respBody, err := readResponse(resp)
 		if err != nil {
-			errorLog("Error reading error response: %v", err)
+			rl.errorf("Error reading error response: %v", err)
 			http.Error(w, "Error reading response", http.StatusInternalServerError)
 			return
 		}
-		debugLog("DeepSeek error response: %s", string(respBody))
-
-		// Forward the error response
-		for k, v := range resp.Header {
-			w.Header()[k] = v
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
+		rl.upstreamErr = &upstreamError{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}
+		forwardUpstreamError(w, rl, rl.upstreamErr)
 		return
 	}
 
 	// Handle streaming response
 	if chatReq.Stream {
-		handleStreamingResponse(w, resp)
+		var filters []streamFilter
+		if px.route.PromptedTools && len(tools) > 0 {
+			filters = append(filters, newPromptedToolFilter(tools))
+		}
+		if len(tools) > 0 {
+			filters = append(filters, newToolCallIDFilter(parallel))
+		}
+		if check := toolArgumentsCheck(rl, tools); check != nil {
+			filters = append(filters, newToolCallBuffer(check))
+		}
+		var assembler *streamAssembler
+		if store {
+			assembler = newStreamAssembler()
+			filters = append(filters, assembler)
+		}
+		upstreamSpan, _ := upstreamSpans(resp)
+		filters = append(filters, newUsageFilter(rl, upstreamSpan, includeUsage))
+		_, streamSpan := startSpan(r.Context(), "stream_response")
+		handleStreamingResponse(w, resp, filters...)
+		streamSpan.End()
+		if store {
+			storeCachedResponse(rl, cacheKey, assembler.response())
+		}
 		return
 	}
 
 	// Handle regular response
-	handleRegularResponse(w, resp)
+	_, translateSpan := startSpan(r.Context(), "translate_response")
+	sent := handleRegularResponse(w, resp, route.Model, chainChecks(toolCallsCheck, toolArgumentsCheck(rl, tools)))
+	translateSpan.End()
+	if store {
+		storeCachedResponse(rl, cacheKey, sent)
+	}
 }
 
-func handleStreamingResponse(w http.ResponseWriter, resp *http.Response) {
-	debugLog("Starting streaming response handling")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
+// errStreamDone is returned for writes after the stream handler returned
+var errStreamDone = errors.New("stream handler returned")
+
+func handleStreamingResponse(w http.ResponseWriter, resp *http.Response, filters ...streamFilter) {
+	rl := requestLogFrom(resp.Request.Context())
+	rl.debugf("Starting streaming response handling")
+	rl.debugf("Response status: %d", resp.StatusCode)
+	rl.debugf("Response headers: %+v", resp.Header)
+
+	body, err := decodeBody(resp)
+	if err != nil {
+		errorLog("Error decoding stream: %v", err)
+		http.Error(w, "Error reading response from upstream", http.StatusBadGateway)
+		return
+	}
 
 	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	setStreamHeaders(w)
 	w.WriteHeader(resp.StatusCode)
 
 	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
+	reader := bufio.NewReader(body)
+
+	// Heartbeats and stream data are written from different goroutines. Once the
+	// handler returns w belongs to the server again, and its compressor may already
+	// serve another response, so a heartbeat that fires late must not write.
+	var mu sync.Mutex
+	done := false
+	defer func() {
+		mu.Lock()
+		done = true
+		mu.Unlock()
+	}()
+	write := func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return errStreamDone
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		// Flush the response writer
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		} else {
+			rl.debugf("Warning: ResponseWriter does not support Flush")
+		}
+		return nil
+	}
+	writeChunks := func(chunks []*ChatChunk) error {
+		for _, chunk := range chunks {
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				return err
+			}
+			if err := write([]byte("data: " + string(data) + "\n\n")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-	// Create a context to track the client connection
-	ctx, cancel := context.WithCancel(context.Background())
+	// Create a context to track the client connection, the upstream request
+	// shares it so reads stop as soon as the client goes away
+	ctx, cancel := context.WithCancel(resp.Request.Context())
 	defer cancel()
 
-	// Create a channel to detect client disconnection
-	clientClosed := w.(http.CloseNotifier).CloseNotify()
-
 	// Start a goroutine to send heartbeats
 	go func() {
 		ticker := time.NewTicker(15 * time.Second)
@@ -513,174 +891,177 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response) {
 			select {
 			case <-ticker.C:
 				// Send a heartbeat comment
-				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
-					debugLog("Error sending heartbeat: %v", err)
+				if err := write([]byte(": heartbeat\n\n")); err != nil {
+					rl.debugf("Error sending heartbeat: %v", err)
 					cancel()
 					return
 				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 
+	sawData := false
 	for {
-		select {
-		case <-ctx.Done():
-			debugLog("Context cancelled, ending stream")
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, errResponseTooLarge) {
+			errorLog("Stream cut off: %v", err)
 			return
-		case <-clientClosed:
-			debugLog("Client closed connection")
-			cancel()
+		}
+		if err != nil && err != io.EOF {
+			rl.debugf("Error reading stream: %v", err)
 			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				debugLog("Error reading stream: %v", err)
-				cancel()
-				return
-			}
+		}
+		eof := err == io.EOF
+
+		line = bytes.TrimSpace(line)
+		isData := bytes.HasPrefix(line, []byte("data:"))
+		payload := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+		if isData && !sawData {
+			_, firstToken := upstreamSpans(resp)
+			firstToken.End()
+			sawData = true
+		}
 
+		switch {
+		case len(line) == 0:
 			// Skip empty lines
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
+		case isData && bytes.Equal(payload, []byte("[DONE]")):
+			if err := writeChunks(flushFilters(filters)); err != nil {
+				rl.debugf("Error writing to response: %v", err)
+				return
 			}
-
+			if err := write([]byte("data: [DONE]\n\n")); err != nil {
+				rl.debugf("Error writing to response: %v", err)
+				return
+			}
+			filters = nil
+		case isData && len(filters) > 0:
+			var chunk ChatChunk
+			if err := json.Unmarshal(payload, &chunk); err != nil {
+				rl.debugf("Error parsing stream chunk: %v", err)
+				break
+			}
+			if err := writeChunks(applyFilters(filters, &chunk)); err != nil {
+				rl.debugf("Error writing to response: %v", err)
+				return
+			}
+		default:
 			// Write the line to the response
-			if _, err := w.Write(line); err != nil {
-				debugLog("Error writing to response: %v", err)
-				cancel()
+			if err := write(append(line, '\n', '\n')); err != nil {
+				rl.debugf("Error writing to response: %v", err)
 				return
 			}
+		}
 
-			// Flush the response writer
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				debugLog("Warning: ResponseWriter does not support Flush")
+		if eof {
+			// Send whatever the filters still hold if the stream ended without [DONE]
+			if err := writeChunks(flushFilters(filters)); err != nil {
+				rl.debugf("Error writing to response: %v", err)
 			}
+			rl.debugf("Upstream stream ended")
+			return
 		}
 	}
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response) {
-	debugLog("Handling regular (non-streaming) response")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
+// handleRegularResponse translates and sends a non-streaming response, returning what was sent
+func handleRegularResponse(w http.ResponseWriter, resp *http.Response, model string, check responseCheck) *ChatResponse {
+	rl := requestLogFrom(resp.Request.Context())
+	rl.debugf("Handling regular (non-streaming) response")
+	rl.debugf("Response status: %d", resp.StatusCode)
+	rl.debugf("Response headers: %+v", resp.Header)
 
 	// Read and log response body
 	body, err := readResponse(resp)
 	if err != nil {
-		debugLog("Error reading response: %v", err)
+		errorLog("Error reading response: %v", err)
+		if errors.Is(err, errResponseTooLarge) {
+			writeOpenAIError(w, http.StatusBadGateway, "upstream_error", "response_too_large", fmt.Sprintf("The upstream response is larger than %d bytes", maxResponseBytes))
+			return nil
+		}
 		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
-		return
+		return nil
 	}
 
-	debugLog("Original response body: %s", string(body))
+	rl.logBody("Original response body", body)
 
 	// Parse the DeepSeek response
-	var deepseekResp struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}
-
+	var deepseekResp ChatResponse
 	if err := json.Unmarshal(body, &deepseekResp); err != nil {
-		debugLog("Error parsing DeepSeek response: %v", err)
+		rl.debugf("Error parsing DeepSeek response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil
 	}
+	span, _ := upstreamSpans(resp)
+	traceResponse(span, &deepseekResp)
+	rl.addUsage(rl.upstreamModel, deepseekResp.Usage)
 
-	// Convert to OpenAI format
-	openAIResp := struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}{
-		ID:      deepseekResp.ID,
-		Object:  "chat.completion",
-		Created: deepseekResp.Created,
-		Model:   model, // Use the original model name
-		Usage:   deepseekResp.Usage,
-	}
-
-	// Convert choices and ensure tool calls are properly handled
-	openAIResp.Choices = make([]struct {
-		Index        int     `json:"index"`
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	}, len(deepseekResp.Choices))
-
-	for i, choice := range deepseekResp.Choices {
-		openAIResp.Choices[i] = struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		}{
-			Index:        choice.Index,
-			Message:      choice.Message,
-			FinishReason: choice.FinishReason,
-		}
-
-		// Ensure tool calls are properly formatted in the message
-		if len(choice.Message.ToolCalls) > 0 {
-			debugLog("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
-			for j, tc := range choice.Message.ToolCalls {
-				debugLog("Tool call %d: %+v", j, tc)
-				// Ensure the tool call has the required fields
-				if tc.Function.Name == "" {
-					debugLog("Warning: Empty function name in tool call %d", j)
-					continue
-				}
-				// Keep the tool call as is since it's already in the correct format
-				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
+	if check != nil {
+		if err := check(&deepseekResp); err != nil {
+			errorLog("Upstream response rejected: %v", err)
+		}
+	}
+
+	writeChatResponse(w, rl, &deepseekResp, model, false, false)
+	return &deepseekResp
+}
+
+// translateResponse converts a DeepSeek completion to OpenAI format in place, under
+// the model name the client requested
+func translateResponse(rl *requestLog, resp *ChatResponse, model string) {
+	resp.Object = "chat.completion"
+	resp.Model = model // Use the original model name
+
+	// Ensure tool calls are properly handled
+	for i := range resp.Choices {
+		choice := &resp.Choices[i]
+		if len(choice.Message.ToolCalls) == 0 {
+			continue
+		}
+		rl.debugf("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
+		toolCalls := choice.Message.ToolCalls[:0]
+		for j, tc := range choice.Message.ToolCalls {
+			rl.debugf("Tool call %d: %s %s", j, tc.ID, tc.Function.Name)
+			// Ensure the tool call has the required fields
+			if tc.Function.Name == "" {
+				rl.debugf("Warning: Empty function name in tool call %d", j)
+				continue
 			}
+			// Keep the tool call as is since it's already in the correct format
+			toolCalls = append(toolCalls, tc)
 		}
+		choice.Message.ToolCalls = toolCalls
+	}
+}
+
+// writeChatResponse translates resp and sends it as JSON, or as an SSE stream when stream is set
+func writeChatResponse(w http.ResponseWriter, rl *requestLog, resp *ChatResponse, model string, stream, includeUsage bool) {
+	if !stream {
+		setCostHeader(w, resp)
+	}
+	translateResponse(rl, resp, model)
+	if stream {
+		streamChatResponse(w, rl, resp, includeUsage)
+		return
 	}
 
 	// Convert back to JSON
-	modifiedBody, err := json.Marshal(openAIResp)
+	modifiedBody, err := json.Marshal(resp)
 	if err != nil {
-		debugLog("Error creating modified response: %v", err)
+		rl.debugf("Error creating modified response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	debugLog("Modified response body: %s", string(modifiedBody))
+	rl.logBody("Modified response body", modifiedBody)
 
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
+	w.WriteHeader(http.StatusOK)
 	w.Write(modifiedBody)
-	debugLog("Modified response sent successfully")
+	rl.debugf("Modified response sent successfully")
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -701,47 +1082,78 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
-	debugLog("Handling models request")
-	response := ModelsResponse{
-		Object: "list",
-		Data: []Model{
-			{
-				ID:      "gpt-4o",
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "openai",
-			},
-			{
-				ID:      "deepseek-chat",
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
+// writeOpenAIError sends an error in the OpenAI error format so clients can show the message
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errType,
+			"code":    code,
 		},
+	})
+}
+
+func handleModelsRequest(w http.ResponseWriter, rl *requestLog, cfg *Config) {
+	rl.debugf("Handling models request")
+	response := ModelsResponse{Object: "list"}
+	seen := make(map[string]bool)
+	for _, route := range cfg.Routes {
+		response.Data = append(response.Data, Model{
+			ID:      route.Model,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: "openai",
+		})
+	}
+	for _, route := range cfg.Routes {
+		if seen[route.UpstreamModel] {
+			continue
+		}
+		seen[route.UpstreamModel] = true
+		response.Data = append(response.Data, Model{
+			ID:      route.UpstreamModel,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: "deepseek",
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	debugLog("Models response sent successfully")
+	rl.debugf("Models response sent successfully")
 }
 
 func readResponse(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
+	reader, err := decodeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
 
+// decodeBody returns a reader that undoes the response's Content-Encoding. It fails
+// with errResponseTooLarge past MAX_RESPONSE_BYTES, counted after decompression.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	var reader io.Reader = resp.Body
 	switch resp.Header.Get("Content-Encoding") {
 	case "gzip":
 		gzReader, err := gzip.NewReader(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("error creating gzip reader: %v", err)
 		}
-		defer gzReader.Close()
 		reader = gzReader
 	case "br":
 		reader = brotli.NewReader(resp.Body)
 	case "deflate":
 		reader = flate.NewReader(resp.Body)
+	case "zstd":
+		zr, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd reader: %v", err)
+		}
+		reader = zr.IOReadCloser()
 	}
-
-	return io.ReadAll(reader)
+	return &limitedReader{r: reader, max: maxResponseBytes}, nil
 }
@@ -1,10 +1,13 @@
 package masker
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 )
 
+const mask = "*********"
+
 // Compile regex patterns once at package initialization
 var credentialPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)(?:password|api[_-]?key|token|secret)\s*[:=]\s*([^\s]+)`),
@@ -34,12 +37,78 @@ Here is a sample text with credentials:
   - Key-value pair: DEEPSEEK_API_KEY=sk-8a65d84eb9e6
 */
 func Mask(text string) string {
+	masked, _ := maskCredentials(text)
+	return masked
+}
+
+// MaskCount masks credentials like Mask and also reports how many were masked
+func MaskCount(text string) (string, int) {
 	return maskCredentials(text)
 }
 
+// Masker masks the built-in credential patterns and extra ones
+type Masker struct {
+	extra []*regexp.Regexp
+}
+
+// New returns a Masker with extra regular expressions. Extra patterns are masked
+// wherever they match: the first group when the pattern has one, otherwise the
+// whole match.
+func New(extra []string) (*Masker, error) {
+	m := &Masker{}
+	for _, pattern := range extra {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("pattern %q matches empty text", pattern)
+		}
+		m.extra = append(m.extra, re)
+	}
+	return m, nil
+}
+
+// Mask masks credentials and the extra patterns in text
+func (m *Masker) Mask(text string) string {
+	masked, _ := m.MaskCount(text)
+	return masked
+}
+
+// MaskCount masks credentials in text and reports how many were masked
+func (m *Masker) MaskCount(text string) (string, int) {
+	text, count := maskCredentials(text)
+	for _, re := range m.extra {
+		var n int
+		text, n = maskMatches(re, text)
+		count += n
+	}
+	return text, count
+}
+
+func maskMatches(re *regexp.Regexp, text string) (string, int) {
+	matches := re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, 0
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(mask)
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String(), len(matches)
+}
+
 // TODO: Optimize and add more patterns
-func maskCredentials(text string) string {
-	mask := "*********"
+func maskCredentials(text string) (string, int) {
+	count := 0
 	// Mask detected credentials using precompiled patterns
 	for _, re := range credentialPatterns {
 		text = re.ReplaceAllStringFunc(text, func(match string) string {
@@ -56,17 +125,20 @@ func maskCredentials(text string) string {
 			if strings.Contains(match, ":") || strings.Contains(match, "=") {
 				parts := strings.SplitN(match, ":", 2)
 				if len(parts) == 2 {
+					count++
 					return parts[0] + ": " + mask
 				}
 				parts = strings.SplitN(match, "=", 2)
 				if len(parts) == 2 {
+					count++
 					return parts[0] + "= " + mask
 				}
 			}
 
+			count++
 			return mask
 		})
 	}
 
-	return text
+	return text, count
 }
@@ -0,0 +1,32 @@
+package masker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	masked, n := MaskCount("api_key: 1234567890abcdef1234567890abcdef and https://example.com?token=notamask")
+	if n != 1 || strings.Contains(masked, "1234567890abcdef") || !strings.Contains(masked, "token=notamask") {
+		t.Errorf("got %q, %d", masked, n)
+	}
+}
+
+func TestMaskerPatterns(t *testing.T) {
+	m, err := New([]string{`ticket-(\d+)`, `ACCT\d{4}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first group is masked when there is one, otherwise the whole match
+	masked, n := m.MaskCount("ticket-4711 for ACCT1234, ticket-1")
+	if want := "ticket-********* for *********, ticket-*********"; masked != want || n != 3 {
+		t.Errorf("got %q, %d, want %q", masked, n, want)
+	}
+
+	if _, err := New([]string{`(`}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	if _, err := New([]string{`\d*`}); err == nil {
+		t.Error("expected a pattern matching empty text to be rejected")
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Package mockupstream is a scriptable OpenAI/DeepSeek compatible server for testing
+the proxy without a live API key.
+
+Replies are queued with Enqueue and served in order; when the queue is empty the
+Default reply is used. Every request received is kept for inspection.
+*/
+package mockupstream
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Reply scripts one response of the server
+type Reply struct {
+	Status       int    // HTTP status, 200 when zero
+	Error        string // Error message sent in the OpenAI error format when Status >= 400
+	Body         string // Raw body sent instead of a generated completion
+	Content      string
+	ToolCalls    []ToolCall
+	FinishReason string // "stop", or "tool_calls" when there are tool calls, when empty
+	Usage        *Usage
+	Headers      map[string]string
+	Encoding     string // Compress the body with "gzip", "br", "deflate" or "zstd"
+
+	// Streaming replies send the content and tool call arguments in pieces
+	// of ChunkSize bytes (whole when zero), ChunkDelay apart
+	ChunkSize  int
+	ChunkDelay time.Duration
+}
+
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+type Usage struct {
+	PromptTokens         int `json:"prompt_tokens"`
+	CompletionTokens     int `json:"completion_tokens"`
+	TotalTokens          int `json:"total_tokens"`
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens,omitempty"`
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// JSON decodes the request body into a generic map
+func (r Request) JSON() map[string]interface{} {
+	var v map[string]interface{}
+	json.Unmarshal(r.Body, &v)
+	return v
+}
+
+// Server is a mock upstream served over TLS with HTTP/2, like the real API
+type Server struct {
+	*httptest.Server
+
+	// Default is sent when no reply is queued
+	Default Reply
+
+	// DiscardRequests stops keeping received requests, for benchmarks
+	DiscardRequests bool
+
+	mu       sync.Mutex
+	queue    []Reply
+	requests []Request
+}
+
+// New starts a Server. Close it when done.
+func New() *Server {
+	s := &Server{Default: Reply{Content: "Hello from the mock upstream"}}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	s.Server.EnableHTTP2 = true
+	s.Server.StartTLS()
+	return s
+}
+
+// Enqueue adds replies to send to the next requests
+func (s *Server) Enqueue(replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, replies...)
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) next(r *http.Request, body []byte) Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.DiscardRequests {
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	}
+	if len(s.queue) == 0 {
+		return s.Default
+	}
+	reply := s.queue[0]
+	s.queue = s.queue[1:]
+	return reply
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	reply := s.next(r, body)
+
+	if r.URL.Path == "/v1/models" {
+		writeJSON(w, reply, map[string]interface{}{
+			"object": "list",
+			"data":   []map[string]interface{}{{"id": "deepseek-chat", "object": "model", "owned_by": "deepseek"}},
+		})
+		return
+	}
+
+	var req struct {
+		Model         string `json:"model"`
+		Stream        bool   `json:"stream"`
+		StreamOptions *struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+		Messages []message `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		reply = Reply{Status: http.StatusBadRequest, Error: "invalid JSON: " + err.Error()}
+	} else if problem := checkToolPairs(req.Messages); problem != "" {
+		reply = Reply{Status: http.StatusBadRequest, Error: problem}
+	}
+
+	switch {
+	case reply.Status >= 400:
+		writeJSON(w, reply, map[string]interface{}{
+			"error": map[string]interface{}{"message": reply.Error, "type": "invalid_request_error"},
+		})
+	case reply.Body != "":
+		writeBody(w, reply, "application/json", []byte(reply.Body))
+	case req.Stream:
+		s.stream(w, reply, req.Model, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+	default:
+		writeJSON(w, reply, completion(reply, req.Model))
+	}
+}
+
+type message struct {
+	Role       string `json:"role"`
+	ToolCallID string `json:"tool_call_id"`
+	ToolCalls  []struct {
+		ID string `json:"id"`
+	} `json:"tool_calls"`
+}
+
+// checkToolPairs rejects histories the real API rejects: every tool call must be
+// answered by the tool messages right after it, and every tool message must answer one
+func checkToolPairs(messages []message) string {
+	pending := make(map[string]bool)
+	for _, m := range messages {
+		if m.Role == "tool" {
+			if !pending[m.ToolCallID] {
+				return "Messages with role 'tool' must be a response to a preceding message with 'tool_calls'"
+			}
+			delete(pending, m.ToolCallID)
+			continue
+		}
+		if len(pending) > 0 {
+			break
+		}
+		for _, tc := range m.ToolCalls {
+			pending[tc.ID] = true
+		}
+	}
+	if len(pending) > 0 {
+		return "An assistant message with 'tool_calls' must be followed by tool messages responding to each 'tool_call_id'"
+	}
+	return ""
+}
+
+func finishReason(reply Reply) string {
+	if reply.FinishReason != "" {
+		return reply.FinishReason
+	}
+	if len(reply.ToolCalls) > 0 {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+func completion(reply Reply, model string) map[string]interface{} {
+	message := map[string]interface{}{"role": "assistant", "content": reply.Content}
+	if len(reply.ToolCalls) > 0 {
+		var toolCalls []map[string]interface{}
+		for _, tc := range reply.ToolCalls {
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":       tc.ID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": tc.Name, "arguments": tc.Arguments},
+			})
+		}
+		message["tool_calls"] = toolCalls
+	}
+	resp := map[string]interface{}{
+		"id":      "chatcmpl-mock",
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]interface{}{{"index": 0, "message": message, "finish_reason": finishReason(reply)}},
+	}
+	if reply.Usage != nil {
+		resp["usage"] = reply.Usage
+	}
+	return resp
+}
+
+func (s *Server) stream(w http.ResponseWriter, reply Reply, model string, includeUsage bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	out, finish := encoder(w, reply)
+	w.WriteHeader(http.StatusOK)
+
+	send := func(delta map[string]interface{}, finishReason interface{}) {
+		chunk := map[string]interface{}{
+			"id":      "chatcmpl-mock",
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]interface{}{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(out, "data: %s\n\n", data)
+		flush(out, w)
+		if reply.ChunkDelay > 0 {
+			time.Sleep(reply.ChunkDelay)
+		}
+	}
+
+	send(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+	for _, piece := range pieces(reply.Content, reply.ChunkSize) {
+		send(map[string]interface{}{"content": piece}, nil)
+	}
+	for i, tc := range reply.ToolCalls {
+		for j, piece := range pieces(tc.Arguments, reply.ChunkSize) {
+			call := map[string]interface{}{"index": i, "function": map[string]interface{}{"arguments": piece}}
+			if j == 0 {
+				call["id"] = tc.ID
+				call["type"] = "function"
+				call["function"].(map[string]interface{})["name"] = tc.Name
+			}
+			send(map[string]interface{}{"tool_calls": []interface{}{call}}, nil)
+		}
+	}
+	send(map[string]interface{}{}, finishReason(reply))
+
+	if includeUsage && reply.Usage != nil {
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":      "chatcmpl-mock",
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []interface{}{},
+			"usage":   reply.Usage,
+		})
+		fmt.Fprintf(out, "data: %s\n\n", data)
+	}
+	fmt.Fprint(out, "data: [DONE]\n\n")
+	finish()
+	flush(out, w)
+}
+
+func pieces(s string, size int) []string {
+	if s == "" {
+		return nil
+	}
+	if size <= 0 {
+		return []string{s}
+	}
+	var out []string
+	for len(s) > size {
+		out = append(out, s[:size])
+		s = s[size:]
+	}
+	return append(out, s)
+}
+
+func writeJSON(w http.ResponseWriter, reply Reply, v interface{}) {
+	data, _ := json.Marshal(v)
+	writeBody(w, reply, "application/json", data)
+}
+
+func writeBody(w http.ResponseWriter, reply Reply, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	out, finish := encoder(w, reply)
+	status := reply.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	out.Write(data)
+	finish()
+}
+
+// encoder sets the reply's headers and returns the writer to send the body through
+// and a function that completes the encoding
+func encoder(w http.ResponseWriter, reply Reply) (io.Writer, func()) {
+	for k, v := range reply.Headers {
+		w.Header().Set(k, v)
+	}
+	switch strings.ToLower(reply.Encoding) {
+	case "gzip":
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		return gz, func() { gz.Close() }
+	case "br":
+		w.Header().Set("Content-Encoding", "br")
+		br := brotli.NewWriter(w)
+		return br, func() { br.Close() }
+	case "deflate":
+		w.Header().Set("Content-Encoding", "deflate")
+		fl, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fl, func() { fl.Close() }
+	case "zstd":
+		w.Header().Set("Content-Encoding", "zstd")
+		zw, _ := zstd.NewWriter(w)
+		return zw, func() { zw.Close() }
+	}
+	return w, func() {}
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// flush pushes buffered compressed data and the response to the client
+func flush(out io.Writer, w http.ResponseWriter) {
+	if f, ok := out.(flusher); ok {
+		f.Flush()
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Ensure the compressors support flushing, which streaming depends on
+var (
+	_ flusher = (*gzip.Writer)(nil)
+	_ flusher = (*brotli.Writer)(nil)
+	_ flusher = (*flate.Writer)(nil)
+	_ flusher = (*zstd.Encoder)(nil)
+)
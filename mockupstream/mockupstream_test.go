@@ -0,0 +1,119 @@
+package mockupstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func post(t *testing.T, s *Server, body string) *http.Response {
+	t.Helper()
+	resp, err := s.Client().Post(s.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestReplies(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(
+		Reply{Content: "first", Usage: &Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}},
+		Reply{ToolCalls: []ToolCall{{ID: "call_1", Name: "read", Arguments: `{"path":"a"}`}}, Encoding: "gzip"},
+		Reply{Status: http.StatusTooManyRequests, Error: "rate limited"},
+	)
+
+	var completion struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *Usage `json:"usage"`
+	}
+	json.NewDecoder(post(t, s, `{"model":"deepseek-chat","messages":[]}`).Body).Decode(&completion)
+	if completion.Model != "deepseek-chat" || completion.Choices[0].Message.Content != "first" || completion.Usage == nil || completion.Usage.TotalTokens != 4 {
+		t.Errorf("got %+v", completion)
+	}
+
+	resp := post(t, s, `{"model":"deepseek-chat","messages":[]}`)
+	if !resp.Uncompressed {
+		t.Error("reply wasn't compressed")
+	}
+	json.NewDecoder(resp.Body).Decode(&completion)
+	choice := completion.Choices[0]
+	if choice.FinishReason != "tool_calls" || len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Arguments != `{"path":"a"}` {
+		t.Errorf("got %+v", choice)
+	}
+
+	if resp := post(t, s, `{"model":"deepseek-chat","messages":[]}`); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	// The queue is empty, so the default reply is sent
+	json.NewDecoder(post(t, s, `{"model":"deepseek-chat","messages":[]}`).Body).Decode(&completion)
+	if completion.Choices[0].Message.Content != s.Default.Content {
+		t.Errorf("got %+v", completion)
+	}
+	if requests := s.Requests(); len(requests) != 4 || requests[0].Path != "/v1/chat/completions" || requests[0].JSON()["model"] != "deepseek-chat" {
+		t.Errorf("got requests %+v", requests)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.Enqueue(Reply{Content: "Hello", ChunkSize: 2, Usage: &Usage{TotalTokens: 5}})
+
+	resp := post(t, s, `{"model":"deepseek-chat","stream":true,"stream_options":{"include_usage":true},"messages":[]}`)
+	var content string
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data := strings.TrimPrefix(scanner.Text(), "data: ")
+		if data == scanner.Text() {
+			continue
+		}
+		events = append(events, data)
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		json.Unmarshal([]byte(data), &chunk)
+		if len(chunk.Choices) > 0 {
+			content += chunk.Choices[0].Delta.Content
+		}
+	}
+	// Role, three pieces, finish reason, usage and [DONE]
+	if content != "Hello" || len(events) != 7 || events[6] != "[DONE]" || !strings.Contains(events[5], `"total_tokens":5`) {
+		t.Errorf("got content %q from %q", content, events)
+	}
+}
+
+func TestToolPairs(t *testing.T) {
+	s := New()
+	defer s.Close()
+	unanswered := `{"model":"deepseek-chat","messages":[{"role":"assistant","tool_calls":[{"id":"call_1"}]},{"role":"user","content":"hi"}]}`
+	if resp := post(t, s, unanswered); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for an unanswered tool call", resp.StatusCode)
+	}
+	answered := `{"model":"deepseek-chat","messages":[{"role":"assistant","tool_calls":[{"id":"call_1"}]},{"role":"tool","tool_call_id":"call_1"}]}`
+	if resp := post(t, s, answered); resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for an answered tool call", resp.StatusCode)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// UpstreamConfig says how the proxy connects to an upstream provider
+type UpstreamConfig struct {
+	// http://, https:// or socks5:// proxy URL. HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY apply when empty, "direct" connects without a proxy.
+	Proxy      string `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	CAFile     string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`     // PEM CA certificates trusted besides the system roots
+	CertFile   string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"` // Client certificate presented to the upstream
+	KeyFile    string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"` // TLS server name (SNI) and the name its certificate must have
+	Host       string `yaml:"host,omitempty" json:"host,omitempty"`               // Host header sent upstream
+}
+
+// Connection settings from the UPSTREAM_* variables, used without a configuration file
+var envUpstream UpstreamConfig
+
+func initOutbound() {
+	envUpstream = UpstreamConfig{
+		Proxy:      os.Getenv("UPSTREAM_PROXY"),
+		CAFile:     os.Getenv("UPSTREAM_CA_FILE"),
+		CertFile:   os.Getenv("UPSTREAM_CERT_FILE"),
+		KeyFile:    os.Getenv("UPSTREAM_KEY_FILE"),
+		ServerName: os.Getenv("UPSTREAM_SERVER_NAME"),
+		Host:       os.Getenv("UPSTREAM_HOST"),
+	}
+}
+
+// newTransport returns a transport with these settings, negotiating HTTP/2 with TLS
+// upstreams. Certificate files are read now, so problems show up in validate.
+func (u UpstreamConfig) newTransport() (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{ServerName: u.ServerName}
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no certificates found in %s", u.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	switch {
+	case u.CertFile != "" && u.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cert_file: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case u.CertFile != "" || u.KeyFile != "":
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch u.Proxy {
+	case "":
+	case "direct":
+		proxy = nil
+	default:
+		proxyURL, err := url.Parse(u.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy: %q is not an http, https or socks5 URL", u.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:               proxy,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if u.Host != "" {
+		rt = hostTransport{host: u.Host, next: rt}
+	}
+	return rt, nil
+}
+
+// redacted returns the settings without the proxy's password, for display
+func (u UpstreamConfig) redacted() UpstreamConfig {
+	if proxyURL, err := url.Parse(u.Proxy); err == nil && proxyURL.User != nil {
+		u.Proxy = proxyURL.Redacted()
+	}
+	return u
+}
+
+// hostTransport overrides the Host header of requests
+type hostTransport struct {
+	host string
+	next http.RoundTripper
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = t.host
+	return t.next.RoundTrip(req)
+}
+
+func (t hostTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
+
+// closeIdleConnections closes the idle connections of rt, when it keeps any
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Transport for requests that don't come with a route's
+var defaultUpstreamTransport, _ = UpstreamConfig{}.newTransport()
+
+type upstreamTransportKey struct{}
+
+// withUpstreamTransport has requests made with ctx sent through rt
+func withUpstreamTransport(ctx context.Context, rt http.RoundTripper) context.Context {
+	if rt == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamTransportKey{}, rt)
+}
+
+// routeTransport sends requests through the transport of the route they are made
+// for. It sits under the recorder so recording sees every upstream call.
+type routeTransport struct{}
+
+func (routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := req.Context().Value(upstreamTransportKey{}).(http.RoundTripper); ok {
+		return rt.RoundTrip(req)
+	}
+	return defaultUpstreamTransport.RoundTrip(req)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamConnection(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+	upstreamClient = &http.Client{Transport: routeTransport{}}
+
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "internal CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCertificate(t, dir, "upstream", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "deepseek.internal"},
+		DNSNames:    []string{"deepseek.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCertificate(t, dir, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	// An upstream with a certificate from the internal CA that wants a client certificate
+	var host, clientName string
+	upstreamCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "upstream.crt"), filepath.Join(dir, "upstream.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, clientName = r.Host, r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","model":"deepseek-chat","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`)
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{upstreamCert}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	// An egress proxy that only allows CONNECT
+	var connects []string
+	egress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		connects = append(connects, r.Host)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		go func() { io.Copy(target, conn); target.Close() }()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	t.Cleanup(egress.Close)
+
+	cfg := *currentConfig()
+	cfg.Routes = []Route{{Model: "gpt-4o", UpstreamModel: "deepseek-chat", Endpoint: upstream.URL, Upstream: &UpstreamConfig{
+		Proxy:      egress.URL,
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "deepseek.internal",
+		Host:       "api.deepseek.internal",
+	}}}
+	useConfig(t, &cfg)
+
+	resp := decodeResponse(t, post(t, proxy, chatBody))
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Hi" {
+		t.Fatalf("got %+v", resp)
+	}
+	if len(connects) != 1 || connects[0] != strings.TrimPrefix(upstream.URL, "https://") {
+		t.Errorf("egress proxy got CONNECT %v", connects)
+	}
+	if host != "api.deepseek.internal" || clientName != "proxy" {
+		t.Errorf("upstream got host %q and client certificate %q", host, clientName)
+	}
+
+	// Without the CA the upstream's certificate isn't trusted
+	cfg.Routes[0].Upstream = &UpstreamConfig{Proxy: "direct", ServerName: "deepseek.internal"}
+	useConfig(t, &cfg)
+	if r := post(t, proxy, chatBody); r.StatusCode != http.StatusBadGateway {
+		t.Errorf("untrusted upstream got status %d", r.StatusCode)
+	}
+
+	cfg.Routes[0].Upstream = &UpstreamConfig{Proxy: "ftp://egress", CertFile: "client.crt"}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "routes[0]: upstream:") {
+		t.Errorf("got %v", err)
+	}
+}
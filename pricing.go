@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cursor-deepseek/usage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModelPrice is what an upstream model costs, in USD per million tokens
+type ModelPrice struct {
+	Input       float64  `json:"input"`
+	CachedInput float64  `json:"cached_input"` // Prompt tokens served from the upstream's context cache
+	Output      float64  `json:"output"`
+	OffPeak     *OffPeak `json:"off_peak,omitempty"`
+}
+
+// OffPeak is a daily window, in UTC, with discounted prices
+type OffPeak struct {
+	Start    string  `json:"start"` // "16:30"
+	End      string  `json:"end"`   // "00:30", may be on the next day
+	Discount float64 `json:"discount"`
+}
+
+// DeepSeek's published prices, PRICES_FILE replaces or adds models
+var priceTable = map[string]ModelPrice{
+	"deepseek-chat": {
+		Input: 0.27, CachedInput: 0.07, Output: 1.10,
+		OffPeak: &OffPeak{Start: "16:30", End: "00:30", Discount: 0.5},
+	},
+	"deepseek-reasoner": {
+		Input: 0.55, CachedInput: 0.14, Output: 2.19,
+		OffPeak: &OffPeak{Start: "16:30", End: "00:30", Discount: 0.75},
+	},
+}
+
+// Send the estimated cost of non-streaming responses in the X-Request-Cost header
+var costHeader = false
+
+// Spend limits in USD per key and budget period, 0 means unlimited
+var defaultBudget float64
+var keyBudgets = map[string]float64{}
+var budgetPeriod = "month"
+
+var usageLedger = usage.New()
+
+func initPricing() {
+	if path := os.Getenv("PRICES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading PRICES_FILE: %v", err)
+		}
+		var prices map[string]ModelPrice
+		if err := json.Unmarshal(data, &prices); err != nil {
+			log.Fatalf("Error parsing PRICES_FILE: %v", err)
+		}
+		for model, price := range prices {
+			if err := price.validate(); err != nil {
+				log.Fatalf("Invalid price for %s in PRICES_FILE: %v", model, err)
+			}
+			priceTable[model] = price
+		}
+	}
+	if os.Getenv("COST_HEADER") == "true" {
+		costHeader = true
+	}
+	if budget := os.Getenv("BUDGET"); budget != "" {
+		amount, err := strconv.ParseFloat(budget, 64)
+		if err != nil || amount < 0 {
+			log.Fatalf("Invalid BUDGET %q", budget)
+		}
+		defaultBudget = amount
+	}
+	// KEY_BUDGETS=<key fingerprint>=<USD>,... as shown in the request logs
+	if budgets := os.Getenv("KEY_BUDGETS"); budgets != "" {
+		for _, entry := range strings.Split(budgets, ",") {
+			key, amount, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			value, err := strconv.ParseFloat(amount, 64)
+			if !ok || err != nil || value < 0 {
+				log.Fatalf("Invalid KEY_BUDGETS entry %q, use <key>=<amount>", entry)
+			}
+			keyBudgets[key] = value
+		}
+	}
+	switch period := os.Getenv("BUDGET_PERIOD"); period {
+	case "day", "month", "total":
+		budgetPeriod = period
+	case "":
+	default:
+		log.Fatalf("Invalid BUDGET_PERIOD %q, use day, month or total", period)
+	}
+	if path := os.Getenv("USAGE_LEDGER"); path != "" {
+		ledger, err := usage.Open(path)
+		var malformed *usage.MalformedError
+		switch {
+		case errors.As(err, &malformed):
+			// Budgets go on with the records that could be read
+			errorLog("Error reading USAGE_LEDGER %s: %v", path, err)
+		case err != nil:
+			log.Fatalf("Error opening USAGE_LEDGER: %v", err)
+		}
+		usageLedger = ledger
+	}
+}
+
+func (p ModelPrice) validate() error {
+	if p.Input < 0 || p.CachedInput < 0 || p.Output < 0 {
+		return fmt.Errorf("prices can't be negative")
+	}
+	if p.OffPeak != nil {
+		if _, err := minuteOfDay(p.OffPeak.Start); err != nil {
+			return fmt.Errorf("off_peak start: %v", err)
+		}
+		if _, err := minuteOfDay(p.OffPeak.End); err != nil {
+			return fmt.Errorf("off_peak end: %v", err)
+		}
+		if p.OffPeak.Discount < 0 || p.OffPeak.Discount > 1 {
+			return fmt.Errorf("off_peak discount must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// discount returns the off-peak discount that applies at t
+func (o *OffPeak) discount(t time.Time) float64 {
+	if o == nil {
+		return 0
+	}
+	start, _ := minuteOfDay(o.Start)
+	end, _ := minuteOfDay(o.End)
+	t = t.UTC()
+	now := t.Hour()*60 + t.Minute()
+	in := now >= start && now < end
+	if end <= start {
+		in = now >= start || now < end
+	}
+	if in {
+		return o.Discount
+	}
+	return 0
+}
+
+// requestCost estimates what usage of model costs at time t, ok is false for unknown models
+func requestCost(model string, u Usage, t time.Time) (cost float64, ok bool) {
+	price, ok := priceTable[model]
+	if !ok {
+		return 0, false
+	}
+	cached := u.cachedTokens()
+	cost = (float64(u.PromptTokens-cached)*price.Input +
+		float64(cached)*price.CachedInput +
+		float64(u.CompletionTokens)*price.Output) / 1e6
+	return cost * (1 - price.OffPeak.discount(t)), true
+}
+
+// budgetStart returns when the current budget period began
+func budgetStart(now time.Time) time.Time {
+	now = now.UTC()
+	switch budgetPeriod {
+	case "day":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Time{}
+}
+
+// checkBudget fails once a key has spent its budget for the current period
+func checkBudget(cfg *Config, key string) error {
+	budget, ok := keyBudgets[key]
+	if !ok {
+		budget = defaultBudget
+	}
+	for _, k := range cfg.Keys {
+		if k.Budget > 0 && keyLabel(k) == key {
+			budget = k.Budget
+		}
+	}
+	if budget <= 0 {
+		return nil
+	}
+	spent := usageLedger.Total(key, budgetStart(time.Now())).Cost
+	if spent >= budget {
+		return fmt.Errorf("spend budget of $%.2f per %s exceeded ($%.2f spent)", budget, budgetPeriod, spent)
+	}
+	return nil
+}
+
+// setCostHeader sends the estimated cost of resp when COST_HEADER is enabled
+func setCostHeader(w http.ResponseWriter, resp *ChatResponse) {
+	if !costHeader {
+		return
+	}
+	if cost, ok := requestCost(resp.Model, resp.Usage, time.Now()); ok {
+		w.Header().Set("X-Request-Cost", strconv.FormatFloat(cost, 'f', 6, 64))
+	}
+}
+
+// recordUsage prices the upstream usage of a finished request and adds it to the
+// ledger, with a record for each upstream model it used
+func recordUsage(rl *requestLog) {
+	if rl.key == "" {
+		return
+	}
+	now := time.Now()
+	var total float64
+	priced := false
+	record := func(model string, u Usage) {
+		cost, ok := requestCost(model, u, now)
+		if ok {
+			total += cost
+			priced = true
+		}
+		err := usageLedger.Add(usage.Record{
+			Time:             now,
+			RequestID:        rl.id,
+			Key:              rl.key,
+			Model:            model,
+			PromptTokens:     u.PromptTokens,
+			CachedTokens:     u.cachedTokens(),
+			CompletionTokens: u.CompletionTokens,
+			Cost:             cost,
+		})
+		if err != nil {
+			errorLog("Error writing usage ledger: %v", err)
+		}
+	}
+	if rl.usage != nil {
+		record(rl.upstreamModel, *rl.usage)
+	}
+	models := make([]string, 0, len(rl.otherUsage))
+	for model := range rl.otherUsage {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		record(model, rl.otherUsage[model])
+	}
+	if priced {
+		rl.cost = &total
+	}
+}
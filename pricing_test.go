@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cursor-deepseek/mockupstream"
+	"cursor-deepseek/usage"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCostAndBudget(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedHeader, savedBudget, savedLedger, savedPrices := costHeader, defaultBudget, usageLedger, priceTable
+	t.Cleanup(func() {
+		costHeader, defaultBudget, usageLedger, priceTable = savedHeader, savedBudget, savedLedger, savedPrices
+	})
+	costHeader = true
+	defaultBudget = 0.5
+	usageLedger = usage.New()
+	priceTable = map[string]ModelPrice{"deepseek-chat": {Input: 1, CachedInput: 0.5, Output: 2}}
+
+	// 1M prompt tokens, half of them cached, and 100k completion tokens: $0.5 + $0.25 + $0.2
+	upstream.Enqueue(mockupstream.Reply{Content: "Hi", Usage: &mockupstream.Usage{
+		PromptTokens: 1000000, PromptCacheHitTokens: 500000, CompletionTokens: 100000, TotalTokens: 1100000}})
+	resp := post(t, proxy, chatBody)
+	decodeResponse(t, resp)
+	if got := resp.Header.Get("X-Request-Cost"); got != "0.950000" {
+		t.Errorf("got cost header %q", got)
+	}
+
+	// The handler records usage after the response is sent
+	proxy.Close()
+	if total := usageLedger.Total(keyFingerprint(testAPIKey), time.Time{}); total.Requests != 1 || total.CachedTokens != 500000 {
+		t.Errorf("got ledger total %+v", total)
+	}
+
+	proxy, _ = newTestProxy(t)
+	resp = post(t, proxy, chatBody)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d after the budget was spent", resp.StatusCode)
+	}
+	if n := len(upstream.Requests()); n != 1 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
+
+func TestOffPeakDiscount(t *testing.T) {
+	offPeak := &OffPeak{Start: "16:30", End: "00:30", Discount: 0.5}
+	for _, tc := range []struct {
+		at   string
+		want float64
+	}{{"16:29", 0}, {"16:30", 0.5}, {"23:59", 0.5}, {"00:29", 0.5}, {"00:30", 0}, {"12:00", 0}} {
+		at, _ := time.Parse("15:04", tc.at)
+		if got := offPeak.discount(at); got != tc.want {
+			t.Errorf("discount at %s = %v, want %v", tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestStreamingUsage(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedLedger := usageLedger
+	usageLedger = usage.New()
+	t.Cleanup(func() { usageLedger = savedLedger })
+	reply := mockupstream.Reply{Content: "Hello!", Usage: &mockupstream.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}}
+	upstream.Enqueue(reply, reply)
+
+	// Usage is requested upstream and accounted, but only sent to clients that ask for it
+	resp := readStream(t, post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+	if resp.Usage.TotalTokens != 0 {
+		t.Errorf("client got usage %+v it didn't ask for", resp.Usage)
+	}
+	resp = readStream(t, post(t, proxy, `{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Hi"}]}`))
+	if resp.Usage.TotalTokens != 5 {
+		t.Errorf("got usage %+v", resp.Usage)
+	}
+
+	for _, req := range upstream.Requests() {
+		if options, _ := req.JSON()["stream_options"].(map[string]interface{}); options["include_usage"] != true {
+			t.Errorf("upstream got stream_options %v", req.JSON()["stream_options"])
+		}
+	}
+	proxy.Close()
+	if total := usageLedger.Total(keyFingerprint(testAPIKey), time.Time{}); total.Requests != 2 || total.CompletionTokens != 4 {
+		t.Errorf("got ledger total %+v", total)
+	}
+}
+
+func TestStreamingUsageCutOff(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedLedger, savedMax := usageLedger, maxResponseBytes
+	usageLedger = usage.New()
+	t.Cleanup(func() { usageLedger, maxResponseBytes = savedLedger, savedMax })
+	maxResponseBytes = 1000
+
+	// The stream breaks off after the usage chunk, before it ends
+	body := `data: {"id":"1","choices":[{"index":0,"delta":{"content":"Hi"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}` + "\n\n" +
+		`data: {"id":"1","choices":[{"index":0,"delta":{"content":"` + strings.Repeat("y", 10000) + `"}}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}` + "\n\n"
+	upstream.Enqueue(mockupstream.Reply{Body: body})
+	resp := post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	proxy.Close()
+	if total := usageLedger.Total(keyFingerprint(testAPIKey), time.Time{}); total.Requests != 1 || total.CompletionTokens != 1 {
+		t.Errorf("got ledger total %+v", total)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"cursor-deepseek/jsonrepair"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tool calls written by the model in prompted tools mode, either as tags or as fenced JSON.
+// An unterminated tag at the end of the text is accepted because replies get truncated.
+var (
+	toolCallTagPattern   = regexp.MustCompile(`(?s)<tool_call>\s*(.*?)\s*(?:</tool_call>|$)`)
+	toolCallFencePattern = regexp.MustCompile("(?s)```(?:json)?\\s*(\\{.*?\\})\\s*```")
+)
+
+const (
+	toolCallOpenTag = "<tool_call>"
+	codeFence       = "```"
+)
+
+// newToolCallID returns an ID in the format OpenAI uses for tool calls
+func newToolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// applyPromptedTools moves the tool definitions and tool history into the prompt
+// for upstreams that reject the tools field
+func applyPromptedTools(req *DeepSeekRequest) {
+	if len(req.Tools) == 0 {
+		return
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString("You can call tools to help answer. To call a tool, reply with one or more blocks in exactly this format:\n\n")
+	prompt.WriteString("<tool_call>\n{\"name\": \"tool_name\", \"arguments\": {\"arg\": \"value\"}}\n</tool_call>\n\n")
+	prompt.WriteString("Write nothing after your last tool call. Tool results are sent back to you in <tool_result> blocks.\n\n")
+	prompt.WriteString("Available tools:\n")
+	for _, tool := range req.Tools {
+		params, _ := json.Marshal(tool.Function.Parameters)
+		fmt.Fprintf(&prompt, "\n## %s\n", tool.Function.Name)
+		if tool.Function.Description != "" {
+			fmt.Fprintf(&prompt, "%s\n", tool.Function.Description)
+		}
+		fmt.Fprintf(&prompt, "Parameters: %s\n", params)
+	}
+	switch req.ToolChoice {
+	case "none":
+		prompt.WriteString("\nDo not call any tools in this reply.")
+	}
+
+	req.Messages = addSystemInstruction(renderToolHistory(req.Messages), strings.TrimSpace(prompt.String()))
+	req.Tools = nil
+	req.ToolChoice = ""
+}
+
+// renderToolHistory rewrites earlier tool calls and results as plain text messages
+func renderToolHistory(messages []Message) []Message {
+	var rendered []Message
+	names := make(map[string]string) // Function names by tool call ID
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			var content strings.Builder
+			content.WriteString(msg.Content)
+			for _, tc := range msg.ToolCalls {
+				names[tc.ID] = tc.Function.Name
+				args := json.RawMessage(tc.Function.Arguments)
+				if !json.Valid(args) {
+					args, _ = json.Marshal(tc.Function.Arguments)
+				}
+				call, _ := json.Marshal(map[string]interface{}{"name": tc.Function.Name, "arguments": args})
+				fmt.Fprintf(&content, "\n%s\n%s\n</tool_call>", toolCallOpenTag, call)
+			}
+			rendered = append(rendered, Message{Role: "assistant", Content: strings.TrimSpace(content.String())})
+
+		case msg.Role == "tool":
+			name := msg.Name
+			if name == "" {
+				name = names[msg.ToolCallID]
+			}
+			result := fmt.Sprintf("<tool_result name=%q id=%q>\n%s\n</tool_result>", name, msg.ToolCallID, msg.Content)
+			// Results of parallel calls go into a single message
+			if n := len(rendered); n > 0 && rendered[n-1].Role == "user" && strings.HasPrefix(rendered[n-1].Content, "<tool_result") {
+				rendered[n-1].Content += "\n" + result
+				continue
+			}
+			rendered = append(rendered, Message{Role: "user", Content: result})
+
+		default:
+			rendered = append(rendered, msg)
+		}
+	}
+	return rendered
+}
+
+// parseToolCallText extracts tool calls written by the model and returns the remaining text.
+// Fenced JSON only counts as a tool call when it names one of the tools.
+func parseToolCallText(text string, tools []Tool) (string, []ToolCall) {
+	var calls []ToolCall
+	remaining := toolCallTagPattern.ReplaceAllStringFunc(text, func(block string) string {
+		body := toolCallTagPattern.FindStringSubmatch(block)[1]
+		if tc, ok := decodeToolCall(body, nil); ok {
+			calls = append(calls, tc)
+			return ""
+		}
+		return block
+	})
+	remaining = toolCallFencePattern.ReplaceAllStringFunc(remaining, func(block string) string {
+		body := toolCallFencePattern.FindStringSubmatch(block)[1]
+		if tc, ok := decodeToolCall(body, tools); ok {
+			calls = append(calls, tc)
+			return ""
+		}
+		return block
+	})
+	return strings.TrimSpace(remaining), calls
+}
+
+// decodeToolCall parses {"name": ..., "arguments": ...}, requiring the name to be in tools unless tools is nil
+func decodeToolCall(body string, tools []Tool) (ToolCall, bool) {
+	repaired, err := jsonrepair.Repair(body)
+	if err != nil {
+		return ToolCall{}, false
+	}
+	var call struct {
+		Name       string          `json:"name"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	if err := json.Unmarshal([]byte(repaired), &call); err != nil || call.Name == "" {
+		return ToolCall{}, false
+	}
+	if tools != nil {
+		known := false
+		for _, tool := range tools {
+			known = known || tool.Function.Name == call.Name
+		}
+		if !known {
+			return ToolCall{}, false
+		}
+	}
+
+	args := call.Arguments
+	if len(args) == 0 {
+		args = call.Parameters
+	}
+	// Arguments may be an object or, as in the OpenAI format, a JSON string
+	var argString string
+	if err := json.Unmarshal(args, &argString); err != nil {
+		argString = string(args)
+	}
+	if argString == "" || argString == "null" {
+		argString = "{}"
+	}
+
+	tc := ToolCall{ID: newToolCallID(), Type: "function"}
+	tc.Function.Name = call.Name
+	tc.Function.Arguments = argString
+	return tc, true
+}
+
+// parsePromptedToolCalls returns a check that turns tool calls in the reply text into tool_calls
+func parsePromptedToolCalls(rl *requestLog, tools []Tool) responseCheck {
+	return func(resp *ChatResponse) error {
+		for i := range resp.Choices {
+			msg := &resp.Choices[i].Message
+			content, calls := parseToolCallText(msg.Content, tools)
+			if len(calls) == 0 {
+				continue
+			}
+			rl.debugf("Parsed %d prompted tool calls in choice %d", len(calls), i)
+			msg.Content = content
+			msg.ToolCalls = append(msg.ToolCalls, calls...)
+			resp.Choices[i].FinishReason = "tool_calls"
+		}
+		return nil
+	}
+}
+
+// promptedToolFilter turns tool calls written in a streamed reply into tool_calls deltas.
+// Text is forwarded as it arrives except for anything that may start a tool call,
+// which is held back until it can be told apart from ordinary text.
+type promptedToolFilter struct {
+	tools    []Tool
+	choices  map[int]*promptedToolState
+	template ChatChunk
+}
+
+type promptedToolState struct {
+	pending string // Text held back because it may be part of a tool call
+	calls   string // Text from the first tool call on, parsed when the choice finishes
+	inCalls bool
+}
+
+func newPromptedToolFilter(tools []Tool) *promptedToolFilter {
+	return &promptedToolFilter{tools: tools, choices: make(map[int]*promptedToolState)}
+}
+
+func (f *promptedToolFilter) Filter(chunk *ChatChunk) []*ChatChunk {
+	f.template = ChatChunk{ID: chunk.ID, Object: chunk.Object, Created: chunk.Created, Model: chunk.Model}
+
+	var out []*ChatChunk
+	for i := range chunk.Choices {
+		choice := &chunk.Choices[i]
+		state := f.choices[choice.Index]
+		if state == nil {
+			state = &promptedToolState{}
+			f.choices[choice.Index] = state
+		}
+
+		state.pending += choice.Delta.Content
+		choice.Delta.Content = f.release(state)
+
+		if choice.FinishReason != nil {
+			held, hasCalls := f.finish(choice.Index, state)
+			if held != nil {
+				out = append(out, held)
+			}
+			if hasCalls {
+				finishReason := "tool_calls"
+				choice.FinishReason = &finishReason
+			}
+		}
+	}
+	return append(out, chunk)
+}
+
+func (f *promptedToolFilter) Flush() []*ChatChunk {
+	indexes := make([]int, 0, len(f.choices))
+	for index := range f.choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var out []*ChatChunk
+	for _, index := range indexes {
+		if held, _ := f.finish(index, f.choices[index]); held != nil {
+			out = append(out, held)
+		}
+	}
+	return out
+}
+
+// release returns the pending text that can't be part of a tool call
+func (f *promptedToolFilter) release(state *promptedToolState) string {
+	var text strings.Builder
+	for {
+		if state.inCalls {
+			state.calls += state.pending
+			state.pending = ""
+			return text.String()
+		}
+
+		tag := strings.Index(state.pending, toolCallOpenTag)
+		fence := strings.Index(state.pending, codeFence)
+		switch {
+		case tag >= 0 && (fence < 0 || tag < fence):
+			text.WriteString(state.pending[:tag])
+			state.pending = state.pending[tag:]
+			state.inCalls = true
+
+		case fence >= 0:
+			text.WriteString(state.pending[:fence])
+			state.pending = state.pending[fence:]
+			end := strings.Index(state.pending[len(codeFence):], codeFence)
+			if end < 0 {
+				// Wait for the closing fence
+				return text.String()
+			}
+			block := state.pending[:len(codeFence)+end+len(codeFence)]
+			if _, calls := parseToolCallText(block, f.tools); len(calls) > 0 {
+				state.inCalls = true
+				continue
+			}
+			text.WriteString(block)
+			state.pending = state.pending[len(block):]
+
+		default:
+			// Hold back a trailing partial "<tool_call>" or "```"
+			keep := partialSuffix(state.pending, toolCallOpenTag)
+			if n := partialSuffix(state.pending, codeFence); n > keep {
+				keep = n
+			}
+			text.WriteString(state.pending[:len(state.pending)-keep])
+			state.pending = state.pending[len(state.pending)-keep:]
+			return text.String()
+		}
+	}
+}
+
+// finish parses the held back text of a choice and returns it as a chunk, reporting whether it has tool calls
+func (f *promptedToolFilter) finish(index int, state *promptedToolState) (*ChatChunk, bool) {
+	delete(f.choices, index)
+	text, calls := parseToolCallText(state.pending+state.calls, f.tools)
+
+	chunk := f.template
+	delta := Delta{Content: text}
+	for j, tc := range calls {
+		delta.ToolCalls = append(delta.ToolCalls, ToolCallDelta{
+			Index: j,
+			ID:    tc.ID,
+			Type:  tc.Type,
+			Function: FunctionCallDelta{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		})
+	}
+	if delta.empty() {
+		return nil, false
+	}
+	chunk.Choices = []ChunkChoice{{Index: index, Delta: delta}}
+	return &chunk, len(calls) > 0
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a proper prefix of marker
+func partialSuffix(s, marker string) int {
+	for n := len(marker) - 1; n > 0; n-- {
+		if strings.HasSuffix(s, marker[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"cursor-deepseek/cache"
+	"cursor-deepseek/mockupstream"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	testSecret = "test-secret"
+	testAPIKey = "sk-upstream"
+)
+
+// newTestProxy starts the proxy in front of a mock upstream and restores the settings afterwards
+func newTestProxy(t testing.TB) (*httptest.Server, *mockupstream.Server) {
+	t.Helper()
+
+	upstream := mockupstream.New()
+	t.Cleanup(upstream.Close)
+
+	saved := struct {
+		config        *Config
+		client        *http.Client
+		responseCache cache.Cache
+		toolArgsMode  string
+	}{currentConfig(), upstreamClient, responseCache, toolArgsMode}
+	t.Cleanup(func() {
+		activeConfig.Store(saved.config)
+		upstreamClient = saved.client
+		responseCache = saved.responseCache
+		toolArgsMode = saved.toolArgsMode
+	})
+
+	useConfig(t, &Config{
+		Secret:   testSecret,
+		Endpoint: upstream.URL,
+		Routes:   []Route{{Model: "gpt-4o", UpstreamModel: "deepseek-chat"}},
+	})
+	upstreamClient = upstream.Client()
+
+	proxy := httptest.NewServer(newHandler())
+	t.Cleanup(proxy.Close)
+	return proxy, upstream
+}
+
+// useConfig validates cfg and serves the following requests with it
+func useConfig(t testing.TB, cfg *Config) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	activeConfig.Store(cfg)
+}
+
+// post sends a chat request to the proxy with a valid API key
+func post(t *testing.T, proxy *httptest.Server, body string, headers ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testSecret+"@"+testAPIKey)
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decodeResponse(t *testing.T, resp *http.Response) ChatResponse {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var chatResp ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
+		t.Fatal(err)
+	}
+	return chatResp
+}
+
+// readStream reassembles a streamed response and checks it ends with [DONE]
+func readStream(t *testing.T, resp *http.Response) *ChatResponse {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	assembler := newStreamAssembler()
+	done := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk ChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		assembler.Filter(&chunk)
+	}
+	if !done {
+		t.Fatal("stream did not end with [DONE]")
+	}
+	assembled := assembler.response()
+	if assembled == nil {
+		t.Fatal("stream has no finished choice")
+	}
+	return assembled
+}
+
+const chatBody = `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`
+
+const toolsJSON = `[{"type":"function","function":{"name":"read_file","description":"Read a file","parameters":{"type":"object","properties":{"path":{"type":"string"}},"required":["path"]}}},{"type":"function","function":{"name":"list_dir","parameters":{"type":"object","properties":{}}}}]`
+
+func TestRegularResponse(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(mockupstream.Reply{Content: "Hello!", Usage: &mockupstream.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}})
+
+	resp := decodeResponse(t, post(t, proxy, chatBody))
+	if resp.Model != "gpt-4o" || resp.Object != "chat.completion" {
+		t.Errorf("got model %q object %q", resp.Model, resp.Object)
+	}
+	if got := resp.Choices[0].Message.Content; got != "Hello!" {
+		t.Errorf("got content %q", got)
+	}
+	if resp.Usage.TotalTokens != 5 {
+		t.Errorf("got usage %+v", resp.Usage)
+	}
+
+	reqs := upstream.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream got %d requests", len(reqs))
+	}
+	if got := reqs[0].Header.Get("Authorization"); got != "Bearer "+testAPIKey {
+		t.Errorf("upstream got Authorization %q", got)
+	}
+	if got := reqs[0].JSON()["model"]; got != "deepseek-chat" {
+		t.Errorf("upstream got model %v", got)
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(mockupstream.Reply{Content: "Streaming works fine", ChunkSize: 4})
+
+	resp := post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	streamed := readStream(t, resp)
+	if got := streamed.Choices[0].Message.Content; got != "Streaming works fine" {
+		t.Errorf("got content %q", got)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+
+	for _, auth := range []string{"", "Bearer", "Bearer " + testAPIKey, "Bearer wrong@" + testAPIKey, "Basic " + testSecret + "@" + testAPIKey} {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", strings.NewReader(chatBody))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d", auth, resp.StatusCode)
+		}
+	}
+	if n := len(upstream.Requests()); n != 0 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(mockupstream.Reply{Status: http.StatusTooManyRequests, Error: "rate limited", Encoding: "gzip"})
+
+	resp := post(t, proxy, chatBody)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "rate limited") {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	for _, encoding := range []string{"gzip", "br", "deflate", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			proxy, upstream := newTestProxy(t)
+			upstream.Enqueue(
+				mockupstream.Reply{Content: "compressed", Encoding: encoding},
+				mockupstream.Reply{Content: "compressed stream", Encoding: encoding, ChunkSize: 3},
+			)
+
+			resp := decodeResponse(t, post(t, proxy, chatBody))
+			if got := resp.Choices[0].Message.Content; got != "compressed" {
+				t.Errorf("got content %q", got)
+			}
+
+			streamed := readStream(t, post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+			if got := streamed.Choices[0].Message.Content; got != "compressed stream" {
+				t.Errorf("got streamed content %q", got)
+			}
+		})
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	saved := compressStreams
+	t.Cleanup(func() { compressStreams = saved })
+	compressStreams = true
+
+	decode := func(t *testing.T, resp *http.Response) *http.Response {
+		t.Helper()
+		var body io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case "gzip":
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		case "br":
+			body = brotli.NewReader(resp.Body)
+		case "zstd":
+			zr, err := zstd.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		resp.Body = io.NopCloser(body)
+		return resp
+	}
+
+	long := strings.Repeat("compressed ", 200)
+	for _, tc := range []struct{ accept, encoding string }{
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"br, zstd", "zstd"},
+		{"*;q=0.1, zstd;q=0", "br"},
+		{"identity", ""},
+	} {
+		t.Run(tc.accept, func(t *testing.T) {
+			upstream.Enqueue(
+				mockupstream.Reply{Content: long},
+				mockupstream.Reply{Content: long, ChunkSize: 100},
+			)
+			resp := post(t, proxy, chatBody, "Accept-Encoding", tc.accept)
+			vary := strings.Join(resp.Header.Values("Vary"), ", ")
+			if got := resp.Header.Get("Content-Encoding"); got != tc.encoding || !strings.Contains(vary, "Accept-Encoding") {
+				t.Errorf("got Content-Encoding %q, Vary %q", got, vary)
+			}
+			if got := decodeResponse(t, decode(t, resp)).Choices[0].Message.Content; got != long {
+				t.Errorf("got content %q", got)
+			}
+
+			resp = post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`, "Accept-Encoding", tc.accept)
+			if got := resp.Header.Get("Content-Encoding"); got != tc.encoding {
+				t.Errorf("got stream Content-Encoding %q", got)
+			}
+			if got := readStream(t, decode(t, resp)).Choices[0].Message.Content; got != long {
+				t.Errorf("got streamed content %q", got)
+			}
+		})
+	}
+
+	// The upstream is asked for what the proxy can decode, not for what the client accepts
+	if got := upstream.Requests()[0].Header.Get("Accept-Encoding"); got != upstreamAcceptEncoding {
+		t.Errorf("upstream got Accept-Encoding %q", got)
+	}
+
+	// Small responses aren't worth it, and streams are sent as they are by default
+	compressStreams = false
+	upstream.Enqueue(mockupstream.Reply{Content: "short"}, mockupstream.Reply{Content: long, ChunkSize: 100})
+	if resp := post(t, proxy, chatBody, "Accept-Encoding", "gzip"); resp.Header.Get("Content-Encoding") != "" {
+		t.Error("small response was compressed")
+	}
+	if resp := post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`, "Accept-Encoding", "gzip"); resp.Header.Get("Content-Encoding") != "" {
+		t.Error("stream was compressed without COMPRESS_STREAMS")
+	}
+}
+
+func TestUnsupportedModel(t *testing.T) {
+	proxy, _ := newTestProxy(t)
+	resp := post(t, proxy, `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"Hi"}]}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	savedRequest, savedResponse := maxRequestBytes, maxResponseBytes
+	t.Cleanup(func() { maxRequestBytes, maxResponseBytes = savedRequest, savedResponse })
+	maxRequestBytes, maxResponseBytes = 1000, 2000
+
+	large := fmt.Sprintf(`{"model":"gpt-4o","messages":[{"role":"user","content":%q}]}`, strings.Repeat("x", 1000))
+	send := func(body io.Reader) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", body)
+		req.Header.Set("Authorization", "Bearer "+testSecret+"@"+testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	// With a Content-Length and chunked, without one
+	for _, body := range []io.Reader{strings.NewReader(large), io.MultiReader(strings.NewReader(large))} {
+		resp := send(body)
+		var e struct {
+			Error struct{ Code string }
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || e.Error.Code != "request_too_large" {
+			t.Errorf("got %d %+v", resp.StatusCode, e)
+		}
+	}
+	if len(upstream.Requests()) != 0 {
+		t.Error("oversized request was sent upstream")
+	}
+
+	upstream.Enqueue(mockupstream.Reply{Content: strings.Repeat("y", 3000)})
+	if resp := post(t, proxy, chatBody); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("oversized response got status %d", resp.StatusCode)
+	}
+	upstream.Enqueue(mockupstream.Reply{Content: strings.Repeat("y", 3000), ChunkSize: 100})
+	data, _ := io.ReadAll(post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`).Body)
+	if strings.Count(string(data), "y") >= 3000 || strings.Contains(string(data), "[DONE]") {
+		t.Errorf("oversized stream wasn't cut off: %s", data)
+	}
+}
+
+// cursorRequest is a chat request like Cursor's agent sends: a long system prompt, tool
+// definitions, and files attached to the user message and read by tool calls
+func cursorRequest(files, lines int, stream bool) []byte {
+	file := func(n int) string {
+		var b strings.Builder
+		fmt.Fprintf(&b, "package file%d\n\nimport \"fmt\"\n\n", n)
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(&b, "func handler%d(w io.Writer, n int) error { _, err := fmt.Fprintf(w, \"%%d\", n+%d); return err }\n", i, i)
+		}
+		return b.String()
+	}
+	var tools []Tool
+	for _, name := range []string{"read_file", "edit_file", "list_dir", "grep_search", "run_terminal_cmd", "file_search", "delete_file"} {
+		tools = append(tools, Tool{Type: "function", Function: Function{
+			Name:        name,
+			Description: strings.Repeat("Use this tool to work with the codebase. ", 10),
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"target_file":  map[string]interface{}{"type": "string", "description": "The path of the file"},
+					"explanation":  map[string]interface{}{"type": "string", "description": "Why the tool is used"},
+					"instructions": map[string]interface{}{"type": "string"},
+				},
+				"required": []string{"target_file"},
+			},
+		}})
+	}
+	var attached strings.Builder
+	attached.WriteString("Fix the failing test.\n\n")
+	for i := 0; i < files/2; i++ {
+		fmt.Fprintf(&attached, "<attached_file path=\"file%d.go\">\n%s</attached_file>\n", i, file(i))
+	}
+	messages := []Message{
+		{Role: "system", Content: strings.Repeat("You are a powerful agentic AI coding assistant. Follow the user's instructions. ", 50)},
+		{Role: "user", Content: attached.String()},
+	}
+	for i := files / 2; i < files; i++ {
+		id := fmt.Sprintf("call_%d", i)
+		call := ToolCall{ID: id, Type: "function"}
+		call.Function.Name = "read_file"
+		call.Function.Arguments = fmt.Sprintf(`{"target_file":"file%d.go"}`, i)
+		messages = append(messages,
+			Message{Role: "assistant", ToolCalls: []ToolCall{call}},
+			Message{Role: "tool", ToolCallID: id, Content: file(i)})
+	}
+	body, _ := json.Marshal(ChatRequest{Model: "gpt-4o", Messages: messages, Tools: tools, Stream: stream})
+	return body
+}
+
+func benchmarkCursorRequest(b *testing.B, stream bool) {
+	proxy, upstream := newTestProxy(b)
+	upstream.DiscardRequests = true
+	body := cursorRequest(16, 120, stream)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1/chat/completions", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testSecret+"@"+testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("got status %d", resp.StatusCode)
+		}
+	}
+}
+
+// Benchmarks proxy large Cursor requests, with 16 whole files, to the mock upstream
+func BenchmarkCursorRequest(b *testing.B)          { benchmarkCursorRequest(b, false) }
+func BenchmarkCursorRequestStreaming(b *testing.B) { benchmarkCursorRequest(b, true) }
@@ -0,0 +1,295 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Entry is one recorded request and response, stored as a line of JSON
+type Entry struct {
+	Time            time.Time   `json:"time"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body"`
+	RequestHash     string      `json:"request_hash"` // Hash of the unredacted request body, used for matching on replay
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	Events          []Event     `json:"events"` // Response body as it was read, with timing
+	Error           string      `json:"error,omitempty"`
+}
+
+// Event is a piece of the response body and when it arrived. Compressed bodies
+// are recorded decoded, as one event at the time of their last read.
+type Event struct {
+	OffsetMs int64  `json:"offset_ms"` // Since the request was sent
+	Data     string `json:"data"`
+	Base64   bool   `json:"base64,omitempty"` // Data is base64, for binary or compressed bodies
+}
+
+// Headers whose values are never written to the archive
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "Api-Key"}
+
+// Recorder is a RoundTripper that writes every exchange to an archive
+type Recorder struct {
+	next   http.RoundTripper
+	redact func(string) string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRecorder records exchanges made through next to w. Bodies are passed through
+// redact before they are written, when it's set, each one whole so credentials
+// split across reads are still found.
+func NewRecorder(next http.RoundTripper, w io.Writer, redact func(string) string) *Recorder {
+	return &Recorder{next: next, w: w, redact: redact}
+}
+
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	entry := &Entry{
+		Time:           time.Now(),
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		RequestHeaders: RedactHeaders(req.Header),
+		RequestBody:    string(body),
+		RequestHash:    Hash(body),
+	}
+	if rec.redact != nil {
+		entry.RequestBody = rec.redact(entry.RequestBody)
+	}
+
+	resp, err := rec.next.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+		rec.write(entry)
+		return nil, err
+	}
+
+	entry.Status = resp.StatusCode
+	entry.ResponseHeaders = RedactHeaders(resp.Header)
+	resp.Body = &recordingBody{ReadCloser: resp.Body, rec: rec, entry: entry, start: entry.Time}
+	return resp, nil
+}
+
+func (rec *Recorder) write(entry *Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.w.Write(append(line, '\n'))
+}
+
+// recordingBody captures the response body as it is read and writes the entry when it's closed
+type recordingBody struct {
+	io.ReadCloser
+	rec   *Recorder
+	entry *Entry
+	start time.Time
+	once  sync.Once
+
+	body  bytes.Buffer
+	reads []read
+}
+
+// read marks where a read ended in the body and when
+type read struct {
+	end    int
+	offset time.Duration
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.body.Write(p[:n])
+		b.reads = append(b.reads, read{end: b.body.Len(), offset: time.Since(b.start)})
+	}
+	if err != nil && err != io.EOF {
+		b.entry.Error = err.Error()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.entry.Events = b.events()
+		b.rec.write(b.entry)
+	})
+	return err
+}
+
+// events decodes and redacts the body read so far and splits it into events
+func (b *recordingBody) events() []Event {
+	if len(b.reads) == 0 {
+		return nil
+	}
+	data, reads := b.body.Bytes(), b.reads
+	last := reads[len(reads)-1].offset
+	if encoding := b.entry.ResponseHeaders.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		decoded, err := decode(encoding, data)
+		if err != nil {
+			return b.unredactable(data, last, "can't decode the "+encoding+" body: "+err.Error())
+		}
+		b.entry.ResponseHeaders.Del("Content-Encoding")
+		b.entry.ResponseHeaders.Del("Content-Length")
+		data, reads = decoded, []read{{end: len(decoded), offset: last}}
+	}
+	if !utf8.Valid(data) {
+		return b.unredactable(data, last, "the body is binary")
+	}
+
+	text := string(data)
+	if b.rec.redact == nil {
+		return split(text, reads)
+	}
+	redacted := b.rec.redact(text)
+	if redacted == text {
+		return split(text, reads)
+	}
+	// Masks don't span lines unless a credential does, so lines still match up and
+	// each one keeps the time of the read that completed it
+	if strings.Count(redacted, "\n") != strings.Count(text, "\n") {
+		return []Event{{OffsetMs: last.Milliseconds(), Data: redacted}}
+	}
+	var lineReads []read
+	i, pos := 0, 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		pos += len(line)
+		for i < len(reads)-1 && reads[i].end < pos {
+			i++
+		}
+		lineReads = append(lineReads, reads[i])
+	}
+	var events []Event
+	for j, line := range strings.SplitAfter(redacted, "\n") {
+		offset := lineReads[j].offset.Milliseconds()
+		if n := len(events); n > 0 && events[n-1].OffsetMs == offset {
+			events[n-1].Data += line
+		} else if line != "" {
+			events = append(events, Event{OffsetMs: offset, Data: line})
+		}
+	}
+	return events
+}
+
+// unredactable records a body that can't be redacted as base64, or leaves it out
+// when bodies are redacted
+func (b *recordingBody) unredactable(data []byte, offset time.Duration, reason string) []Event {
+	if b.rec.redact != nil {
+		if b.entry.Error == "" {
+			b.entry.Error = "body not recorded, " + reason
+		}
+		return nil
+	}
+	return []Event{{OffsetMs: offset.Milliseconds(), Data: base64.StdEncoding.EncodeToString(data), Base64: true}}
+}
+
+// split cuts text into one event per read
+func split(text string, reads []read) []Event {
+	events := make([]Event, 0, len(reads))
+	start := 0
+	for _, r := range reads {
+		events = append(events, Event{OffsetMs: r.offset.Milliseconds(), Data: text[start:r.end]})
+		start = r.end
+	}
+	return events
+}
+
+// decode undoes a Content-Encoding
+func decode(encoding string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(data))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown encoding")
+	}
+	return io.ReadAll(r)
+}
+
+// RedactHeaders returns a copy of h with the values of secret headers replaced
+func RedactHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range secretHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+	return redacted
+}
+
+// Hash returns the content hash used to match requests on replay
+func Hash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load reads the entries of an archive
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 256<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
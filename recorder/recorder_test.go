@@ -0,0 +1,111 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func entry(method, url, body, response string) Entry {
+	return Entry{Method: method, URL: url, RequestHash: Hash([]byte(body)), Status: http.StatusOK, Events: []Event{{Data: response}}}
+}
+
+func replay(t *testing.T, rp *Replayer, method, url, body string) (string, error) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := rp.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), nil
+}
+
+func TestReplayMatching(t *testing.T) {
+	rp := NewReplayer([]Entry{
+		entry("POST", "https://api.deepseek.com/v1/chat/completions", `{"n":1}`, "first"),
+		entry("POST", "https://api.deepseek.com/v1/chat/completions", `{"n":2}`, "second"),
+		entry("GET", "https://api.deepseek.com/v1/models?limit=1", "", "models"),
+		{Method: "POST", URL: "https://api.deepseek.com/v1/embeddings", Error: "connection refused"},
+	})
+
+	// The same body is preferred over an earlier entry
+	if got, err := replay(t, rp, "POST", "http://localhost:9000/v1/chat/completions", `{"n":2}`); err != nil || got != "second" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	// A different body gets the next unused entry for the path
+	if got, err := replay(t, rp, "POST", "http://localhost:9000/v1/chat/completions", `{"n":3}`); err != nil || got != "first" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := replay(t, rp, "POST", "http://localhost:9000/v1/chat/completions", `{"n":1}`); err == nil {
+		t.Error("replayed an entry twice")
+	}
+	// Query strings and hosts don't matter, methods do
+	if _, err := replay(t, rp, "POST", "http://localhost:9000/v1/models", ""); err == nil {
+		t.Error("matched an entry with another method")
+	}
+	if got, err := replay(t, rp, "GET", "http://localhost:9000/v1/models", ""); err != nil || got != "models" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := replay(t, rp, "POST", "http://localhost:9000/v1/embeddings", "{}"); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v for a recorded error", err)
+	}
+	if rp.Remaining() != 0 {
+		t.Errorf("%d entries left", rp.Remaining())
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=1")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d sk-secret\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	var archive bytes.Buffer
+	client := &http.Client{Transport: NewRecorder(http.DefaultTransport, &archive, func(s string) string {
+		return strings.ReplaceAll(s, "sk-secret", "sk-******")
+	})}
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/v1/chat/completions", strings.NewReader(`{"key":"sk-secret"}`))
+	req.Header.Set("Authorization", "Bearer sk-secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if strings.Contains(archive.String(), "sk-secret") {
+		t.Errorf("archive contains a secret: %s", archive.String())
+	}
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	os.WriteFile(path, archive.Bytes(), 0o600)
+	entries, err := Load(path)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %d entries, %v", len(entries), err)
+	}
+	if cookie := entries[0].ResponseHeaders.Get("Set-Cookie"); cookie != "REDACTED" {
+		t.Errorf("got Set-Cookie %q", cookie)
+	}
+
+	// Requests are matched by the hash of their unredacted body
+	got, err := replay(t, NewReplayer(entries), http.MethodPost, "http://localhost/v1/chat/completions", `{"key":"sk-secret"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != strings.ReplaceAll(string(want), "sk-secret", "sk-******") {
+		t.Errorf("replayed %q", got)
+	}
+}
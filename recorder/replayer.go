@@ -0,0 +1,155 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replayer is a RoundTripper that answers requests from recorded entries instead of the network.
+// A request gets the first unused entry with the same method, path and body, or failing that
+// the next unused entry with the same method and path, so small differences like generated IDs
+// don't break a replay.
+type Replayer struct {
+	// Realtime replays response bodies with their recorded timing
+	Realtime bool
+
+	mu      sync.Mutex
+	entries []Entry
+	used    []bool
+}
+
+func NewReplayer(entries []Entry) *Replayer {
+	return &Replayer{entries: entries, used: make([]bool, len(entries))}
+}
+
+func (rp *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entry, ok := rp.match(req.Method, req.URL.Path, Hash(body))
+	if !ok {
+		return nil, fmt.Errorf("recorder: no recorded response for %s %s", req.Method, req.URL.Path)
+	}
+	if entry.Error != "" && entry.Status == 0 {
+		return nil, fmt.Errorf("recorder: recorded error: %s", entry.Error)
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode: entry.Status,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     entry.ResponseHeaders.Clone(),
+		Body:       &replayBody{events: entry.Events, realtime: rp.Realtime, start: time.Now(), ctx: req.Context().Done()},
+		Request:    req,
+	}, nil
+}
+
+// Remaining returns how many entries have not been replayed yet
+func (rp *Replayer) Remaining() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	n := 0
+	for _, used := range rp.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
+
+func (rp *Replayer) match(method, path, hash string) (Entry, bool) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	fallback := -1
+	for i, entry := range rp.entries {
+		if rp.used[i] || entry.Method != method || entryPath(entry.URL) != path {
+			continue
+		}
+		if entry.RequestHash == hash {
+			rp.used[i] = true
+			return entry, true
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+	if fallback < 0 {
+		return Entry{}, false
+	}
+	rp.used[fallback] = true
+	return rp.entries[fallback], true
+}
+
+func entryPath(rawURL string) string {
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		rawURL = rawURL[i+3:]
+		if j := strings.IndexByte(rawURL, '/'); j >= 0 {
+			rawURL = rawURL[j:]
+		} else {
+			rawURL = "/"
+		}
+	}
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	return rawURL
+}
+
+// replayBody returns the recorded events in order, optionally waiting until each one is due
+type replayBody struct {
+	events   []Event
+	realtime bool
+	start    time.Time
+	ctx      <-chan struct{}
+	buf      bytes.Buffer
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if len(b.events) == 0 {
+			return 0, io.EOF
+		}
+		event := b.events[0]
+		b.events = b.events[1:]
+
+		if b.realtime {
+			if wait := time.Until(b.start.Add(time.Duration(event.OffsetMs) * time.Millisecond)); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-b.ctx:
+					return 0, io.ErrUnexpectedEOF
+				}
+			}
+		}
+
+		if event.Base64 {
+			data, err := base64.StdEncoding.DecodeString(event.Data)
+			if err != nil {
+				return 0, err
+			}
+			b.buf.Write(data)
+		} else {
+			b.buf.WriteString(event.Data)
+		}
+	}
+	return b.buf.Read(p)
+}
+
+func (b *replayBody) Close() error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"cursor-deepseek/recorder"
+	"log"
+	"os"
+)
+
+// initRecording sets up recording of upstream traffic to RECORD_FILE and
+// serving recorded responses from REPLAY_FILE instead of calling DeepSeek
+func initRecording() {
+	if path := os.Getenv("REPLAY_FILE"); path != "" {
+		entries, err := recorder.Load(path)
+		if err != nil {
+			log.Fatalf("Error loading REPLAY_FILE: %v", err)
+		}
+		replayer := recorder.NewReplayer(entries)
+		replayer.Realtime = os.Getenv("REPLAY_REALTIME") == "true"
+		upstreamClient.Transport = replayer
+		log.Printf("Replaying %d recorded responses from %s", len(entries), path)
+	}
+
+	if path := os.Getenv("RECORD_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("Error opening RECORD_FILE: %v", err)
+		}
+		// Bodies are masked like user messages unless explicitly disabled
+		redact := redactRecording
+		if os.Getenv("RECORD_REDACT_BODIES") == "false" {
+			redact = nil
+		}
+		upstreamClient.Transport = recorder.NewRecorder(upstreamClient.Transport, f, redact)
+		log.Printf("Recording upstream traffic to %s", path)
+	}
+}
+
+// redactRecording masks credentials and the configured patterns in recorded bodies
+func redactRecording(text string) string {
+	return currentConfig().masker.Mask(text)
+}
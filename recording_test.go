@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/mockupstream"
+	"cursor-deepseek/recorder"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(mockupstream.Reply{Content: "recorded reply", ChunkSize: 5, Encoding: "gzip"})
+
+	var archive bytes.Buffer
+	upstreamClient = &http.Client{Transport: recorder.NewRecorder(upstream.Client().Transport, &archive, nil)}
+	streamBody := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`
+	readStream(t, post(t, proxy, streamBody))
+
+	var entries []recorder.Entry
+	for _, line := range strings.Split(strings.TrimSpace(archive.String()), "\n") {
+		var entry recorder.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 1 || entries[0].RequestHeaders.Get("Authorization") != "REDACTED" {
+		t.Fatalf("got entries %+v", entries)
+	}
+
+	// Replay without the upstream
+	upstream.Close()
+	upstreamClient = &http.Client{Transport: recorder.NewReplayer(entries)}
+	if got := readStream(t, post(t, proxy, streamBody)).Choices[0].Message.Content; got != "recorded reply" {
+		t.Errorf("got replayed content %q", got)
+	}
+}
+
+func TestRecordingRedaction(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.Mask = MaskConfig{Patterns: []string{`ticket-(\d+)`}}
+	useConfig(t, &cfg)
+
+	secret := "The ticket-4815162342 is done"
+	for _, encoding := range []string{"", "gzip", "br", "zstd"} {
+		var archive bytes.Buffer
+		upstreamClient = &http.Client{Transport: recorder.NewRecorder(upstream.Client().Transport, &archive, redactRecording)}
+		// Reads of three bytes split the ticket number
+		upstream.Enqueue(mockupstream.Reply{Content: secret, ChunkSize: 3, ChunkDelay: 2 * time.Millisecond, Encoding: encoding})
+		readStream(t, post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+		upstream.Enqueue(mockupstream.Reply{Content: secret, Encoding: encoding})
+		decodeResponse(t, post(t, proxy, chatBody))
+
+		if strings.Contains(archive.String(), "4815162342") {
+			t.Errorf("%q: ticket number recorded: %s", encoding, archive.String())
+		}
+		var entry recorder.Entry
+		json.Unmarshal(bytes.SplitN(archive.Bytes(), []byte("\n"), 2)[0], &entry)
+		if entry.ResponseHeaders.Get("Content-Encoding") != "" || len(entry.Events) == 0 || entry.Events[0].Base64 {
+			t.Errorf("%q: body not recorded decoded: %+v", encoding, entry)
+		}
+		// Uncompressed streams keep the timing of their events
+		if encoding == "" && len(entry.Events) < 2 {
+			t.Errorf("stream recorded as %d events", len(entry.Events))
+		}
+	}
+}
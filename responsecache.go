@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"cursor-deepseek/cache"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Exact-match response cache, nil unless CACHE is enabled
+var responseCache cache.Cache
+
+// Pacing of cached responses replayed to streaming clients
+var cacheReplayChunkSize = 16
+var cacheReplayDelay = 10 * time.Millisecond
+
+// Cache lookups since startup
+var cacheHits, cacheMisses atomic.Int64
+
+func initResponseCache() {
+	if os.Getenv("CACHE") != "true" {
+		return
+	}
+
+	ttl := time.Hour
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid CACHE_TTL: %v", err)
+		}
+		ttl = d
+	}
+	maxEntries := 1000
+	if n, err := strconv.Atoi(os.Getenv("CACHE_MAX_ENTRIES")); err == nil {
+		maxEntries = n
+	}
+	maxBytes := int64(64 << 20)
+	if n, err := strconv.ParseInt(os.Getenv("CACHE_MAX_BYTES"), 10, 64); err == nil {
+		maxBytes = n
+	}
+	if v := os.Getenv("CACHE_REPLAY_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid CACHE_REPLAY_DELAY: %v", err)
+		}
+		cacheReplayDelay = d
+	}
+
+	responseCache = cache.NewMemory(ttl, maxEntries, maxBytes)
+	if dir := os.Getenv("CACHE_DIR"); dir != "" {
+		disk, err := cache.NewDisk(dir, ttl, maxBytes)
+		if err != nil {
+			log.Fatalf("Error creating cache directory: %v", err)
+		}
+		responseCache = &cache.Tiered{Fast: responseCache, Slow: disk}
+	}
+}
+
+// cacheControl reports whether the client allows reading from and writing to the cache.
+// "no-cache" skips the lookup but still stores the fresh response, "no-store" skips both.
+func cacheControl(r *http.Request) (lookup, store bool) {
+	if responseCache == nil {
+		return false, false
+	}
+	directives := strings.ToLower(r.Header.Get("Cache-Control") + "," + r.Header.Get("Pragma"))
+	if strings.Contains(directives, "no-store") {
+		return false, false
+	}
+	return !strings.Contains(directives, "no-cache"), true
+}
+
+// responseCacheKey addresses a request by its final upstream form, so streaming and
+// regular requests share entries. The API key is part of the key to keep clients apart.
+func responseCacheKey(endpoint, apiKey string, req DeepSeekRequest) string {
+	req.Stream = false
+	req.StreamOptions = nil
+	body, _ := json.Marshal(req)
+	keyHash := sha256.Sum256([]byte(apiKey))
+	return cache.Key([]byte(endpoint), keyHash[:], body)
+}
+
+func loadCachedResponse(key string) (*ChatResponse, bool) {
+	data, ok := responseCache.Get(key)
+	if !ok {
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	var resp ChatResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	cacheHits.Add(1)
+	return &resp, true
+}
+
+func storeCachedResponse(rl *requestLog, key string, resp *ChatResponse) {
+	if resp == nil || len(resp.Choices) == 0 {
+		return
+	}
+	for _, choice := range resp.Choices {
+		// Only complete replies are worth replaying
+		if choice.FinishReason == "" || choice.FinishReason == "length" {
+			return
+		}
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	responseCache.Set(key, data)
+	rl.debugf("Cached response %s under %s", resp.ID, key)
+}
+
+// replayCachedResponse sends a cached response, streaming it in small paced chunks
+// like the upstream would when the client asked for a stream
+func replayCachedResponse(w http.ResponseWriter, rl *requestLog, resp *ChatResponse, model string, stream, includeUsage bool) {
+	translateResponse(rl, resp, model)
+	if !stream {
+		writeChatResponse(w, rl, resp, model, false, false)
+		return
+	}
+
+	setStreamHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	for i, chunk := range responseChunks(resp, cacheReplayChunkSize, includeUsage) {
+		if i > 0 && cacheReplayDelay > 0 {
+			time.Sleep(cacheReplayDelay)
+		}
+		if err := writeSSE(w, chunk); err != nil {
+			rl.debugf("Error writing to response: %v", err)
+			return
+		}
+	}
+	writeSSEDone(w)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"cursor-deepseek/cache"
+	"testing"
+)
+
+func TestResponseCache(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	responseCache = cache.NewMemory(0, 10, 0)
+
+	first := post(t, proxy, chatBody)
+	if got := first.Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("got X-Cache %q", got)
+	}
+	decodeResponse(t, first)
+
+	// The cached reply is also replayed as a stream
+	second := post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`)
+	if got := second.Header.Get("X-Cache"); got != "HIT" {
+		t.Errorf("got X-Cache %q", got)
+	}
+	if got := readStream(t, second).Choices[0].Message.Content; got != upstream.Default.Content {
+		t.Errorf("got content %q", got)
+	}
+
+	decodeResponse(t, post(t, proxy, chatBody, "Cache-Control", "no-cache"))
+	if n := len(upstream.Requests()); n != 2 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cursor-deepseek/jsonrepair"
+	"cursor-deepseek/jsonschema"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OpenAI response_format parameter
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Schema      interface{} `json:"schema"`
+	Strict      *bool       `json:"strict,omitempty"`
+}
+
+// applyResponseFormat passes response_format upstream when the upstream supports it and otherwise
+// emulates it with instructions, returning the check that validates the reply in that case
+func applyResponseFormat(req *DeepSeekRequest, rf *ResponseFormat, support string) (responseCheck, error) {
+	switch rf.Type {
+	case "", "text":
+		return nil, nil
+
+	case "json_object":
+		if support != "none" {
+			req.ResponseFormat = rf
+			return nil, nil
+		}
+		req.Messages = addSystemInstruction(req.Messages, "Respond only with a valid JSON object. Do not add any other text.")
+		return checkJSONContent(nil), nil
+
+	case "json_schema":
+		if rf.JSONSchema == nil || rf.JSONSchema.Schema == nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema is required")
+		}
+		if support == "json_schema" {
+			req.ResponseFormat = rf
+			return nil, nil
+		}
+		if support == "json_object" {
+			req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		}
+
+		schema, err := json.MarshalIndent(rf.JSONSchema.Schema, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("invalid response_format.json_schema.schema: %v", err)
+		}
+		var instruction strings.Builder
+		fmt.Fprintf(&instruction, "Respond only with a JSON object that conforms to the JSON schema `%s`", rf.JSONSchema.Name)
+		if rf.JSONSchema.Description != "" {
+			fmt.Fprintf(&instruction, " (%s)", rf.JSONSchema.Description)
+		}
+		fmt.Fprintf(&instruction, ". Do not add any other text.\n\n```json\n%s\n```", schema)
+		req.Messages = addSystemInstruction(req.Messages, instruction.String())
+		return checkJSONContent(rf.JSONSchema.Schema), nil
+	}
+
+	return nil, fmt.Errorf("unsupported response_format type %q", rf.Type)
+}
+
+// checkJSONContent returns a check that the reply content is a JSON object matching schema,
+// cleaning up code fences and other repairable mistakes in place
+func checkJSONContent(schema interface{}) responseCheck {
+	return func(resp *ChatResponse) error {
+		if len(resp.Choices) == 0 {
+			return fmt.Errorf("the reply has no choices")
+		}
+		for i := range resp.Choices {
+			msg := &resp.Choices[i].Message
+			// Tool calls take the place of the structured reply
+			if len(msg.ToolCalls) > 0 {
+				continue
+			}
+			if strings.TrimSpace(msg.Content) == "" {
+				return fmt.Errorf("the reply is empty, it must be a JSON object")
+			}
+
+			content, err := jsonrepair.Repair(msg.Content)
+			if err != nil {
+				return fmt.Errorf("the reply is not valid JSON")
+			}
+			var value interface{}
+			if err := json.Unmarshal([]byte(content), &value); err != nil {
+				return fmt.Errorf("the reply is not valid JSON")
+			}
+			if _, ok := value.(map[string]interface{}); !ok {
+				return fmt.Errorf("the reply must be a JSON object")
+			}
+			var schemaErr *jsonschema.SchemaError
+			if err := jsonschema.Validate(schema, value); errors.As(err, &schemaErr) {
+				errorLog("Not validating the reply: %v", err)
+			} else if err != nil {
+				return fmt.Errorf("the reply does not match the JSON schema: %v", err)
+			}
+			msg.Content = content
+		}
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"cursor-deepseek/mockupstream"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStructuredOutput(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(
+		mockupstream.Reply{Content: `{"answer": "forty-two"}`},
+		mockupstream.Reply{Content: "```json\n{\"answer\": 42}\n```"},
+	)
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"result","schema":{"type":"object","properties":{"answer":{"type":"integer"}},"required":["answer"]}}}}`
+	resp := decodeResponse(t, post(t, proxy, body))
+	if got := resp.Choices[0].Message.Content; got != `{"answer": 42}` {
+		t.Errorf("got content %q", got)
+	}
+	if got := upstream.Requests()[0].JSON()["response_format"]; got == nil {
+		t.Errorf("upstream did not get json_object mode")
+	}
+}
+
+func TestResponseFormatPerRoute(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.Routes = []Route{
+		{Model: "gpt-4o", UpstreamModel: "deepseek-chat", ResponseFormat: "json_schema"},
+		{Model: "local", UpstreamModel: "llama", ResponseFormat: "none"},
+	}
+	useConfig(t, &cfg)
+	upstream.Default = mockupstream.Reply{Content: `{"answer": 42}`}
+
+	format := `"response_format":{"type":"json_schema","json_schema":{"name":"result","schema":{"type":"object"}}}`
+	decodeResponse(t, post(t, proxy, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],`+format+`}`))
+	decodeResponse(t, post(t, proxy, `{"model":"local","messages":[{"role":"user","content":"Hi"}],`+format+`}`))
+	reqs := upstream.Requests()
+	if rf, _ := reqs[0].JSON()["response_format"].(map[string]interface{}); rf["type"] != "json_schema" {
+		t.Errorf("json_schema route got response_format %v", rf)
+	}
+	if rf, ok := reqs[1].JSON()["response_format"]; ok || !strings.Contains(string(reqs[1].Body), "JSON schema") {
+		t.Errorf("route without support got response_format %v", rf)
+	}
+
+	cfg.Routes[0].ResponseFormat = "yaml"
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "response_format") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestStructuredOutputFailure(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Default = mockupstream.Reply{Content: "Sorry, I can't do that."}
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"result","schema":{"type":"object"}}}}`
+	resp := post(t, proxy, body)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if n := len(upstream.Requests()); n != structuredOutputRetries+1 {
+		t.Errorf("upstream got %d requests", n)
+	}
+}
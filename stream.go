@@ -0,0 +1,416 @@
+package main
+
+import (
+	"cursor-deepseek/tracing"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// OpenAI compatible streaming chunk structure
+type ChatChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index        int             `json:"index"`
+	Delta        Delta           `json:"delta"`
+	Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type Delta struct {
+	Role             string          `json:"role,omitempty"`
+	Content          string          `json:"content,omitempty"`
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+func (d Delta) empty() bool {
+	return d.Role == "" && d.Content == "" && d.ReasoningContent == "" && len(d.ToolCalls) == 0
+}
+
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function FunctionCallDelta `json:"function"`
+}
+
+type FunctionCallDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+func setStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+}
+
+// writeSSE sends v as a single server-sent event and flushes it
+func writeSSE(w http.ResponseWriter, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeSSEDone(w http.ResponseWriter) {
+	w.Write([]byte("data: [DONE]\n\n"))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamChatResponse replays a complete response as an SSE stream, for when the
+// client asked for streaming but the proxy had to wait for the full reply
+func streamChatResponse(w http.ResponseWriter, rl *requestLog, resp *ChatResponse, includeUsage bool) {
+	rl.debugf("Streaming buffered response %s", resp.ID)
+	setStreamHeaders(w)
+	w.WriteHeader(http.StatusOK)
+
+	for _, chunk := range responseChunks(resp, 0, includeUsage) {
+		if err := writeSSE(w, chunk); err != nil {
+			rl.debugf("Error writing to response: %v", err)
+			return
+		}
+	}
+	writeSSEDone(w)
+}
+
+// responseChunks splits a complete response into the chunks a stream would carry.
+// Content and tool call arguments are split into pieces of about pieceSize bytes,
+// or sent whole when pieceSize is 0. With includeUsage the usage follows in a
+// final chunk without choices, like stream_options.include_usage asks for.
+func responseChunks(resp *ChatResponse, pieceSize int, includeUsage bool) []ChatChunk {
+	newChunk := func(choice ChunkChoice) ChatChunk {
+		return ChatChunk{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: []ChunkChoice{choice},
+		}
+	}
+
+	var chunks []ChatChunk
+	for _, choice := range resp.Choices {
+		pieces := splitPieces(choice.Message.Content, pieceSize)
+		chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: Delta{Role: "assistant", Content: pieces[0]}}))
+		for _, piece := range pieces[1:] {
+			chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: Delta{Content: piece}}))
+		}
+
+		for j, tc := range choice.Message.ToolCalls {
+			for k, piece := range splitPieces(tc.Function.Arguments, pieceSize) {
+				delta := ToolCallDelta{Index: j, Function: FunctionCallDelta{Arguments: piece}}
+				// The first fragment of a call carries its ID and name
+				if k == 0 {
+					delta.ID = tc.ID
+					delta.Type = "function"
+					delta.Function.Name = tc.Function.Name
+				}
+				chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: Delta{ToolCalls: []ToolCallDelta{delta}}}))
+			}
+		}
+
+		finishReason := choice.FinishReason
+		chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, FinishReason: &finishReason}))
+	}
+	if includeUsage {
+		usage := resp.Usage
+		chunk := newChunk(ChunkChoice{})
+		chunk.Choices = []ChunkChoice{}
+		chunk.Usage = &usage
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// splitPieces cuts s into pieces of about size bytes, preferring to cut after spaces
+// and never inside a UTF-8 sequence. It always returns at least one piece.
+func splitPieces(s string, size int) []string {
+	if size <= 0 || len(s) <= size {
+		return []string{s}
+	}
+	var pieces []string
+	for len(s) > size {
+		cut := size
+		if space := strings.LastIndexByte(s[:size], ' '); space > size/2 {
+			cut = space + 1
+		}
+		for cut < len(s) && !utf8.RuneStart(s[cut]) {
+			cut++
+		}
+		pieces = append(pieces, s[:cut])
+		s = s[cut:]
+	}
+	if s != "" {
+		pieces = append(pieces, s)
+	}
+	return pieces
+}
+
+// streamFilter rewrites the chunks of an upstream stream before they reach the client
+type streamFilter interface {
+	// Filter returns the chunks to send in place of chunk
+	Filter(chunk *ChatChunk) []*ChatChunk
+	// Flush returns the chunks still held back when the stream ends
+	Flush() []*ChatChunk
+}
+
+// applyFilters passes chunk through each filter in turn
+func applyFilters(filters []streamFilter, chunk *ChatChunk) []*ChatChunk {
+	chunks := []*ChatChunk{chunk}
+	for _, f := range filters {
+		var next []*ChatChunk
+		for _, c := range chunks {
+			next = append(next, f.Filter(c)...)
+		}
+		chunks = next
+	}
+	return chunks
+}
+
+// flushFilters collects held back chunks, passing each through the filters after the one that held it
+func flushFilters(filters []streamFilter) []*ChatChunk {
+	var chunks []*ChatChunk
+	for i, f := range filters {
+		for _, c := range f.Flush() {
+			chunks = append(chunks, applyFilters(filters[i+1:], c)...)
+		}
+	}
+	return chunks
+}
+
+// toolCallBuffer holds back tool call deltas until their choice finishes, so the
+// complete calls can be checked and fixed before the client sees them
+type toolCallBuffer struct {
+	check    responseCheck
+	calls    map[int][]ToolCall // Buffered calls by choice index
+	template ChatChunk          // ID, model and timestamp for the chunks it emits
+}
+
+func newToolCallBuffer(check responseCheck) *toolCallBuffer {
+	return &toolCallBuffer{check: check, calls: make(map[int][]ToolCall)}
+}
+
+func (b *toolCallBuffer) Filter(chunk *ChatChunk) []*ChatChunk {
+	b.template = ChatChunk{ID: chunk.ID, Object: chunk.Object, Created: chunk.Created, Model: chunk.Model}
+
+	var out []*ChatChunk
+	choices := chunk.Choices[:0]
+	for _, choice := range chunk.Choices {
+		for _, delta := range choice.Delta.ToolCalls {
+			b.add(choice.Index, delta)
+		}
+		choice.Delta.ToolCalls = nil
+
+		// Send the complete calls right before the finish reason
+		if choice.FinishReason != nil {
+			if released := b.release(choice.Index); released != nil {
+				out = append(out, released)
+			}
+		}
+		if choice.Delta.empty() && choice.FinishReason == nil {
+			continue
+		}
+		choices = append(choices, choice)
+	}
+	chunk.Choices = choices
+
+	if len(chunk.Choices) > 0 || chunk.Usage != nil {
+		out = append(out, chunk)
+	}
+	return out
+}
+
+func (b *toolCallBuffer) Flush() []*ChatChunk {
+	indexes := make([]int, 0, len(b.calls))
+	for index := range b.calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var out []*ChatChunk
+	for _, index := range indexes {
+		if released := b.release(index); released != nil {
+			out = append(out, released)
+		}
+	}
+	return out
+}
+
+// add merges a tool call fragment into the buffered calls of a choice
+func (b *toolCallBuffer) add(choiceIndex int, delta ToolCallDelta) {
+	calls := b.calls[choiceIndex]
+	for len(calls) <= delta.Index {
+		calls = append(calls, ToolCall{Type: "function"})
+	}
+	tc := &calls[delta.Index]
+	if delta.ID != "" {
+		tc.ID = delta.ID
+	}
+	if delta.Type != "" {
+		tc.Type = delta.Type
+	}
+	tc.Function.Name += delta.Function.Name
+	tc.Function.Arguments += delta.Function.Arguments
+	b.calls[choiceIndex] = calls
+}
+
+// release checks the buffered calls of a choice and returns them as a single chunk
+func (b *toolCallBuffer) release(choiceIndex int) *ChatChunk {
+	calls, ok := b.calls[choiceIndex]
+	if !ok {
+		return nil
+	}
+	delete(b.calls, choiceIndex)
+
+	resp := &ChatResponse{Choices: []ChatChoice{{Index: choiceIndex, Message: Message{Role: "assistant", ToolCalls: calls}}}}
+	if b.check != nil {
+		if err := b.check(resp); err != nil {
+			errorLog("Streamed tool calls rejected: %v", err)
+		}
+	}
+
+	chunk := b.template
+	delta := Delta{}
+	for j, tc := range resp.Choices[0].Message.ToolCalls {
+		delta.ToolCalls = append(delta.ToolCalls, ToolCallDelta{
+			Index: j,
+			ID:    tc.ID,
+			Type:  tc.Type,
+			Function: FunctionCallDelta{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		})
+	}
+	chunk.Choices = []ChunkChoice{{Index: choiceIndex, Delta: delta}}
+	return &chunk
+}
+
+// usageFilter records the usage an upstream stream reports as it passes, so it
+// counts even when the stream breaks off later, and removes it from the stream
+// when the client didn't ask for it
+type usageFilter struct {
+	rl       *requestLog
+	span     *tracing.Span
+	forward  bool
+	recorded Usage
+}
+
+func newUsageFilter(rl *requestLog, span *tracing.Span, forward bool) *usageFilter {
+	return &usageFilter{rl: rl, span: span, forward: forward}
+}
+
+func (f *usageFilter) Filter(chunk *ChatChunk) []*ChatChunk {
+	if chunk.Usage == nil {
+		return []*ChatChunk{chunk}
+	}
+	// Upstreams that repeat usage report the running total, only what's new is added
+	delta := *chunk.Usage
+	delta.sub(f.recorded)
+	f.rl.addUsage(f.rl.upstreamModel, delta)
+	f.recorded = *chunk.Usage
+	traceUsage(f.span, f.recorded)
+	if f.forward {
+		return []*ChatChunk{chunk}
+	}
+	chunk.Usage = nil
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	return []*ChatChunk{chunk}
+}
+
+func (f *usageFilter) Flush() []*ChatChunk {
+	return nil
+}
+
+// streamAssembler rebuilds the complete response from the chunks passing through it
+type streamAssembler struct {
+	resp    ChatResponse
+	choices map[int]*ChatChoice
+	order   []int
+}
+
+func newStreamAssembler() *streamAssembler {
+	return &streamAssembler{choices: make(map[int]*ChatChoice)}
+}
+
+func (a *streamAssembler) Filter(chunk *ChatChunk) []*ChatChunk {
+	a.resp.ID = chunk.ID
+	a.resp.Created = chunk.Created
+	a.resp.Model = chunk.Model
+	if chunk.Usage != nil {
+		a.resp.Usage = *chunk.Usage
+	}
+
+	for _, c := range chunk.Choices {
+		choice := a.choices[c.Index]
+		if choice == nil {
+			choice = &ChatChoice{Index: c.Index, Message: Message{Role: "assistant"}}
+			a.choices[c.Index] = choice
+			a.order = append(a.order, c.Index)
+		}
+		choice.Message.Content += c.Delta.Content
+		for _, delta := range c.Delta.ToolCalls {
+			toolCalls := choice.Message.ToolCalls
+			for len(toolCalls) <= delta.Index {
+				toolCalls = append(toolCalls, ToolCall{Type: "function"})
+			}
+			tc := &toolCalls[delta.Index]
+			if delta.ID != "" {
+				tc.ID = delta.ID
+			}
+			tc.Function.Name += delta.Function.Name
+			tc.Function.Arguments += delta.Function.Arguments
+			choice.Message.ToolCalls = toolCalls
+		}
+		if c.FinishReason != nil {
+			choice.FinishReason = *c.FinishReason
+		}
+	}
+	return []*ChatChunk{chunk}
+}
+
+func (a *streamAssembler) Flush() []*ChatChunk {
+	return nil
+}
+
+// response returns the assembled response, or nil if no choice finished
+func (a *streamAssembler) response() *ChatResponse {
+	resp := a.resp
+	resp.Choices = nil
+	for _, index := range a.order {
+		choice := a.choices[index]
+		if choice.FinishReason == "" {
+			return nil
+		}
+		resp.Choices = append(resp.Choices, *choice)
+	}
+	if len(resp.Choices) == 0 {
+		return nil
+	}
+	return &resp
+}
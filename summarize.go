@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cursor-deepseek/cache"
+	"cursor-deepseek/tracing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route that writes summaries for the summarize strategy, by the model clients ask
+// for. Summaries are written on the request's own route when empty.
+var trimSummaryRoute = ""
+
+// Model that writes summaries on the request's own route, its upstream model when empty
+var trimSummaryModel = ""
+
+// Summaries are limited to this many tokens
+var trimSummaryTokens = 1000
+
+// Summaries by the chained hash of the messages they cover, so a conversation that
+// keeps growing only has its newly dropped messages summarized
+var summaryCache cache.Cache = cache.NewMemory(24*time.Hour, 1000, 16<<20)
+
+const summaryPrompt = "You compact long conversations between a user and a coding assistant. " +
+	"Summarize the conversation below so the assistant can continue the work without it. " +
+	"Keep the user's goals and instructions, decisions made, files and identifiers involved, " +
+	"results of tool calls that still matter, and open problems. Leave out pleasantries and " +
+	"anything that was superseded. Write in the second person, addressed to the assistant."
+
+const summaryNotePrefix = "Earlier parts of this conversation were removed to fit the context window. " +
+	"This is a summary of them:\n\n"
+
+func initSummaries() {
+	trimSummaryRoute = os.Getenv("TRIM_SUMMARY_ROUTE")
+	trimSummaryModel = os.Getenv("TRIM_SUMMARY_MODEL")
+	if tokens := os.Getenv("TRIM_SUMMARY_TOKENS"); tokens != "" {
+		n, err := strconv.Atoi(tokens)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TRIM_SUMMARY_TOKENS %q", tokens)
+		}
+		trimSummaryTokens = n
+	}
+}
+
+// summarizeOldest replaces the oldest parts of the conversation, the ones oldest_turns
+// would drop, with a summary written by the summary model. The summary is added
+// as a system message after the leading ones. When summarizing fails the messages are
+// left for the next strategy.
+func summarizeOldest(px *proxyRequest, messages []Message, budget int) []Message {
+	note := Message{Role: "system", Content: summaryNotePrefix}
+	est := px.estimator()
+	kept, dropped := splitOldest(est, messages, budget-messageTokens(est, note)-trimSummaryTokens)
+	if len(dropped) == 0 || px == nil {
+		return messages
+	}
+
+	summary, err := px.summarize(dropped)
+	if err != nil {
+		errorLog("Error summarizing %d messages: %v", len(dropped), err)
+		return messages
+	}
+	note.Content += summary
+
+	preamble, _ := trimUnits(kept)
+	result := make([]Message, 0, len(kept)+1)
+	result = append(result, kept[:preamble]...)
+	result = append(result, note)
+	return append(result, kept[preamble:]...)
+}
+
+// summarize returns a summary of messages, reusing the summary of the longest
+// prefix of them that was summarized before
+func (p *proxyRequest) summarize(messages []Message) (string, error) {
+	sp, model := p.summarizer()
+
+	// keys[i] covers messages[:i]
+	keys := make([]string, len(messages)+1)
+	keys[0] = cache.Key([]byte(model))
+	for i, msg := range messages {
+		data, _ := json.Marshal(msg)
+		keys[i+1] = cache.Key([]byte(keys[i]), data)
+	}
+	start, previous := 0, ""
+	for i := len(messages); i > 0; i-- {
+		if cached, ok := summaryCache.Get(keys[i]); ok {
+			start, previous = i, string(cached)
+			break
+		}
+	}
+	if start == len(messages) {
+		p.log().debugf("Reusing summary of %d messages", len(messages))
+		return previous, nil
+	}
+
+	ctx, span := startSpan(p.r.Context(), "summarize_messages",
+		tracing.String("gen_ai.request.model", model),
+		tracing.Int("messages", len(messages)-start),
+		tracing.Int("messages.cached", start))
+	defer span.End()
+
+	// The summary model has a context window of its own
+	remaining := messages[start:]
+	limits := sp.limits()
+	if model != sp.route.UpstreamModel {
+		limits = modelLimitTable[model]
+	}
+	if limits.ContextWindow > 0 {
+		est := sp.estimator()
+		room := limits.ContextWindow - trimSummaryTokens - est.Count(summaryPrompt) - est.Count(previous) - minReplyTokens
+		remaining = truncateToolOutputs(p, remaining, room)
+	}
+
+	req := DeepSeekRequest{
+		Model:     model,
+		MaxTokens: trimSummaryTokens,
+		Messages: []Message{
+			{Role: "system", Content: summaryPrompt},
+			{Role: "user", Content: summaryTranscript(previous, remaining)},
+		},
+	}
+	sp.r = p.r.WithContext(ctx)
+	resp, err := sp.complete(req)
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		err := errors.New("the summary model returned no summary")
+		span.SetError(err)
+		return "", err
+	}
+	summary := strings.TrimSpace(resp.Choices[0].Message.Content)
+	p.log().debugf("Summarized %d messages in %d characters", len(messages)-start, len(summary))
+	summaryCache.Set(keys[len(messages)], []byte(summary))
+	return summary, nil
+}
+
+// summarizer returns the request summaries are written with and the model writing
+// them: on the TRIM_SUMMARY_ROUTE, with its endpoint, upstream key and limits, or on
+// the request's own route
+func (p *proxyRequest) summarizer() (*proxyRequest, string) {
+	if trimSummaryRoute != "" {
+		cfg := currentConfig()
+		if route := cfg.route(trimSummaryRoute); route != nil {
+			targetURL := cfg.endpoint(route) + "/v1/chat/completions"
+			return &proxyRequest{r: p.r, apiKey: p.apiKey, targetURL: targetURL, route: route}, route.UpstreamModel
+		}
+	}
+	model := trimSummaryModel
+	if model == "" {
+		model = p.route.UpstreamModel
+	}
+	return &proxyRequest{r: p.r, apiKey: p.apiKey, targetURL: p.targetURL, route: p.route}, model
+}
+
+// summaryTranscript renders messages as plain text for the summary model, after the
+// summary of the messages before them if there is one
+func summaryTranscript(previous string, messages []Message) string {
+	var b strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&b, "Summary of the conversation so far:\n\n%s\n\nThe conversation continued:\n\n", previous)
+	}
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "tool":
+			fmt.Fprintf(&b, "[tool result %s]\n%s\n\n", msg.ToolCallID, msg.Content)
+		case len(msg.ToolCalls) > 0:
+			if msg.Content != "" {
+				fmt.Fprintf(&b, "[assistant]\n%s\n", msg.Content)
+			}
+			for _, tc := range msg.ToolCalls {
+				fmt.Fprintf(&b, "[assistant called %s %s with %s]\n", tc.Function.Name, tc.ID, tc.Function.Arguments)
+			}
+			b.WriteString("\n")
+		default:
+			fmt.Fprintf(&b, "[%s]\n%s\n\n", msg.Role, msg.Content)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"cursor-deepseek/tracing"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Spans are exported when an OTLP endpoint is configured, nil disables tracing
+var tracer *tracing.Tracer
+
+// The tracer's exporter, shut down when the proxy stops so queued spans are sent
+var traceExporter *tracing.OTLPExporter
+
+func initTracing() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "cursor-deepseek"
+	}
+	traceExporter = tracing.NewOTLPExporter(endpoint, service)
+	tracer = tracing.NewTracer(traceExporter)
+	infoLog("Exporting traces to %s", endpoint)
+}
+
+// shutdownTracing sends the spans still queued, giving up when ctx is done
+func shutdownTracing(ctx context.Context) {
+	if traceExporter != nil {
+		traceExporter.Shutdown(ctx)
+	}
+}
+
+// withTracing wraps each request in a server span, continuing the client's trace
+// when it sends a traceparent header
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, tracing.KindServer,
+			tracing.String("http.request.method", r.Method),
+			tracing.String("url.path", r.URL.Path))
+		rl := requestLogFrom(ctx)
+		rl.traceID = span.Context().TraceID.String()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		if rl.id != "" {
+			span.SetAttributes(tracing.String("request.id", rl.id))
+		}
+		if sw, ok := w.(*statusWriter); ok {
+			span.SetAttributes(tracing.Int("http.response.status_code", sw.status))
+		}
+		if rl.model != "" {
+			span.SetAttributes(
+				tracing.String("gen_ai.operation.name", "chat"),
+				tracing.String("gen_ai.request.model", rl.model))
+		}
+		if rl.usage != nil {
+			span.SetAttributes(
+				tracing.Int("gen_ai.usage.input_tokens", rl.usage.PromptTokens),
+				tracing.Int("gen_ai.usage.output_tokens", rl.usage.CompletionTokens))
+		}
+		if rl.err != "" {
+			span.SetError(errors.New(rl.err))
+		}
+		span.End()
+	})
+}
+
+// startSpan starts an internal span for a step of the proxy pipeline
+func startSpan(ctx context.Context, name string, attrs ...tracing.Attr) (context.Context, *tracing.Span) {
+	return tracer.Start(ctx, name, tracing.KindInternal, attrs...)
+}
+
+// startUpstreamSpan starts the client span for a call to the upstream, with the
+// GenAI semantic convention attributes of the request
+func startUpstreamSpan(ctx context.Context, targetURL string, req DeepSeekRequest) (context.Context, *tracing.Span) {
+	attrs := []tracing.Attr{
+		tracing.String("gen_ai.system", "deepseek"),
+		tracing.String("gen_ai.operation.name", "chat"),
+		tracing.String("gen_ai.request.model", req.Model),
+		tracing.Bool("gen_ai.request.stream", req.Stream),
+	}
+	if req.MaxTokens > 0 {
+		attrs = append(attrs, tracing.Int("gen_ai.request.max_tokens", req.MaxTokens))
+	}
+	if req.Temperature != 0 {
+		attrs = append(attrs, tracing.Float("gen_ai.request.temperature", req.Temperature))
+	}
+	if u, err := url.Parse(targetURL); err == nil {
+		attrs = append(attrs, tracing.String("server.address", u.Hostname()))
+	}
+	return tracer.Start(ctx, "chat "+req.Model, tracing.KindClient, attrs...)
+}
+
+// tracedBody ends the upstream spans once the response body has been consumed
+type tracedBody struct {
+	io.ReadCloser
+	span       *tracing.Span
+	firstToken *tracing.Span
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.firstToken.End()
+	b.span.End()
+	return err
+}
+
+// upstreamSpans returns the spans send started for resp, nil when tracing is off
+func upstreamSpans(resp *http.Response) (span, firstToken *tracing.Span) {
+	if b, ok := resp.Body.(*tracedBody); ok {
+		return b.span, b.firstToken
+	}
+	return nil, nil
+}
+
+// traceResponse records the outcome of a completion on the upstream span
+func traceResponse(span *tracing.Span, resp *ChatResponse) {
+	if span == nil || resp == nil {
+		return
+	}
+	reasons := make([]string, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		reasons = append(reasons, choice.FinishReason)
+	}
+	span.SetAttributes(
+		tracing.String("gen_ai.response.id", resp.ID),
+		tracing.String("gen_ai.response.model", resp.Model),
+		tracing.Strings("gen_ai.response.finish_reasons", reasons))
+	traceUsage(span, resp.Usage)
+}
+
+// traceUsage records token counts on the upstream span
+func traceUsage(span *tracing.Span, usage Usage) {
+	span.SetAttributes(
+		tracing.Int("gen_ai.usage.input_tokens", usage.PromptTokens),
+		tracing.Int("gen_ai.usage.output_tokens", usage.CompletionTokens))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/mockupstream"
+	"cursor-deepseek/tracing"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// spanRecorder keeps exported spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(span tracing.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestTracing(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	spans := &spanRecorder{}
+	savedTracer := tracer
+	tracer = tracing.NewTracer(spans)
+	t.Cleanup(func() { tracer = savedTracer })
+	upstream.Enqueue(mockupstream.Reply{Content: "Hello there!", ChunkSize: 4})
+
+	clientParent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	readStream(t, post(t, proxy, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}]}`, "traceparent", clientParent))
+	proxy.Close()
+
+	byName := map[string]tracing.SpanData{}
+	for _, span := range spans.spans {
+		if span.Context.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("span %s is not part of the client's trace", span.Name)
+		}
+		byName[span.Name] = span
+	}
+	for _, name := range []string{"POST /v1/chat/completions", "authenticate", "parse_request", "convert_messages", "chat deepseek-chat", "time_to_first_token", "stream_response"} {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("no %s span, got %v", name, byName)
+		}
+	}
+	if got := byName["POST /v1/chat/completions"].Parent.String(); got != "b7ad6b7169203331" {
+		t.Errorf("server span parent %s", got)
+	}
+
+	upstreamSpan := byName["chat deepseek-chat"]
+	sent, ok := tracing.ParseTraceparent(upstream.Requests()[0].Header.Get("traceparent"))
+	if !ok || sent.SpanID != upstreamSpan.Context.SpanID {
+		t.Errorf("upstream got traceparent %+v, upstream span is %+v", sent, upstreamSpan.Context)
+	}
+	if byName["time_to_first_token"].End.After(upstreamSpan.End) {
+		t.Error("time to first token ends after the upstream call")
+	}
+}
+
+func TestShutdownExportsSpans(t *testing.T) {
+	if os.Getenv("TEST_SHUTDOWN") == "1" {
+		os.Exit(runCommand(nil, strings.NewReader(""), os.Stdout))
+	}
+	spans := make(chan string, 16)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		spans <- string(body)
+	}))
+	defer collector.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownExportsSpans$")
+	cmd.Env = append(os.Environ(), "TEST_SHUTDOWN=1", "CONFIG_FILE=", "LISTEN="+addr,
+		"DEEPSEEK_ENDPOINT=https://api.deepseek.com", "DEEPSEEK_CHAT_MODEL=deepseek-chat", "MODEL=gpt-4o", "SECRET="+testSecret,
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT="+collector.URL+"/v1/traces")
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	// One request leaves a span in the exporter's queue, which is only sent on a timer
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + "/v1/models")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy didn't start: %v\n%s", err, out.String())
+		}
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("proxy exited with %v\n%s", err, out.String())
+	}
+	select {
+	case body := <-spans:
+		if !strings.Contains(body, "/v1/models") {
+			t.Errorf("exported %s", body)
+		}
+	default:
+		t.Errorf("no spans were exported on shutdown\n%s", out.String())
+	}
+}
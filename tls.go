@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Certificate and key the proxy serves HTTPS with, plain HTTP without them
+var tlsCertFile, tlsKeyFile string
+
+// CA certificates client certificates are verified against, client
+// certificates aren't asked for without them
+var tlsClientCAFile string
+
+// Whether clients must present a certificate once TLS_CLIENT_CA_FILE is set
+var tlsClientAuth = tls.RequireAndVerifyClientCert
+
+func initTLS() {
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+	tlsClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatalf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsClientCAFile != "" && tlsCertFile == "" {
+		log.Fatalf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	switch auth := os.Getenv("TLS_CLIENT_AUTH"); auth {
+	case "require", "":
+	case "optional":
+		tlsClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		log.Fatalf("Invalid TLS_CLIENT_AUTH %q, use require or optional", auth)
+	}
+}
+
+// serverCertificates loads the TLS certificates and watches them for changes,
+// it returns nil when the proxy serves plain HTTP
+func serverCertificates() (*certificates, error) {
+	if tlsCertFile == "" {
+		return nil, nil
+	}
+	certs := &certificates{certFile: tlsCertFile, keyFile: tlsKeyFile, clientCAFile: tlsClientCAFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	go certs.watch()
+	return certs, nil
+}
+
+// newServer returns a server for handler: HTTPS with HTTP/2 with certs, and plain
+// HTTP that also accepts HTTP/2 without TLS (h2c) without them
+func newServer(handler http.Handler, certs *certificates) (*http.Server, error) {
+	server := &http.Server{Handler: handler}
+	if certs == nil {
+		server.Handler = h2c.NewHandler(handler, &http2.Server{})
+		return server, nil
+	}
+	server.TLSConfig = certs.tlsConfig()
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// certificates holds the server certificate and client CAs, reloaded when their
+// files change so certificates can be rotated without a restart
+type certificates struct {
+	certFile, keyFile, clientCAFile string
+
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// load reads the certificate files, keeping the ones loaded before on error
+func (c *certificates) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading TLS_CLIENT_CA_FILE: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("error loading TLS_CLIENT_CA_FILE: no certificates found")
+		}
+	}
+	c.cert.Store(&cert)
+	c.clientCAs.Store(pool)
+	return nil
+}
+
+// tlsConfig returns a configuration that picks up reloaded certificates on new connections
+func (c *certificates) tlsConfig() *tls.Config {
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return c.cert.Load(), nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{"h2", "http/1.1"},
+				GetCertificate: getCertificate,
+			}
+			if pool := c.clientCAs.Load(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tlsClientAuth
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// watch reloads the certificates on SIGHUP and when one of their files changes
+func (c *certificates) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modified := c.modTime()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			t := c.modTime()
+			if t.Equal(modified) {
+				continue
+			}
+			modified = t
+		}
+		if err := c.load(); err != nil {
+			errorLog("%v, keeping the current certificates", err)
+			continue
+		}
+		infoLog("Reloaded TLS certificates from %s", c.certFile)
+	}
+}
+
+// modTime returns the latest modification time of the certificate files
+func (c *certificates) modTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		if t := configModTime(path); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// clientCertKey returns the client key a verified client certificate is mapped to.
+// Certificates match by their subject's common name, DNS names or email addresses.
+func (c *Config) clientCertKey(state *tls.ConnectionState) *ClientKey {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := state.VerifiedChains[0][0]
+	ids := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	for _, id := range append(ids, leaf.EmailAddresses...) {
+		if key, ok := c.clientCerts[id]; ok && id != "" {
+			return key
+		}
+	}
+	return nil
+}
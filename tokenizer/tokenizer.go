@@ -0,0 +1,100 @@
+// Package tokenizer estimates how many tokens a text takes without the model's
+// vocabulary. Estimates are meant for pre-flight checks against context windows,
+// so they err on the high side.
+package tokenizer
+
+import (
+	"fmt"
+	"math"
+	"unicode"
+)
+
+// Estimator counts the tokens of a text
+type Estimator interface {
+	Count(text string) int
+}
+
+// New returns the estimator with the given name: "pieces" or "chars"
+func New(name string) (Estimator, error) {
+	switch name {
+	case "pieces", "":
+		return Pieces{}, nil
+	case "chars":
+		return DeepSeekChars, nil
+	}
+	return nil, fmt.Errorf("unknown tokenizer %q, use pieces or chars", name)
+}
+
+// Pieces splits text the way BPE pre-tokenizers do, into words, numbers, whitespace
+// and symbols, and estimates each piece. It does well on source code, where runs of
+// indentation and punctuation make character ratios unreliable.
+type Pieces struct{}
+
+func (Pieces) Count(text string) int {
+	tokens := 0.0
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		j := i + 1
+		switch {
+		case isCJK(r):
+			// Ideographs and kana are about half to one token each
+			tokens += 0.6
+		case unicode.IsLetter(r):
+			for j < len(runes) && unicode.IsLetter(runes[j]) && !isCJK(runes[j]) {
+				j++
+			}
+			// Common words are one token, longer ones a token per four letters or so
+			tokens += math.Ceil(float64(j-i) / 4)
+		case unicode.IsDigit(r):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			// Numbers are split into groups of up to three digits
+			tokens += math.Ceil(float64(j-i) / 3)
+		case r == '\n' || r == '\r':
+			for j < len(runes) && (runes[j] == '\n' || runes[j] == '\r') {
+				j++
+			}
+			tokens++
+		case unicode.IsSpace(r):
+			for j < len(runes) && unicode.IsSpace(runes[j]) && runes[j] != '\n' && runes[j] != '\r' {
+				j++
+			}
+			// A single space merges into the following word, indentation is a token of its own
+			if j-i > 1 {
+				tokens++
+			}
+		default:
+			tokens++
+		}
+		i = j
+	}
+	return int(math.Ceil(tokens))
+}
+
+// Chars estimates tokens from character counts, with separate ratios for CJK text
+type Chars struct {
+	PerChar    float64
+	PerCJKChar float64
+}
+
+// DeepSeekChars uses the ratios DeepSeek documents: about 0.3 tokens per English
+// character and 0.6 per Chinese character
+var DeepSeekChars = Chars{PerChar: 0.3, PerCJKChar: 0.6}
+
+func (c Chars) Count(text string) int {
+	tokens := 0.0
+	for _, r := range text {
+		if isCJK(r) {
+			tokens += c.PerCJKChar
+		} else {
+			tokens += c.PerChar
+		}
+	}
+	return int(math.Ceil(tokens))
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
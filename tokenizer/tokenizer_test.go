@@ -0,0 +1,58 @@
+package tokenizer
+
+import "testing"
+
+func TestPieces(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     int
+	}{
+		{"empty", "", 0},
+		{"word", "hello", 2},
+		{"words", "the cat sat", 3},
+		{"long word", "internationalization", 5},
+		{"number", "1234567", 3},
+		{"symbols", "a+b;", 4},
+		{"newlines", "a\n\n\nb", 3},
+		{"indentation", "\t\treturn", 3},
+		{"cjk", "你好世界", 3},
+		{"mixed", "数据data", 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (Pieces{}).Count(tc.in); got != tc.want {
+				t.Errorf("Pieces.Count(%q) = %d, want %d", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChars(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     int
+	}{
+		{"empty", "", 0},
+		{"english", "hello world", 4},
+		{"cjk", "你好", 2},
+		{"mixed", "hi你好", 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DeepSeekChars.Count(tc.in); got != tc.want {
+				t.Errorf("DeepSeekChars.Count(%q) = %d, want %d", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for name, want := range map[string]Estimator{"": Pieces{}, "pieces": Pieces{}, "chars": DeepSeekChars} {
+		if got, err := New(name); err != nil || got != want {
+			t.Errorf("New(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := New("tiktoken"); err == nil {
+		t.Error("expected an unknown tokenizer to be rejected")
+	}
+}
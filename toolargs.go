@@ -0,0 +1,116 @@
+package main
+
+import (
+	"cursor-deepseek/jsonrepair"
+	"cursor-deepseek/jsonschema"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// repairToolCall fixes malformed arguments of tc in place and validates them
+// against the parameters schema of the matching tool
+func repairToolCall(rl *requestLog, tc *ToolCall, tools []Tool) error {
+	var params interface{}
+	found := false
+	for _, tool := range tools {
+		if tool.Function.Name == tc.Function.Name {
+			params = tool.Function.Parameters
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("function `%s` does not exist", tc.Function.Name)
+	}
+
+	if !json.Valid([]byte(tc.Function.Arguments)) {
+		repaired, err := jsonrepair.Repair(tc.Function.Arguments)
+		if err != nil {
+			return fmt.Errorf("arguments for `%s` are not valid JSON", tc.Function.Name)
+		}
+		rl.debugf("Repaired arguments for %s: %s", tc.Function.Name, truncateString(repaired, 200))
+		tc.Function.Arguments = repaired
+	}
+
+	var args interface{}
+	if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+		return fmt.Errorf("arguments for `%s` are not valid JSON", tc.Function.Name)
+	}
+	var schemaErr *jsonschema.SchemaError
+	if err := jsonschema.Validate(params, args); errors.As(err, &schemaErr) {
+		// The model can't fix the client's schema, so the arguments are passed on unchecked
+		errorLog("Not validating arguments for %s: %v", tc.Function.Name, err)
+	} else if err != nil {
+		return fmt.Errorf("arguments for `%s` do not match its parameters schema: %v", tc.Function.Name, err)
+	}
+	return nil
+}
+
+// checkToolArguments repairs the tool calls of every choice and reports those still invalid
+func checkToolArguments(rl *requestLog, tools []Tool) responseCheck {
+	return func(resp *ChatResponse) error {
+		var problems []string
+		for i := range resp.Choices {
+			toolCalls := resp.Choices[i].Message.ToolCalls
+			for j := range toolCalls {
+				if err := repairToolCall(rl, &toolCalls[j], tools); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%s", strings.Join(problems, "; "))
+		}
+		return nil
+	}
+}
+
+// toolArgumentsCheck returns the tool call check for the configured TOOL_ARGS_VALIDATION mode.
+// Only "reask" mode fails the check, "repair" mode fixes what it can and logs the rest.
+func toolArgumentsCheck(rl *requestLog, tools []Tool) responseCheck {
+	if len(tools) == 0 || toolArgsMode == "off" {
+		return nil
+	}
+	check := checkToolArguments(rl, tools)
+	if toolArgsMode == "reask" {
+		return check
+	}
+	return func(resp *ChatResponse) error {
+		if err := check(resp); err != nil {
+			errorLog("Tool call arguments still invalid after repair: %v", err)
+		}
+		return nil
+	}
+}
+
+// chainChecks runs checks in order and stops at the first failure, nil checks are skipped
+func chainChecks(checks ...responseCheck) responseCheck {
+	return func(resp *ChatResponse) error {
+		for _, check := range checks {
+			if check == nil {
+				continue
+			}
+			if err := check(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// handleCheckedCompletion buffers the upstream reply, validates it and re-asks the model
+// until it passes, then sends it to the client as JSON or as an SSE stream and returns it
+func handleCheckedCompletion(w http.ResponseWriter, px *proxyRequest, req DeepSeekRequest, retries int, check responseCheck, stream, includeUsage bool) *ChatResponse {
+	resp, err := px.completeWithRetries(req, retries, check)
+	if err != nil {
+		handleCompletionError(w, px.log(), err)
+		return nil
+	}
+	_, span := startSpan(px.r.Context(), "translate_response")
+	writeChatResponse(w, px.log(), resp, px.route.Model, stream, includeUsage)
+	span.End()
+	return resp
+}
@@ -0,0 +1,159 @@
+package main
+
+import "fmt"
+
+// Content of the tool result added for a call the client never answered
+const missingToolResult = "No result was returned for this tool call."
+
+// repairToolPairing makes every assistant tool call directly followed by its result, in call order.
+// Missing results get a placeholder, results without a matching call are dropped and calls without
+// an ID get one, since DeepSeek rejects histories with dangling or reordered tool results.
+func repairToolPairing(rl *requestLog, messages []Message) []Message {
+	// Assign missing IDs first so results can be matched against every call
+	callIDs := make(map[string]bool)
+	for i := range messages {
+		if messages[i].Role != "assistant" || len(messages[i].ToolCalls) == 0 {
+			continue
+		}
+		toolCalls := append([]ToolCall(nil), messages[i].ToolCalls...)
+		for j := range toolCalls {
+			if toolCalls[j].ID == "" {
+				toolCalls[j].ID = newToolCallID()
+				rl.debugf("Assigned ID %s to tool call %s in message %d", toolCalls[j].ID, toolCalls[j].Function.Name, i)
+			}
+			callIDs[toolCalls[j].ID] = true
+		}
+		messages[i].ToolCalls = toolCalls
+	}
+
+	// Collect the results by the ID of the call they answer
+	results := make(map[string]Message)
+	for i, msg := range messages {
+		if msg.Role != "tool" {
+			continue
+		}
+		id := msg.ToolCallID
+		if id == "" {
+			id = matchToolResultByName(messages[:i], msg.Name, results)
+		}
+		if !callIDs[id] {
+			rl.debugf("Dropping tool result %d without a matching tool call: %q", i, msg.ToolCallID)
+			continue
+		}
+		if _, seen := results[id]; seen {
+			rl.debugf("Dropping duplicate tool result %d for tool call %s", i, id)
+			continue
+		}
+		msg.ToolCallID = id
+		results[id] = msg
+	}
+
+	repaired := make([]Message, 0, len(messages))
+	used := make(map[string]bool)
+	for _, msg := range messages {
+		// Results are added right after their call
+		if msg.Role == "tool" {
+			continue
+		}
+		repaired = append(repaired, msg)
+		if msg.Role != "assistant" {
+			continue
+		}
+
+		for _, tc := range msg.ToolCalls {
+			result, ok := results[tc.ID]
+			if !ok || used[tc.ID] {
+				rl.debugf("Adding placeholder result for tool call %s (%s)", tc.ID, tc.Function.Name)
+				result = Message{Role: "tool", ToolCallID: tc.ID, Content: missingToolResult}
+			}
+			used[tc.ID] = true
+			repaired = append(repaired, result)
+		}
+	}
+	return repaired
+}
+
+// matchToolResultByName finds the latest unanswered call to name for a result without a tool_call_id
+func matchToolResultByName(previous []Message, name string, results map[string]Message) string {
+	for i := len(previous) - 1; i >= 0; i-- {
+		if previous[i].Role != "assistant" {
+			continue
+		}
+		for _, tc := range previous[i].ToolCalls {
+			if _, answered := results[tc.ID]; !answered && (name == "" || tc.Function.Name == name) {
+				return tc.ID
+			}
+		}
+	}
+	return ""
+}
+
+// normalizeToolCalls returns a check that gives every tool call a unique ID and,
+// when parallel calls are disabled, keeps only the first call of each choice
+func normalizeToolCalls(rl *requestLog, parallel bool) responseCheck {
+	return func(resp *ChatResponse) error {
+		seen := make(map[string]bool)
+		for i := range resp.Choices {
+			msg := &resp.Choices[i].Message
+			if !parallel && len(msg.ToolCalls) > 1 {
+				rl.debugf("Dropping %d parallel tool calls in choice %d", len(msg.ToolCalls)-1, i)
+				msg.ToolCalls = msg.ToolCalls[:1]
+			}
+			for j := range msg.ToolCalls {
+				tc := &msg.ToolCalls[j]
+				if tc.ID == "" || seen[tc.ID] {
+					tc.ID = newToolCallID()
+				}
+				if tc.Type == "" {
+					tc.Type = "function"
+				}
+				seen[tc.ID] = true
+			}
+		}
+		return nil
+	}
+}
+
+// toolCallIDFilter is the streaming counterpart of normalizeToolCalls
+type toolCallIDFilter struct {
+	parallel bool
+	ids      map[string]string // Assigned IDs by choice and tool call index
+	seen     map[string]bool
+}
+
+func newToolCallIDFilter(parallel bool) *toolCallIDFilter {
+	return &toolCallIDFilter{parallel: parallel, ids: make(map[string]string), seen: make(map[string]bool)}
+}
+
+func (f *toolCallIDFilter) Filter(chunk *ChatChunk) []*ChatChunk {
+	for i := range chunk.Choices {
+		choice := &chunk.Choices[i]
+		toolCalls := choice.Delta.ToolCalls[:0]
+		for _, tc := range choice.Delta.ToolCalls {
+			if !f.parallel && tc.Index > 0 {
+				continue
+			}
+			key := fmt.Sprintf("%d/%d", choice.Index, tc.Index)
+			if _, started := f.ids[key]; !started {
+				// The first fragment of a call carries its ID
+				if tc.ID == "" || f.seen[tc.ID] {
+					tc.ID = newToolCallID()
+				}
+				if tc.Type == "" {
+					tc.Type = "function"
+				}
+				f.ids[key] = tc.ID
+				f.seen[tc.ID] = true
+			} else if tc.ID != "" {
+				tc.ID = f.ids[key]
+			}
+			toolCalls = append(toolCalls, tc)
+		}
+		choice.Delta.ToolCalls = toolCalls
+	}
+	return []*ChatChunk{chunk}
+}
+
+func (f *toolCallIDFilter) Flush() []*ChatChunk {
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// toolChoice is the parsed OpenAI tool_choice parameter
+type toolChoice struct {
+	Mode     string // "auto", "none", "required", "function" or empty when unset
+	Function string // Name of the function to call when Mode is "function"
+}
+
+func parseToolChoice(choice interface{}) toolChoice {
+	if choice == nil {
+		return toolChoice{}
+	}
+
+	// If string "auto", "none" or "required"
+	if str, ok := choice.(string); ok {
+		switch str {
+		case "auto", "none", "required":
+			return toolChoice{Mode: str}
+		}
+	}
+
+	// Try to parse as map for function call: {"type": "function", "function": {"name": "..."}}
+	if choiceMap, ok := choice.(map[string]interface{}); ok {
+		if choiceMap["type"] == "function" {
+			if fn, ok := choiceMap["function"].(map[string]interface{}); ok {
+				if name, ok := fn["name"].(string); ok && name != "" {
+					return toolChoice{Mode: "function", Function: name}
+				}
+			}
+			return toolChoice{Mode: "auto"}
+		}
+	}
+
+	return toolChoice{}
+}
+
+// upstream returns the tool_choice value sent to DeepSeek
+func (c toolChoice) upstream() string {
+	switch c.Mode {
+	case "auto", "none":
+		return c.Mode
+	case "required", "function":
+		return "auto" // DeepSeek doesn't support forcing tool calls, emulated by the proxy
+	}
+	return ""
+}
+
+// forced reports whether the client requires a tool call in the reply
+func (c toolChoice) forced() bool {
+	return c.Mode == "required" || c.Mode == "function"
+}
+
+// applyToolChoice narrows the tools to the forced function and tells the model it has to call it
+func applyToolChoice(req *DeepSeekRequest, c toolChoice) error {
+	var instruction string
+	switch c.Mode {
+	case "function":
+		var tools []Tool
+		for _, tool := range req.Tools {
+			if tool.Function.Name == c.Function {
+				tools = append(tools, tool)
+			}
+		}
+		if len(tools) == 0 {
+			return fmt.Errorf("tool_choice function %q is not in tools", c.Function)
+		}
+		req.Tools = tools
+		instruction = fmt.Sprintf("You must respond by calling the function `%s`. Do not answer with plain text.", c.Function)
+	case "required":
+		instruction = "You must respond by calling one or more of the provided tools. Do not answer with plain text."
+	default:
+		return nil
+	}
+
+	req.ToolChoice = c.upstream()
+	req.Messages = addSystemInstruction(req.Messages, instruction)
+	return nil
+}
+
+// enforceToolChoice returns a check that rejects replies without the required tool call
+func enforceToolChoice(c toolChoice) responseCheck {
+	return func(resp *ChatResponse) error {
+		if len(resp.Choices) == 0 {
+			return fmt.Errorf("the reply has no choices")
+		}
+		for i := range resp.Choices {
+			msg := &resp.Choices[i].Message
+			if c.Mode == "function" {
+				// Drop calls to other functions the model may have added
+				toolCalls := msg.ToolCalls[:0]
+				for _, tc := range msg.ToolCalls {
+					if tc.Function.Name == c.Function {
+						toolCalls = append(toolCalls, tc)
+					}
+				}
+				msg.ToolCalls = toolCalls
+				if len(toolCalls) == 0 {
+					return fmt.Errorf("you must call the function `%s`", c.Function)
+				}
+			} else if len(msg.ToolCalls) == 0 {
+				return fmt.Errorf("you must call one of the provided tools")
+			}
+			resp.Choices[i].FinishReason = "tool_calls"
+		}
+		return nil
+	}
+}
+
+// addSystemInstruction appends text to the leading system message, adding one if there is none
+func addSystemInstruction(messages []Message, text string) []Message {
+	if len(messages) > 0 && messages[0].Role == "system" {
+		result := append([]Message(nil), messages...)
+		result[0].Content = strings.TrimSpace(result[0].Content + "\n\n" + text)
+		return result
+	}
+	return append([]Message{{Role: "system", Content: text}}, messages...)
+}
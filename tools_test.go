@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cursor-deepseek/mockupstream"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestForcedToolChoice(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(
+		mockupstream.Reply{Content: "I'd rather just answer."},
+		mockupstream.Reply{ToolCalls: []mockupstream.ToolCall{{ID: "call_1", Name: "read_file", Arguments: `{"path":"main.go"}`}}},
+	)
+
+	body := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}],"tools":` + toolsJSON + `,"tool_choice":{"type":"function","function":{"name":"read_file"}}}`
+	streamed := readStream(t, post(t, proxy, body))
+	calls := streamed.Choices[0].Message.ToolCalls
+	if len(calls) != 1 || calls[0].Function.Name != "read_file" {
+		t.Fatalf("got tool calls %+v", calls)
+	}
+
+	reqs := upstream.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("upstream got %d requests, want a retry", len(reqs))
+	}
+	var sent DeepSeekRequest
+	json.Unmarshal(reqs[0].Body, &sent)
+	if len(sent.Tools) != 1 || sent.Tools[0].Function.Name != "read_file" || sent.ToolChoice != "auto" || sent.Stream {
+		t.Errorf("upstream got tools %+v tool_choice %q stream %v", sent.Tools, sent.ToolChoice, sent.Stream)
+	}
+}
+
+func TestToolArgumentsRepair(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	upstream.Enqueue(mockupstream.Reply{
+		ToolCalls: []mockupstream.ToolCall{{ID: "call_1", Name: "read_file", Arguments: `{path: 'main.go',`}},
+		ChunkSize: 5,
+	})
+
+	body := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}],"tools":` + toolsJSON + `}`
+	streamed := readStream(t, post(t, proxy, body))
+	calls := streamed.Choices[0].Message.ToolCalls
+	if len(calls) != 1 || calls[0].Function.Arguments != `{"path": "main.go"}` {
+		t.Fatalf("got tool calls %+v", calls)
+	}
+}
+
+func TestToolArgumentsReask(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	toolArgsMode = "reask"
+	upstream.Enqueue(
+		mockupstream.Reply{ToolCalls: []mockupstream.ToolCall{{ID: "call_1", Name: "read_file", Arguments: `{"file":"main.go"}`}}},
+		mockupstream.Reply{ToolCalls: []mockupstream.ToolCall{{ID: "call_2", Name: "read_file", Arguments: `{"path":"main.go"}`}}},
+	)
+
+	resp := decodeResponse(t, post(t, proxy, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"tools":`+toolsJSON+`}`))
+	if got := resp.Choices[0].Message.ToolCalls[0].ID; got != "call_2" {
+		t.Errorf("got tool call %s, want the retried one", got)
+	}
+	reqs := upstream.Requests()
+	if len(reqs) != 2 || !strings.Contains(string(reqs[1].Body), "missing required property") {
+		t.Fatalf("retry did not include the validation error")
+	}
+	// The rejected call is answered, the upstream refuses calls without results
+	if !strings.Contains(string(reqs[1].Body), `"tool_call_id":"call_1"`) {
+		t.Errorf("rejected tool call left without a result: %s", reqs[1].Body)
+	}
+}
+
+func TestPromptedTools(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+	cfg := *currentConfig()
+	cfg.Routes = []Route{
+		{Model: "gpt-4o", UpstreamModel: "deepseek-chat", PromptedTools: true},
+		{Model: "native", UpstreamModel: "deepseek-chat"},
+	}
+	useConfig(t, &cfg)
+	upstream.Enqueue(mockupstream.Reply{
+		Content:   "Let me look.\n<tool_call>\n{\"name\": \"read_file\", \"arguments\": {\"path\": \"main.go\"}}\n</tool_call>",
+		ChunkSize: 7,
+	})
+
+	body := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Hi"}],"tools":` + toolsJSON + `}`
+	streamed := readStream(t, post(t, proxy, body))
+	choice := streamed.Choices[0]
+	if choice.Message.Content != "Let me look.\n" || choice.FinishReason != "tool_calls" {
+		t.Errorf("got content %q finish reason %q", choice.Message.Content, choice.FinishReason)
+	}
+	if calls := choice.Message.ToolCalls; len(calls) != 1 || calls[0].Function.Name != "read_file" || calls[0].ID == "" {
+		t.Errorf("got tool calls %+v", calls)
+	}
+
+	sent := upstream.Requests()[0].JSON()
+	if _, ok := sent["tools"]; ok {
+		t.Error("upstream got the tools field")
+	}
+
+	// Other routes keep native tools
+	decodeResponse(t, post(t, proxy, `{"model":"native","messages":[{"role":"user","content":"Hi"}],"tools":`+toolsJSON+`}`))
+	if _, ok := upstream.Requests()[1].JSON()["tools"]; !ok {
+		t.Error("native route didn't get the tools field")
+	}
+}
+
+func TestToolHistoryRepair(t *testing.T) {
+	proxy, upstream := newTestProxy(t)
+
+	body := `{"model":"gpt-4o","messages":[
+		{"role":"user","content":"Hi"},
+		{"role":"assistant","content":"","tool_calls":[
+			{"id":"a","type":"function","function":{"name":"read_file","arguments":"{}"}},
+			{"id":"b","type":"function","function":{"name":"list_dir","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"b","content":"dir"},
+		{"role":"tool","tool_call_id":"zzz","content":"orphan"},
+		{"role":"user","content":"Thanks"}]}`
+	decodeResponse(t, post(t, proxy, body))
+
+	var sent DeepSeekRequest
+	json.Unmarshal(upstream.Requests()[0].Body, &sent)
+	var roles []string
+	for _, msg := range sent.Messages {
+		roles = append(roles, msg.Role+":"+msg.ToolCallID)
+	}
+	if got := strings.Join(roles, ","); got != "user:,assistant:,tool:a,tool:b,user:" {
+		t.Errorf("got messages %s", got)
+	}
+}
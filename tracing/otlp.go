@@ -0,0 +1,225 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPExporter batches spans and posts them to an OTLP/HTTP endpoint in the JSON encoding
+type OTLPExporter struct {
+	url      string
+	client   *http.Client
+	resource []Attr
+
+	queue chan SpanData
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+const (
+	otlpQueueSize = 2048
+	otlpBatchSize = 256
+	otlpInterval  = 5 * time.Second
+)
+
+// NewOTLPExporter exports to url, usually http://localhost:4318/v1/traces, with
+// service.name set to service. Spans are dropped when the collector can't keep up.
+func NewOTLPExporter(url, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		resource: []Attr{String("service.name", service)},
+		queue:    make(chan SpanData, otlpQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) ExportSpan(span SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+// Shutdown sends the queued spans and stops the exporter
+func (e *OTLPExporter) Shutdown(ctx context.Context) {
+	e.once.Do(func() {
+		flushed := make(chan struct{})
+		select {
+		case e.flush <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+		close(e.done)
+	})
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	var batch []SpanData
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.post(batch); err != nil {
+				log.Printf("Error exporting %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) post(spans []SpanData) error {
+	body, err := json.Marshal(encodeTraces(e.resource, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, see opentelemetry-proto's trace.proto
+
+type otlpValue map[string]interface{}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func encodeTraces(resource []Attr, spans []SpanData) map[string]interface{} {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: unixNano(s.Start),
+			EndTimeUnixNano:   unixNano(s.End),
+			Attributes:        encodeAttrs(s.Attrs),
+		}
+		if s.Parent != (SpanID{}) {
+			span.ParentSpanID = s.Parent.String()
+		}
+		for _, ev := range s.Events {
+			span.Events = append(span.Events, otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name, Attributes: encodeAttrs(ev.Attrs)})
+		}
+		if s.Error {
+			span.Status = otlpStatus{Code: 2, Message: s.StatusMsg}
+		}
+		encoded[i] = span
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": encodeAttrs(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "cursor-deepseek"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func encodeAttrs(attrs []Attr) []otlpKeyValue {
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		encoded = append(encoded, otlpKeyValue{Key: a.Key, Value: encodeValue(a.Value)})
+	}
+	return encoded
+}
+
+func encodeValue(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{"stringValue": v}
+	case bool:
+		return otlpValue{"boolValue": v}
+	case int64:
+		// 64-bit integers are strings in the JSON encoding
+		return otlpValue{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return otlpValue{"doubleValue": v}
+	case []string:
+		values := make([]otlpValue, len(v))
+		for i, s := range v {
+			values[i] = otlpValue{"stringValue": s}
+		}
+		return otlpValue{"arrayValue": map[string]interface{}{"values": values}}
+	}
+	return otlpValue{"stringValue": fmt.Sprint(v)}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,221 @@
+// Package tracing records spans with W3C trace context propagation and exports them
+// to an OpenTelemetry collector. It covers what the proxy needs without pulling in the
+// OpenTelemetry SDK: spans are nil-safe, so a nil *Tracer disables tracing entirely.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(s string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	// Version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+type SpanKind int
+
+// Values match the OTLP span kinds
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// Attr is a span attribute, values are strings, bools, ints, floats or string slices
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attr           { return Attr{key, value} }
+func Int(key string, value int) Attr          { return Attr{key, int64(value)} }
+func Float(key string, value float64) Attr    { return Attr{key, value} }
+func Bool(key string, value bool) Attr        { return Attr{key, value} }
+func Strings(key string, value []string) Attr { return Attr{key, value} }
+
+type Event struct {
+	Name  string
+	Time  time.Time
+	Attrs []Attr
+}
+
+// SpanData is a finished span as handed to the exporter
+type SpanData struct {
+	Name      string
+	Kind      SpanKind
+	Context   SpanContext
+	Parent    SpanID
+	Start     time.Time
+	End       time.Time
+	Attrs     []Attr
+	Events    []Event
+	Error     bool
+	StatusMsg string
+}
+
+// Exporter receives finished, sampled spans
+type Exporter interface {
+	ExportSpan(SpanData)
+}
+
+// Tracer starts spans and hands them to its exporter when they end
+type Tracer struct {
+	exporter Exporter
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Span is an operation in progress. All methods are safe on a nil span.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SpanFromContext returns the current span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent makes spans started from ctx children of a span in another process
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start begins a span as a child of the span in ctx, or of a remote parent
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attr) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Start: time.Now(), Attrs: attrs}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.data.Context.TraceID = parent.data.Context.TraceID
+		span.data.Context.Sampled = parent.data.Context.Sampled
+		span.data.Parent = parent.data.Context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.IsValid() {
+		span.data.Context.TraceID = remote.TraceID
+		span.data.Context.Sampled = remote.Sampled
+		span.data.Parent = remote.SpanID
+	} else {
+		rand.Read(span.data.Context.TraceID[:])
+		span.data.Context.Sampled = true
+	}
+	rand.Read(span.data.Context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Context returns the span's identity, the zero SpanContext for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attrs = append(s.data.Attrs, attrs...)
+}
+
+func (s *Span) AddEvent(name string, attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, Event{Name: name, Time: time.Now(), Attrs: attrs})
+}
+
+// SetError marks the span as failed, a nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+	s.data.StatusMsg = err.Error()
+}
+
+// End finishes the span, only the first call has an effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.Context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
@@ -0,0 +1,143 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(valid)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("got %+v, %v", sc, ok)
+	}
+	if sc.Traceparent() != valid {
+		t.Errorf("formatted as %s", sc.Traceparent())
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(s); ok {
+			t.Errorf("accepted %q", s)
+		}
+	}
+	// Later versions may add fields
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Error("rejected a later version")
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "request", KindServer)
+	_, client := tracer.Start(ctx, "upstream", KindClient, String("model", "deepseek-chat"))
+	client.SetError(errors.New("timeout"))
+	client.End()
+	client.End()
+	server.End()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %d spans", len(exporter.spans))
+	}
+	child, parent := exporter.spans[0], exporter.spans[1]
+	if parent.Context.TraceID != remote.TraceID || parent.Parent != remote.SpanID {
+		t.Errorf("server span isn't a child of the remote parent: %+v", parent)
+	}
+	if child.Context.TraceID != remote.TraceID || child.Parent != parent.Context.SpanID || !child.Error || child.StatusMsg != "timeout" {
+		t.Errorf("got client span %+v", child)
+	}
+
+	// Unsampled traces aren't exported
+	remote.Sampled = false
+	_, span := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "request", KindServer)
+	span.End()
+	if len(exporter.spans) != 2 {
+		t.Error("exported an unsampled span")
+	}
+
+	// A nil tracer disables tracing
+	var disabled *Tracer
+	ctx, span = disabled.Start(context.Background(), "request", KindServer)
+	span.SetAttributes(Int("n", 1))
+	span.AddEvent("retry")
+	span.SetError(errors.New("failed"))
+	span.End()
+	if SpanFromContext(ctx) != nil || span.Context().IsValid() {
+		t.Error("a nil tracer started a span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "proxy")
+	_, span := NewTracer(exporter).Start(context.Background(), "request", KindServer, Int("status", 200), Strings("tools", []string{"read"}))
+	span.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Shutdown sends the spans still queued
+	exporter.Shutdown(ctx)
+
+	select {
+	case data := <-bodies:
+		var decoded struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []otlpKeyValue `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(data, &decoded); err != nil || len(decoded.ResourceSpans) != 1 {
+			t.Fatalf("got %s, %v", data, err)
+		}
+		resource := decoded.ResourceSpans[0]
+		if len(resource.Resource.Attributes) != 1 || resource.Resource.Attributes[0].Value["stringValue"] != "proxy" {
+			t.Errorf("got resource %+v", resource.Resource)
+		}
+		spans := resource.ScopeSpans[0].Spans
+		if len(spans) != 1 || spans[0].Name != "request" || spans[0].Kind != KindServer || spans[0].ParentSpanID != "" {
+			t.Fatalf("got spans %+v", spans)
+		}
+		if attrs := spans[0].Attributes; len(attrs) != 2 || attrs[0].Value["intValue"] != "200" {
+			t.Errorf("got attributes %+v", attrs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans were exported")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cursor-deepseek/tokenizer"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Strategies applied in order when a conversation doesn't fit the context window
+// and CONTEXT_OVERFLOW is "trim", until it fits
+var trimStrategies = []string{"tool_outputs", "oldest_turns"}
+
+// Tool outputs are cut down to about this many tokens by the tool_outputs strategy
+var trimToolOutputTokens = 1000
+
+// A trimming strategy shortens messages towards budget tokens. It gets the request
+// being trimmed for strategies that call the upstream.
+type trimStrategy func(px *proxyRequest, messages []Message, budget int) []Message
+
+var trimStrategyFuncs = map[string]trimStrategy{
+	"tool_outputs": truncateToolOutputs,
+	"summarize":    summarizeOldest,
+	"oldest_turns": dropOldestTurns,
+}
+
+func initTrimming() {
+	if strategies := os.Getenv("TRIM_STRATEGIES"); strategies != "" {
+		trimStrategies = nil
+		for _, name := range strings.Split(strategies, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := trimStrategyFuncs[name]; !ok {
+				log.Fatalf("Invalid TRIM_STRATEGIES entry %q, use tool_outputs, summarize or oldest_turns", name)
+			}
+			trimStrategies = append(trimStrategies, name)
+		}
+	}
+	if tokens := os.Getenv("TRIM_TOOL_OUTPUT_TOKENS"); tokens != "" {
+		n, err := strconv.Atoi(tokens)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid TRIM_TOOL_OUTPUT_TOKENS %q", tokens)
+		}
+		trimToolOutputTokens = n
+	}
+}
+
+// trimToBudget applies the configured strategies until the messages fit budget tokens
+func trimToBudget(px *proxyRequest, messages []Message, budget int) []Message {
+	for _, name := range trimStrategies {
+		if messagesTokens(px.estimator(), messages) <= budget {
+			break
+		}
+		before := len(messages)
+		messages = trimStrategyFuncs[name](px, messages, budget)
+		px.log().debugf("Trimmed with %s: %d messages left of %d, about %d tokens", name, len(messages), before, messagesTokens(px.estimator(), messages))
+	}
+	return messages
+}
+
+// truncateToolOutputs cuts tool results longer than TRIM_TOOL_OUTPUT_TOKENS down to
+// their start and end, oldest first, leaving a marker where text was removed. The
+// results of the latest tool calls are left for last.
+func truncateToolOutputs(px *proxyRequest, messages []Message, budget int) []Message {
+	est := px.estimator()
+	total := messagesTokens(est, messages)
+	var trimmed []Message
+	for i := range messages {
+		if total <= budget {
+			break
+		}
+		msg := messages[i]
+		if msg.Role != "tool" {
+			continue
+		}
+		tokens := est.Count(msg.Content)
+		if tokens <= trimToolOutputTokens {
+			continue
+		}
+		if trimmed == nil {
+			trimmed = append([]Message(nil), messages...)
+		}
+		trimmed[i].Content = truncateMiddle(msg.Content, len(msg.Content)*trimToolOutputTokens/tokens)
+		total -= tokens - est.Count(trimmed[i].Content)
+	}
+	if trimmed == nil {
+		return messages
+	}
+	return trimmed
+}
+
+// truncateMiddle keeps about keep bytes of s, two thirds from the start and the rest
+// from the end, cutting at line breaks where it can
+func truncateMiddle(s string, keep int) string {
+	if len(s) <= keep {
+		return s
+	}
+	head := keep * 2 / 3
+	tail := keep - head
+	if i := strings.LastIndexByte(s[:head], '\n'); i > head/2 {
+		head = i + 1
+	}
+	tailStart := len(s) - tail
+	if i := strings.IndexByte(s[tailStart:], '\n'); i >= 0 && i < tail/2 {
+		tailStart += i + 1
+	}
+	// Stay on UTF-8 boundaries
+	for head > 0 && head < len(s) && s[head]&0xC0 == 0x80 {
+		head--
+	}
+	for tailStart < len(s) && s[tailStart]&0xC0 == 0x80 {
+		tailStart++
+	}
+	return fmt.Sprintf("%s\n[... %d characters of tool output removed by the proxy to fit the context window ...]\n%s",
+		s[:head], tailStart-head, s[tailStart:])
+}
+
+// dropOldestTurns removes the oldest parts of the conversation until it fits budget.
+// Leading system messages, the latest user message and the latest round of tool
+// calls are always kept. Earlier turns are dropped whole, and within the latest turn
+// an assistant message is dropped together with the results of its tool calls, so
+// every remaining tool result still follows its call.
+func dropOldestTurns(px *proxyRequest, messages []Message, budget int) []Message {
+	kept, _ := splitOldest(px.estimator(), messages, budget)
+	return kept
+}
+
+// trimUnit is a run of messages that can only be dropped together
+type trimUnit struct{ start, end int }
+
+// trimUnits returns the parts of the conversation that may be dropped, oldest first:
+// whole turns before the latest user message, then rounds of tool calls after it,
+// except for the latest round. preamble is the number of leading system messages.
+func trimUnits(messages []Message) (preamble int, units []trimUnit) {
+	for preamble < len(messages) && messages[preamble].Role == "system" {
+		preamble++
+	}
+	lastUser := -1
+	for i := len(messages) - 1; i >= preamble; i-- {
+		if messages[i].Role == "user" {
+			lastUser = i
+			break
+		}
+	}
+	if lastUser < 0 {
+		return preamble, nil
+	}
+
+	for i := preamble; i < lastUser; i++ {
+		if i == preamble || messages[i].Role == "user" {
+			units = append(units, trimUnit{start: i, end: lastUser})
+			if n := len(units); n > 1 {
+				units[n-2].end = i
+			}
+		}
+	}
+	var rounds []trimUnit
+	for i := lastUser + 1; i < len(messages); i++ {
+		if messages[i].Role == "assistant" {
+			rounds = append(rounds, trimUnit{start: i, end: len(messages)})
+			if n := len(rounds); n > 1 {
+				rounds[n-2].end = i
+			}
+		}
+	}
+	if len(rounds) > 0 {
+		units = append(units, rounds[:len(rounds)-1]...)
+	}
+	return preamble, units
+}
+
+// splitOldest drops the oldest units until the messages fit budget and returns
+// the messages kept and the ones dropped, both in their original order
+func splitOldest(est tokenizer.Estimator, messages []Message, budget int) (kept, dropped []Message) {
+	_, units := trimUnits(messages)
+	total := messagesTokens(est, messages)
+	drop := make(map[int]bool)
+	for _, u := range units {
+		if total <= budget {
+			break
+		}
+		for i := u.start; i < u.end; i++ {
+			drop[i] = true
+		}
+		total -= messagesTokens(est, messages[u.start:u.end])
+	}
+	if len(drop) == 0 {
+		return messages, nil
+	}
+
+	kept = make([]Message, 0, len(messages)-len(drop))
+	for i, msg := range messages {
+		if drop[i] {
+			dropped = append(dropped, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, dropped
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"cursor-deepseek/recorder"
+	"cursor-deepseek/tracing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Shared client with keepalive so HTTP/2 connections to DeepSeek are reused
+var upstreamClient = &http.Client{
+	Transport: routeTransport{},
+	Timeout:   5 * time.Minute,
+}
+
+// upstreamError is an error response from DeepSeek that is forwarded to the client as is
+type upstreamError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned status %d: %s", e.StatusCode, truncateString(string(e.Body), 200))
+}
+
+// invalidResponseError means the upstream reply still failed validation after all retries
+type invalidResponseError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *invalidResponseError) Error() string {
+	return fmt.Sprintf("invalid response after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// responseCheck validates a completion, and may fix it up in place
+type responseCheck func(resp *ChatResponse) error
+
+// proxyRequest holds what is needed to call DeepSeek on behalf of a client request
+type proxyRequest struct {
+	r         *http.Request
+	apiKey    string // The client key's upstream key, a route's upstream_key replaces it
+	targetURL string
+	route     *Route
+}
+
+// log returns the request's log, where debug lines go for keys with debug logging on
+func (p *proxyRequest) log() *requestLog {
+	return requestLogFrom(p.r.Context())
+}
+
+// send forwards req to DeepSeek and returns the raw response
+func (p *proxyRequest) send(req DeepSeekRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error creating modified request body: %v", err)
+	}
+
+	rl := p.log()
+	rl.logBody("Modified request body", body)
+	rl.debugf("Forwarding to: %s", p.targetURL)
+
+	ctx, span := startUpstreamSpan(p.r.Context(), p.targetURL, req)
+	if p.route != nil {
+		ctx = withUpstreamTransport(ctx, p.route.transport)
+	}
+	proxyReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.targetURL, bytes.NewReader(body))
+	if err != nil {
+		span.End()
+		return nil, fmt.Errorf("error creating proxy request: %v", err)
+	}
+
+	// Copy headers
+	copyHeaders(proxyReq.Header, p.r.Header)
+
+	// Let the upstream correlate its logs with ours
+	if rl.id != "" {
+		proxyReq.Header.Set(requestIDHeader, rl.id)
+	}
+	if sc := span.Context(); sc.IsValid() {
+		proxyReq.Header.Set("traceparent", sc.Traceparent())
+	}
+
+	// Set DeepSeek API key and content type
+	// The client's Accept-Encoding is for the proxy's response, the upstream may send what decodeBody reads
+	proxyReq.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+	apiKey := p.apiKey
+	if p.route != nil && p.route.UpstreamKey != "" {
+		apiKey = p.route.UpstreamKey
+	}
+	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
+	proxyReq.Header.Set("Content-Type", "application/json")
+	if req.Stream {
+		proxyReq.Header.Set("Accept", "text/event-stream")
+	} else {
+		proxyReq.Header.Set("Accept", "application/json")
+	}
+
+	rl.debugf("Proxy request headers: %v", recorder.RedactHeaders(proxyReq.Header))
+
+	var firstToken *tracing.Span
+	if req.Stream {
+		_, firstToken = startSpan(ctx, "time_to_first_token")
+	}
+	resp, err := upstreamClient.Do(proxyReq)
+	if err != nil {
+		span.SetError(err)
+		firstToken.End()
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetError(fmt.Errorf("upstream returned status %d", resp.StatusCode))
+	}
+	if span != nil {
+		resp.Body = &tracedBody{ReadCloser: resp.Body, span: span, firstToken: firstToken}
+	}
+	return resp, nil
+}
+
+// complete sends a non-streaming request and decodes the completion
+func (p *proxyRequest) complete(req DeepSeekRequest) (*ChatResponse, error) {
+	req.Stream = false
+	req.StreamOptions = nil
+	resp, err := p.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	rl := p.log()
+	rl.debugf("DeepSeek response status: %d", resp.StatusCode)
+	rl.logBody("DeepSeek response body", body)
+	if resp.StatusCode >= 400 {
+		upErr := &upstreamError{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+		rl.upstreamErr = upErr
+		return nil, upErr
+	}
+
+	var chatResp ChatResponse
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return nil, fmt.Errorf("error parsing DeepSeek response: %v", err)
+	}
+	span, _ := upstreamSpans(resp)
+	traceResponse(span, &chatResp)
+	// Every attempt is billed, so usage adds up over retries
+	rl.addUsage(req.Model, chatResp.Usage)
+	return &chatResp, nil
+}
+
+// completeWithRetries requests a completion and, while check rejects it, re-asks
+// the model with the validation error up to retries more times
+func (p *proxyRequest) completeWithRetries(req DeepSeekRequest, retries int, check responseCheck) (*ChatResponse, error) {
+	messages := append([]Message(nil), req.Messages...)
+	for attempt := 1; ; attempt++ {
+		req.Messages = messages
+		resp, err := p.complete(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep the reply as the model wrote it, checks may rewrite it
+		var reply *Message
+		if len(resp.Choices) > 0 {
+			raw := resp.Choices[0].Message
+			raw.ToolCalls = append([]ToolCall(nil), raw.ToolCalls...)
+			reply = &raw
+		}
+
+		err = check(resp)
+		if err == nil {
+			return resp, nil
+		}
+		p.log().debugf("Response failed validation on attempt %d: %v", attempt, err)
+		if attempt > retries {
+			return resp, &invalidResponseError{Attempts: attempt, Err: err}
+		}
+
+		// Show the model its previous reply and what was wrong with it. The upstream
+		// rejects tool calls without results, so each call is answered with the error.
+		rejection := fmt.Sprintf("Your previous reply was rejected: %v. Reply again and fix this.", err)
+		if reply != nil {
+			for i := range reply.ToolCalls {
+				if reply.ToolCalls[i].ID == "" {
+					reply.ToolCalls[i].ID = fmt.Sprintf("call_rejected_%d_%d", attempt, i)
+				}
+			}
+			messages = append(messages, *reply)
+			for _, tc := range reply.ToolCalls {
+				messages = append(messages, Message{Role: "tool", ToolCallID: tc.ID, Content: "Not run: " + rejection})
+			}
+		}
+		messages = append(messages, Message{Role: "user", Content: rejection})
+	}
+}
+
+// forwardUpstreamError sends a DeepSeek error response to the client
+func forwardUpstreamError(w http.ResponseWriter, rl *requestLog, e *upstreamError) {
+	rl.logBody("DeepSeek error response", e.Body)
+	copyHeaders(w.Header(), e.Header)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.StatusCode)
+	w.Write(e.Body)
+}
+
+// handleCompletionError reports an error returned by complete or completeWithRetries
+func handleCompletionError(w http.ResponseWriter, rl *requestLog, err error) {
+	var upErr *upstreamError
+	var invalidErr *invalidResponseError
+	switch {
+	case errors.As(err, &upErr):
+		forwardUpstreamError(w, rl, upErr)
+	case errors.Is(err, errResponseTooLarge):
+		errorLog("Error forwarding request: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "upstream_error", "response_too_large", fmt.Sprintf("The upstream response is larger than %d bytes", maxResponseBytes))
+	case errors.As(err, &invalidErr):
+		errorLog("Upstream response rejected: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "upstream_error", "invalid_response", invalidErr.Error())
+	default:
+		errorLog("Error forwarding request: %v", err)
+		http.Error(w, "Error forwarding request", http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,214 @@
+// Package usage keeps a ledger of token usage and cost per API key. Totals are
+// kept per key and UTC day in memory, and records can be appended to a JSONL file
+// that is read back on startup so budgets survive restarts.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record is the usage of one request
+type Record struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id,omitempty"`
+	Key              string    `json:"key"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CachedTokens     int       `json:"cached_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+}
+
+// Total sums records
+type Total struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (t *Total) Add(rec Record) {
+	t.Requests++
+	t.PromptTokens += rec.PromptTokens
+	t.CachedTokens += rec.CachedTokens
+	t.CompletionTokens += rec.CompletionTokens
+	t.Cost += rec.Cost
+}
+
+const dayFormat = "2006-01-02"
+
+type Ledger struct {
+	mu   sync.Mutex
+	file *os.File
+	days map[string]map[string]*Total // Key, then UTC day
+}
+
+// New returns a ledger that is only kept in memory
+func New() *Ledger {
+	return &Ledger{days: make(map[string]map[string]*Total)}
+}
+
+// Open returns a ledger backed by the file at path, loading the records it already
+// holds. Lines that can't be decoded are skipped, the ledger is then returned
+// together with a *MalformedError naming them.
+func Open(path string) (*Ledger, error) {
+	l := New()
+	records, err := Load(path)
+	var malformed *MalformedError
+	if err != nil && !os.IsNotExist(err) && !errors.As(err, &malformed) {
+		return nil, err
+	}
+	for _, rec := range records {
+		l.add(rec)
+	}
+	l.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// A crash in the middle of an append leaves a line without its newline, the
+	// next record must not be written onto it
+	if info, err := l.file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := l.file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := l.file.Write([]byte("\n")); err != nil {
+				l.file.Close()
+				return nil, err
+			}
+		}
+	}
+	if malformed != nil {
+		return l, malformed
+	}
+	return l, nil
+}
+
+// Add records a request's usage
+func (l *Ledger) Add(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.add(rec)
+	if l.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *Ledger) add(rec Record) {
+	days := l.days[rec.Key]
+	if days == nil {
+		days = make(map[string]*Total)
+		l.days[rec.Key] = days
+	}
+	day := rec.Time.UTC().Format(dayFormat)
+	if days[day] == nil {
+		days[day] = &Total{}
+	}
+	days[day].Add(rec)
+}
+
+// Total sums a key's usage on the days from since on, a zero since sums all of it
+func (l *Ledger) Total(key string, since time.Time) Total {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := ""
+	if !since.IsZero() {
+		first = since.UTC().Format(dayFormat)
+	}
+	var total Total
+	for day, t := range l.days[key] {
+		if day >= first {
+			total.Requests += t.Requests
+			total.PromptTokens += t.PromptTokens
+			total.CachedTokens += t.CachedTokens
+			total.CompletionTokens += t.CompletionTokens
+			total.Cost += t.Cost
+		}
+	}
+	return total
+}
+
+// Keys returns the keys with recorded usage, sorted
+func (l *Ledger) Keys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]string, 0, len(l.days))
+	for key := range l.days {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Load reads the records of a ledger file
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// MalformedError names the lines of a ledger that couldn't be decoded, like the
+// partial line a crash in the middle of an append leaves
+type MalformedError struct {
+	Lines []int
+	Err   error // Why the first of them couldn't be decoded
+}
+
+func (e *MalformedError) Error() string {
+	return fmt.Sprintf("skipped %d malformed lines, line %d: %v", len(e.Lines), e.Lines[0], e.Err)
+}
+
+// Read decodes ledger records, one JSON object per line. Lines that can't be decoded
+// are skipped, the records of the others are returned with a *MalformedError.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	var malformed *MalformedError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			if malformed == nil {
+				malformed = &MalformedError{Err: err}
+			}
+			malformed.Lines = append(malformed.Lines, line)
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return records, err
+	}
+	if malformed != nil {
+		return records, malformed
+	}
+	return records, nil
+}
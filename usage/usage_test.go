@@ -0,0 +1,97 @@
+package usage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenSkipsPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	// The last append was cut off by a crash
+	os.WriteFile(path, []byte(`{"time":"2026-10-01T10:00:00Z","key":"alice","model":"deepseek-chat","prompt_tokens":10,"completion_tokens":5,"cost":0.5}`+"\n"+
+		`{"time":"2026-10-01T11:00:00Z","key":"alice","mod`), 0o600)
+
+	l, err := Open(path)
+	var malformed *MalformedError
+	if !errors.As(err, &malformed) || len(malformed.Lines) != 1 || malformed.Lines[0] != 2 {
+		t.Fatalf("got %v", err)
+	}
+	if total := l.Total("alice", time.Time{}); total.Requests != 1 || total.Cost != 0.5 {
+		t.Errorf("got total %+v", total)
+	}
+
+	// New records start on a line of their own
+	if err := l.Add(Record{Time: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC), Key: "alice", Cost: 1}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	records, err := Load(path)
+	if !errors.As(err, &malformed) || len(records) != 2 || records[1].Cost != 1 {
+		t.Errorf("got %+v, %v", records, err)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	records, err := Read(strings.NewReader("{\"key\":\"a\"}\nnot json\n\n{\"key\":\"b\"}\n{\"key\":\n"))
+	var malformed *MalformedError
+	if !errors.As(err, &malformed) || len(malformed.Lines) != 2 || malformed.Lines[0] != 2 || malformed.Lines[1] != 5 {
+		t.Fatalf("got %v", err)
+	}
+	if len(records) != 2 || records[0].Key != "a" || records[1].Key != "b" {
+		t.Errorf("got %+v", records)
+	}
+}
+
+func TestTotal(t *testing.T) {
+	l := New()
+	day := func(d, hour int) time.Time { return time.Date(2026, 10, d, hour, 0, 0, 0, time.UTC) }
+	l.Add(Record{Time: day(1, 23), Key: "alice", PromptTokens: 10, CompletionTokens: 5, Cost: 1})
+	l.Add(Record{Time: day(2, 0), Key: "alice", PromptTokens: 20, CachedTokens: 8, Cost: 2})
+	// 01:00 on the second day in UTC+3 is still the first day in UTC
+	l.Add(Record{Time: time.Date(2026, 10, 2, 1, 0, 0, 0, time.FixedZone("UTC+3", 3*3600)), Key: "alice", Cost: 4})
+	l.Add(Record{Time: day(2, 12), Key: "bob", Cost: 8})
+
+	if total := l.Total("alice", time.Time{}); total != (Total{Requests: 3, PromptTokens: 30, CachedTokens: 8, CompletionTokens: 5, Cost: 7}) {
+		t.Errorf("got total %+v", total)
+	}
+	// Totals since a time count whole UTC days
+	if total := l.Total("alice", day(2, 18)); total.Requests != 1 || total.Cost != 2 {
+		t.Errorf("got total since day 2 %+v", total)
+	}
+	if total := l.Total("carol", time.Time{}); total != (Total{}) {
+		t.Errorf("got total %+v for a key without usage", total)
+	}
+	if keys := l.Keys(); len(keys) != 2 || keys[0] != "alice" || keys[1] != "bob" {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := Record{Time: time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC), RequestID: "req-1", Key: "alice", Model: "deepseek-chat", PromptTokens: 10, CompletionTokens: 5, Cost: 0.25}
+	if err := l.Add(rec); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	records, err := Load(path)
+	if err != nil || len(records) != 1 || records[0] != rec {
+		t.Fatalf("got %+v, %v", records, err)
+	}
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if total := l.Total("alice", time.Time{}); total.Requests != 1 || total.Cost != 0.25 {
+		t.Errorf("got total %+v after reopening", total)
+	}
+}